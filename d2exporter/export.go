@@ -310,6 +310,7 @@ func toConnection(edge *d2graph.Edge, theme *d2themes.Theme) d2target.Connection
 		connection.LabelPercentage = *edge.LabelPercentage
 	}
 	connection.Route = edge.Route
+	connection.JunctionPoints = edge.JunctionPoints
 	connection.IsCurve = edge.IsCurve
 
 	connection.Src = edge.Src.AbsID()
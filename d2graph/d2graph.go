@@ -1061,6 +1061,8 @@ type Edge struct {
 
 	IsCurve bool         `json:"isCurve"`
 	Route   []*geo.Point `json:"route,omitempty"`
+	// JunctionPoints are where this edge splits off from other edges it shares a route with
+	JunctionPoints []*geo.Point `json:"junctionPoints,omitempty"`
 
 	Src          *Object     `json:"-"`
 	SrcArrow     bool        `json:"src_arrow"`
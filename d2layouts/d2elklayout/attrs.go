@@ -0,0 +1,51 @@
+package d2elklayout
+
+import (
+	"strconv"
+
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// withRootAttributes is opts with the spacings the gap attributes on g's root set merged in, so they can be
+// set in the diagram's source: vertical-gap and horizontal-gap, or grid-gap for both, as for grid diagrams.
+// The gap along the layout's direction is the spacing between layers and the one across it the spacing between
+// nodes within them. Spacings set in opts take precedence: NodeSpacing when it's set to other than its default,
+// and the spacings set in opts.Extra. Gaps that aren't whole numbers are ignored.
+//
+// These are the only layout options d2 has keywords for on the root: others, like the algorithm or thoroughness,
+// can't be set in the source. d2 also only accepts the gaps on roots whose containers aren't nested, as it does
+// for grid diagrams, so diagrams with nested containers can't set them.
+func withRootAttributes(g *d2graph.Graph, opts *ConfigurableOpts) *ConfigurableOpts {
+	vertical, horizontal := g.Root.VerticalGap, g.Root.HorizontalGap
+	if g.Root.GridGap != nil {
+		if vertical == nil {
+			vertical = g.Root.GridGap
+		}
+		if horizontal == nil {
+			horizontal = g.Root.GridGap
+		}
+	}
+	if vertical == nil && horizontal == nil {
+		return opts
+	}
+
+	betweenLayers, withinLayers := vertical, horizontal
+	if g.Root.Direction.Value == "right" || g.Root.Direction.Value == "left" {
+		betweenLayers, withinLayers = horizontal, vertical
+	}
+	merged := *opts
+	if _, ok := opts.Extra["spacing.nodeNodeBetweenLayers"]; betweenLayers != nil && !ok && opts.NodeSpacing == DefaultOpts.NodeSpacing {
+		if spacing, err := strconv.Atoi(betweenLayers.Value); err == nil {
+			merged.NodeSpacing = spacing
+		}
+	}
+	if _, ok := opts.Extra["elk.spacing.nodeNode"]; withinLayers != nil && !ok {
+		if _, err := strconv.Atoi(withinLayers.Value); err == nil {
+			merged.Extra = map[string]string{"elk.spacing.nodeNode": withinLayers.Value}
+			for k, v := range opts.Extra {
+				merged.Extra[k] = v
+			}
+		}
+	}
+	return &merged
+}
@@ -0,0 +1,42 @@
+package d2elklayout
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"oss.terrastruct.com/util-go/go2"
+
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// LayoutN lays out graphs like Layout, several at a time on a pool of engines, one for each of up to GOMAXPROCS
+// layouts running at once, so ELK is loaded once per engine rather than once per graph. The pool is let go once
+// the batch is done. The error of each graph is at its index, nil if it was laid out.
+// opts is shared by every layout, so its PreLayout and PostLayout may be called from several goroutines at once.
+func LayoutN(ctx context.Context, graphs []*d2graph.Graph, opts *ConfigurableOpts) []error {
+	errs := make([]error, len(graphs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < go2.Min(runtime.GOMAXPROCS(0), len(graphs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := NewEngine()
+			for i := range next {
+				if err != nil {
+					errs[i] = fmt.Errorf("failed to ELK layout: %v", err)
+					continue
+				}
+				_, _, errs[i] = layout(ctx, e, graphs[i], opts)
+			}
+		}()
+	}
+	for i := range graphs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,59 @@
+package d2elklayout
+
+import (
+	"math"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2target"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/label"
+	"oss.terrastruct.com/d2/lib/shape"
+)
+
+// LabelBounds returns the smallest box containing the labels of every object and edge of g, laid out,
+// where the renderer draws them. Labels outside their objects, or beside their edges, can extend past
+// the boxes of the objects, so canvases sized to objects alone may clip them.
+// It's nil if nothing in g has a label.
+func LabelBounds(g *d2graph.Graph) *geo.Box {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	add := func(tl *geo.Point, width, height float64) {
+		minX, minY = math.Min(minX, tl.X), math.Min(minY, tl.Y)
+		maxX, maxY = math.Max(maxX, tl.X+width), math.Max(maxY, tl.Y+height)
+	}
+
+	for _, obj := range g.Objects {
+		if !obj.HasLabel() || obj.LabelPosition == nil {
+			continue
+		}
+		position := label.Position(*obj.LabelPosition)
+		box := obj.Box
+		if !position.IsOutside() {
+			box = shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(obj.Shape.Value)], obj.Box).GetInnerBox()
+		}
+		width, height := float64(obj.LabelDimensions.Width), float64(obj.LabelDimensions.Height)
+		if tl := position.GetPointOnBox(box, label.PADDING, width, height); tl != nil {
+			add(tl, width, height)
+		}
+	}
+	for _, e := range g.Edges {
+		if e.Label.Value == "" || e.LabelPosition == nil || len(e.Route) < 2 {
+			continue
+		}
+		percentage := 0.
+		if e.LabelPercentage != nil {
+			percentage = *e.LabelPercentage
+		}
+		width, height := float64(e.LabelDimensions.Width), float64(e.LabelDimensions.Height)
+		tl, _ := label.Position(*e.LabelPosition).GetPointOnRoute(e.Route, edgeStrokeWidth(e), percentage, width, height)
+		if tl != nil {
+			add(tl, width, height)
+		}
+	}
+
+	if math.IsInf(minX, 1) {
+		return nil
+	}
+	return geo.NewBox(geo.NewPoint(minX, minY), maxX-minX, maxY-minY)
+}
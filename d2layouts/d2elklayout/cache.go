@@ -0,0 +1,160 @@
+package d2elklayout
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// CachedLayouter lays out graphs like Layout, remembering what ELK computed for the most recent graphs.
+// A graph whose ELK input and retry options match one laid out before takes ELK's output from the cache instead of
+// running ELK again, and the options applied in Go are applied to it as usual. Like an Engine, it lays out one graph
+// at a time.
+type CachedLayouter struct {
+	mu     sync.Mutex
+	engine *Engine
+	cache  *layoutCache
+}
+
+// NewCachedLayouter returns a CachedLayouter that remembers the layouts of up to size graphs,
+// forgetting the least recently used first. ELK is loaded on the first layout that isn't cached.
+func NewCachedLayouter(size int) *CachedLayouter {
+	return &CachedLayouter{
+		cache: &layoutCache{
+			size:    size,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		},
+	}
+}
+
+// Layout is like the package level Layout but through the cache
+func (l *CachedLayouter) Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) error {
+	e, err := l.getEngine()
+	if err != nil {
+		return err
+	}
+	_, _, err = layout(ctx, e, g, opts)
+	return err
+}
+
+func (l *CachedLayouter) getEngine() (*Engine, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.engine == nil {
+		e, err := NewEngine()
+		if err != nil {
+			return nil, err
+		}
+		e.cache = l.cache
+		l.engine = e
+	}
+	return l.engine, nil
+}
+
+type layoutCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key string
+	// output is the graph ELK returned, as JSON so that laying out from it can't change it
+	output []byte
+	// fellBack is whether the layout took opts.FallbackAlgorithm
+	fellBack bool
+}
+
+// layoutELK is like Engine.layoutELK but returns the cached layout of elkGraph under opts if there is one
+func (c *layoutCache) layoutELK(ctx context.Context, e *Engine, g *d2graph.Graph, elkGraph *ELKGraph, opts *ConfigurableOpts) (*ELKGraph, *ConfigurableOpts, error) {
+	key, err := cacheKey(elkGraph, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry, ok := c.get(key); ok {
+		var cached *ELKGraph
+		if err := json.Unmarshal(entry.output, &cached); err != nil {
+			return nil, nil, err
+		}
+		if entry.fellBack {
+			opts = fallback(opts)
+		}
+		return cached, opts, nil
+	}
+
+	out, outOpts, err := e.layoutELK(ctx, g, elkGraph, opts)
+	if err != nil {
+		// What ELK finished before running out of time isn't cached, since it may not be what it would finish
+		return out, outOpts, err
+	}
+	output, err := json.Marshal(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.put(&cacheEntry{
+		key:      key,
+		output:   output,
+		fellBack: outOpts != opts,
+	})
+	return out, outOpts, nil
+}
+
+// cacheKey hashes the ELK input along with the options that change how ELK is run on it: the retries of MaxWidth,
+// the aspect ratio bounds and the fallback algorithm. The other options are either in the input already or only
+// applied in Go to what ELK returns, so layouts differing in those share ELK's output.
+func cacheKey(elkGraph *ELKGraph, opts *ConfigurableOpts) (string, error) {
+	input, err := json.Marshal(elkGraph)
+	if err != nil {
+		return "", err
+	}
+	runOpts, err := json.Marshal(struct {
+		FallbackAlgorithm string
+		MaxWidth          float64
+		MinAspectRatio    float64
+		MaxAspectRatio    float64
+	}{opts.FallbackAlgorithm, opts.MaxWidth, opts.MinAspectRatio, opts.MaxAspectRatio})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(input)
+	h.Write(runOpts)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *layoutCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *layoutCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,80 @@
+package d2elklayout
+
+import (
+	"math"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// centerChildren moves the children of g's containers across them, along with everything inside them, to the middle
+// of the containers' content areas, within their padding, for CenterChildren. Algorithms other than layered leave
+// them at the left of containers wider than they are. Children wider than the content area stay where they are.
+// Routes between the descendants of a moved container move with them, as do their label centers, and routes
+// leaving it are routed again like Reroute does.
+func centerChildren(g *d2graph.Graph, elkNodes map[string]*ELKNode, labelCenters map[*d2graph.Edge]*geo.Point, opts *ConfigurableOpts) {
+	rerouted := make(map[*d2graph.Edge]bool)
+	var center func(*d2graph.Object)
+	center = func(obj *d2graph.Object) {
+		if obj != g.Root && len(obj.ChildrenArray) > 0 {
+			var left, right float64
+			if n := elkNodes[obj.AbsID()]; n != nil && n.LayoutOptions != nil {
+				_, left, _, right, _ = parseSides(n.LayoutOptions.Padding)
+			}
+			minX, maxX := math.Inf(1), math.Inf(-1)
+			for _, ch := range obj.ChildrenArray {
+				minX = math.Min(minX, ch.TopLeft.X)
+				maxX = math.Max(maxX, ch.TopLeft.X+ch.Width)
+			}
+			areaMin, areaMax := obj.TopLeft.X+left, obj.TopLeft.X+obj.Width-right
+			dx := (areaMin+areaMax)/2 - (minX+maxX)/2
+			if maxX-minX <= areaMax-areaMin && math.Abs(dx) >= geo.PRECISION {
+				shiftDescendants(g, obj, dx, labelCenters, rerouted)
+			}
+		}
+		for _, ch := range obj.ChildrenArray {
+			center(ch)
+		}
+	}
+	center(g.Root)
+
+	var bands []labelBand
+	if opts.AvoidContainerLabels {
+		bands = labelBands(g)
+	}
+	for _, e := range g.Edges {
+		if !rerouted[e] {
+			continue
+		}
+		e.Route = orthogonalRoute(g, bands, e, opts)
+		e.JunctionPoints = nil
+		repairRoute(g, bands, e)
+	}
+}
+
+// shiftDescendants moves the descendants of obj dx across, with the routes between them.
+// Edges between them and what stays put are marked in rerouted to be routed again.
+func shiftDescendants(g *d2graph.Graph, obj *d2graph.Object, dx float64, labelCenters map[*d2graph.Edge]*geo.Point, rerouted map[*d2graph.Edge]bool) {
+	inside := func(o *d2graph.Object) bool {
+		return o != obj && o.IsDescendantOf(obj)
+	}
+	for _, o := range g.Objects {
+		if inside(o) {
+			o.TopLeft = geo.NewPoint(o.TopLeft.X+dx, o.TopLeft.Y)
+		}
+	}
+	for _, e := range g.Edges {
+		switch {
+		case inside(e.Src) && inside(e.Dst):
+			movePoints(e, func(p *geo.Point) *geo.Point {
+				p.X += dx
+				return p
+			})
+			if c, ok := labelCenters[e]; ok {
+				labelCenters[e] = geo.NewPoint(c.X+dx, c.Y)
+			}
+		case inside(e.Src) || inside(e.Dst):
+			rerouted[e] = true
+		}
+	}
+}
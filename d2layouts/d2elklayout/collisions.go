@@ -0,0 +1,210 @@
+package d2elklayout
+
+import (
+	"math"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/label"
+)
+
+// collisionCellSize is the width and height of the cells of a collisionIndex
+var collisionCellSize = 4 * float64(edge_node_spacing)
+
+// collisionMargin is how far from a segment objects and other segments can be and still count against it.
+// It's more than the buffers countObjectIntersects and countEdgeIntersects use, so the index never misses one.
+var collisionMargin = float64(edge_node_spacing)
+
+// collisionIndex is a grid of the boxes of g's objects, and of their outside labels, and the segments of its routes,
+// so that counting what a segment runs into only tests what's near it instead of the whole graph.
+// It counts the same as countObjectIntersects and countEdgeIntersects, as long as the routes
+// it's told about with updateEdge are the ones in g. Objects and segments spanning several cells are
+// only counted in the cell holding the top left corner of where they overlap the segment's bounds,
+// so each is counted once without keeping track of them.
+type collisionIndex struct {
+	g        *d2graph.Graph
+	objects  map[gridCell][]indexedObject
+	segments map[gridCell][]indexedSegment
+	// edgeCells are the cells holding the segments of each edge, by index in g.Edges
+	edgeCells [][]gridCell
+}
+
+type gridCell struct {
+	x, y int
+}
+
+type indexedObject struct {
+	obj *d2graph.Object
+	// labelBox is the box of obj's outside label if that's what's indexed, rather than obj
+	labelBox *geo.Box
+	// bounds is the object's or label's box grown by collisionMargin
+	bounds bounds
+}
+
+type indexedSegment struct {
+	edge    *d2graph.Edge
+	segment geo.Segment
+	// bounds is the segment's bounding box grown by collisionMargin
+	bounds bounds
+}
+
+type bounds struct {
+	minX, minY, maxX, maxY float64
+}
+
+func segmentBounds(s geo.Segment) bounds {
+	return bounds{
+		minX: math.Min(s.Start.X, s.End.X),
+		minY: math.Min(s.Start.Y, s.End.Y),
+		maxX: math.Max(s.Start.X, s.End.X),
+		maxY: math.Max(s.Start.Y, s.End.Y),
+	}
+}
+
+func (b bounds) grow(margin float64) bounds {
+	return bounds{b.minX - margin, b.minY - margin, b.maxX + margin, b.maxY + margin}
+}
+
+// intersect is the overlap of b and other, and whether there is one
+func (b bounds) intersect(other bounds) (bounds, bool) {
+	out := bounds{
+		minX: math.Max(b.minX, other.minX),
+		minY: math.Max(b.minY, other.minY),
+		maxX: math.Min(b.maxX, other.maxX),
+		maxY: math.Min(b.maxY, other.maxY),
+	}
+	return out, out.minX <= out.maxX && out.minY <= out.maxY
+}
+
+func cellAt(x, y float64) gridCell {
+	return gridCell{int(math.Floor(x / collisionCellSize)), int(math.Floor(y / collisionCellSize))}
+}
+
+// cells calls f with every cell b covers
+func (b bounds) cells(f func(gridCell)) {
+	min, max := cellAt(b.minX, b.minY), cellAt(b.maxX, b.maxY)
+	for x := min.x; x <= max.x; x++ {
+		for y := min.y; y <= max.y; y++ {
+			f(gridCell{x, y})
+		}
+	}
+}
+
+func newCollisionIndex(g *d2graph.Graph) *collisionIndex {
+	idx := &collisionIndex{
+		g:         g,
+		objects:   make(map[gridCell][]indexedObject),
+		segments:  make(map[gridCell][]indexedSegment),
+		edgeCells: make([][]gridCell, len(g.Edges)),
+	}
+	for _, obj := range g.Objects {
+		io := indexedObject{
+			obj: obj,
+			bounds: bounds{
+				obj.TopLeft.X, obj.TopLeft.Y, obj.TopLeft.X + obj.Width, obj.TopLeft.Y + obj.Height,
+			}.grow(collisionMargin),
+		}
+		io.bounds.cells(func(c gridCell) {
+			idx.objects[c] = append(idx.objects[c], io)
+		})
+		if box := outsideLabelBox(obj); box != nil {
+			il := indexedObject{
+				obj:      obj,
+				labelBox: box,
+				bounds: bounds{
+					box.TopLeft.X, box.TopLeft.Y, box.TopLeft.X + box.Width, box.TopLeft.Y + box.Height,
+				}.grow(collisionMargin),
+			}
+			il.bounds.cells(func(c gridCell) {
+				idx.objects[c] = append(idx.objects[c], il)
+			})
+		}
+	}
+	for ei := range g.Edges {
+		idx.addEdge(ei)
+	}
+	return idx
+}
+
+func (idx *collisionIndex) addEdge(ei int) {
+	e := idx.g.Edges[ei]
+	for i := 0; i < len(e.Route)-1; i++ {
+		s := *geo.NewSegment(e.Route[i], e.Route[i+1])
+		is := indexedSegment{
+			edge:    e,
+			segment: s,
+			bounds:  segmentBounds(s).grow(collisionMargin),
+		}
+		is.bounds.cells(func(c gridCell) {
+			idx.segments[c] = append(idx.segments[c], is)
+			idx.edgeCells[ei] = append(idx.edgeCells[ei], c)
+		})
+	}
+}
+
+// updateEdge reindexes the route of g.Edges[ei] after it's changed
+func (idx *collisionIndex) updateEdge(ei int) {
+	e := idx.g.Edges[ei]
+	for _, c := range idx.edgeCells[ei] {
+		kept := idx.segments[c][:0]
+		for _, is := range idx.segments[c] {
+			if is.edge != e {
+				kept = append(kept, is)
+			}
+		}
+		idx.segments[c] = kept
+	}
+	idx.edgeCells[ei] = idx.edgeCells[ei][:0]
+	idx.addEdge(ei)
+}
+
+// countObjectIntersects is countObjectIntersects(idx.g, src, dst, s)
+func (idx *collisionIndex) countObjectIntersects(src, dst *d2graph.Object, s geo.Segment) int {
+	count := 0
+	query := segmentBounds(s)
+	query.cells(func(c gridCell) {
+		for _, io := range idx.objects[c] {
+			if io.obj == src || io.obj == dst {
+				continue
+			}
+			overlap, ok := io.bounds.intersect(query)
+			if !ok || cellAt(overlap.minX, overlap.minY) != c {
+				continue
+			}
+			if io.labelBox != nil {
+				if io.labelBox.Intersects(s, label.PADDING) {
+					count++
+				}
+			} else if io.obj.Intersects(s, float64(edge_node_spacing)-1) {
+				count++
+			}
+		}
+	})
+	return count
+}
+
+// countEdgeIntersects is countEdgeIntersects(idx.g, sEdge, s)
+func (idx *collisionIndex) countEdgeIntersects(sEdge *d2graph.Edge, s geo.Segment) (int, int, int, int) {
+	crossingsCount := 0
+	overlapsCount := 0
+	closeOverlapsCount := 0
+	touchingCount := 0
+	query := segmentBounds(s)
+	query.cells(func(c gridCell) {
+		for _, is := range idx.segments[c] {
+			if is.edge == sEdge {
+				continue
+			}
+			overlap, ok := is.bounds.intersect(query)
+			if !ok || cellAt(overlap.minX, overlap.minY) != c {
+				continue
+			}
+			crossing, overlaps, closeOverlaps, touching := countSegmentIntersects(s, is.segment)
+			crossingsCount += crossing
+			overlapsCount += overlaps
+			closeOverlapsCount += closeOverlaps
+			touchingCount += touching
+		}
+	})
+	return crossingsCount, overlapsCount, closeOverlapsCount, touchingCount
+}
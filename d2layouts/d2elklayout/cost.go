@@ -0,0 +1,32 @@
+package d2elklayout
+
+import (
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// Cost is a cheap estimate of how expensive it is to lay out a graph with ELK.
+type Cost struct {
+	Nodes    int `json:"nodes"`
+	Edges    int `json:"edges"`
+	MaxDepth int `json:"maxDepth"`
+	// Score combines the counts. It's only meaningful compared to other scores,
+	// and grows with each of them.
+	Score float64 `json:"score"`
+}
+
+// EstimateCost estimates the cost of laying out g without running ELK
+func EstimateCost(g *d2graph.Graph) Cost {
+	c := Cost{
+		Nodes: len(g.Objects),
+		Edges: len(g.Edges),
+	}
+	for _, obj := range g.Objects {
+		if depth := int(obj.Level()); depth > c.MaxDepth {
+			c.MaxDepth = depth
+		}
+	}
+	// Layered's crossing minimization dominates, growing with nodes*edges,
+	// and each level of nesting adds to the hierarchy it sweeps through
+	c.Score = float64(c.Nodes+c.Edges) + float64(c.Nodes)*float64(c.Edges+1)*float64(c.MaxDepth)
+	return c
+}
@@ -0,0 +1,92 @@
+package d2elklayout
+
+import (
+	"oss.terrastruct.com/util-go/go2"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// CountCrossings counts the places where the routes of two laid out edges of g cross,
+// the way bend deletion counts the crossings it mustn't add. Runs of edges alongside each other don't count.
+func CountCrossings(g *d2graph.Graph) int {
+	count := 0
+	for i, e := range g.Edges {
+		for _, other := range g.Edges[i+1:] {
+			for j := 0; j < len(e.Route)-1; j++ {
+				s := *geo.NewSegment(e.Route[j], e.Route[j+1])
+				for k := 0; k < len(other.Route)-1; k++ {
+					if crosses(s, *geo.NewSegment(other.Route[k], other.Route[k+1])) {
+						count++
+					}
+				}
+			}
+		}
+	}
+	return count
+}
+
+// passReach is how far from a segment an object can be for the segment to pass it, as far as uncross is concerned
+var passReach = 2 * float64(edge_node_spacing)
+
+// uncross reroutes the edges of g that cross others around the other side of the objects they pass, for AvoidCrossings.
+// Of the detours from each segment around the objects within passReach of it, the one crossing the fewest edges
+// is taken, or the shortest of those, if it crosses fewer than the route it replaces and runs into no more objects
+// or bands. Each edge is rerouted until none of its detours helps.
+func uncross(g *d2graph.Graph, bands []labelBand, opts *ConfigurableOpts) {
+	for _, e := range g.Edges {
+		if _, ok := opts.Waypoints[e.AbsID()]; ok {
+			continue
+		}
+		if e.Src == e.Dst || opts.EdgeRouting[e.AbsID()] == "STRAIGHT" || go2.Contains(opts.CriticalEdges, e.AbsID()) {
+			continue
+		}
+		crossings := routeCrossings(g, e, e.Route)
+		for attempt := 0; crossings > 0 && attempt < len(g.Objects); attempt++ {
+			collisions := countCollisions(g, bands, e, e.Route)
+			var best []*geo.Point
+			bestCrossings := crossings
+			for i := 0; i < len(e.Route)-1; i++ {
+				s := *geo.NewSegment(e.Route[i], e.Route[i+1])
+				for _, obj := range g.Objects {
+					if !isObstacle(e, obj) || !obj.Box.Intersects(s, passReach) {
+						continue
+					}
+					for _, route := range detours(e.Route, i, obj.Box) {
+						if countCollisions(g, bands, e, route) > collisions {
+							continue
+						}
+						if c := routeCrossings(g, e, route); c < bestCrossings ||
+							(best != nil && c == bestCrossings && geo.Route(route).Length() < geo.Route(best).Length()) {
+							best, bestCrossings = route, c
+						}
+					}
+				}
+			}
+			if best == nil {
+				break
+			}
+			e.Route, crossings = best, bestCrossings
+			e.JunctionPoints = nil
+		}
+	}
+}
+
+// routeCrossings counts the places where route, for e, crosses the routes of the other edges of g
+func routeCrossings(g *d2graph.Graph, e *d2graph.Edge, route []*geo.Point) int {
+	count := 0
+	for _, other := range g.Edges {
+		if other == e {
+			continue
+		}
+		for j := 0; j < len(route)-1; j++ {
+			s := *geo.NewSegment(route[j], route[j+1])
+			for k := 0; k < len(other.Route)-1; k++ {
+				if crosses(s, *geo.NewSegment(other.Route[k], other.Route[k+1])) {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
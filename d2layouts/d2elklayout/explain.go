@@ -0,0 +1,56 @@
+package d2elklayout
+
+import (
+	"encoding/json"
+
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// ExplainOptions returns the ELK options that laying out g with opts would set on the root, keyed by "root",
+// and on each container, keyed by its absolute ID. Each is a map from ELK option key to value, including the
+// minimum sizes of containers under elk.nodeSize.minimum, as adjusted by opts.ContainerMinimumSize.
+// ELK isn't run and g is left as is, though opts.PreLayout is called.
+func ExplainOptions(g *d2graph.Graph, opts *ConfigurableOpts) map[string]interface{} {
+	// Building the ELK graph resizes objects to fit their ports and labels
+	type size struct {
+		width, height float64
+	}
+	sizes := make(map[*d2graph.Object]size, len(g.Objects))
+	for _, obj := range g.Objects {
+		sizes[obj] = size{obj.Width, obj.Height}
+	}
+	elkGraph := BuildELKGraph(g, opts)
+	if opts != nil && opts.PreLayout != nil {
+		opts.PreLayout(elkGraph)
+	}
+	for obj, s := range sizes {
+		obj.Width, obj.Height = s.width, s.height
+	}
+
+	explanation := map[string]interface{}{
+		elkGraph.ID: flattenOpts(elkGraph.LayoutOptions),
+	}
+	var explainNodes func([]*ELKNode)
+	explainNodes = func(nodes []*ELKNode) {
+		for _, n := range nodes {
+			if len(n.Children) == 0 {
+				continue
+			}
+			explanation[n.ID] = flattenOpts(n.LayoutOptions)
+			explainNodes(n.Children)
+		}
+	}
+	explainNodes(elkGraph.Children)
+	return explanation
+}
+
+// flattenOpts is opts as they're sent to ELK
+func flattenOpts(opts *elkOpts) map[string]interface{} {
+	flat := make(map[string]interface{})
+	raw, err := json.Marshal(opts)
+	if err != nil {
+		return flat
+	}
+	_ = json.Unmarshal(raw, &flat)
+	return flat
+}
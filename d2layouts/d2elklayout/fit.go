@@ -0,0 +1,108 @@
+package d2elklayout
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// LayoutToBox lays out g like Layout, then scales it to fit within box, keeping its aspect ratio, and centers it there.
+// Objects, routes and junction points are scaled, but labels and icons keep their size,
+// so labels that outgrow objects scaled down may overflow them.
+func LayoutToBox(ctx context.Context, g *d2graph.Graph, box geo.Box, opts *ConfigurableOpts) error {
+	if box.Width <= 0 || box.Height <= 0 {
+		return fmt.Errorf("failed to ELK layout: box must be wider and taller than 0, got %vx%v", box.Width, box.Height)
+	}
+	if opts == nil {
+		opts = &DefaultOpts
+	}
+	// Routes are scaled with the objects, so they're made relative once they're in place
+	absolute := *opts
+	absolute.RouteCoordinateSpace = ""
+	if _, _, err := layout(ctx, nil, g, &absolute); err != nil {
+		return err
+	}
+	scaleToBox(g, box)
+	if opts.RouteCoordinateSpace == "container-relative" {
+		relativizeRoutes(g.Edges)
+	}
+	return nil
+}
+
+// scaleToBox scales and moves the laid out g to fit within box, centered
+func scaleToBox(g *d2graph.Graph, box geo.Box) {
+	bounds := contentBounds(g)
+	if bounds == nil {
+		return
+	}
+	scale := math.Inf(1)
+	if bounds.Width > 0 {
+		scale = box.Width / bounds.Width
+	}
+	if bounds.Height > 0 {
+		scale = math.Min(scale, box.Height/bounds.Height)
+	}
+	if math.IsInf(scale, 1) {
+		scale = 1
+	}
+	// Where the top left of bounds lands, for the scaled content to be centered
+	x := box.TopLeft.X + (box.Width-bounds.Width*scale)/2
+	y := box.TopLeft.Y + (box.Height-bounds.Height*scale)/2
+	transform := func(p *geo.Point) *geo.Point {
+		return geo.NewPoint(x+(p.X-bounds.TopLeft.X)*scale, y+(p.Y-bounds.TopLeft.Y)*scale)
+	}
+
+	for _, obj := range g.Objects {
+		obj.TopLeft = transform(obj.TopLeft)
+		obj.Width *= scale
+		obj.Height *= scale
+	}
+	for _, e := range g.Edges {
+		movePoints(e, transform)
+	}
+}
+
+// scaleWithin scales the laid out g down to fit within max from where it is, for MaxDimensions
+func scaleWithin(g *d2graph.Graph, max geo.Point) {
+	bounds := contentBounds(g)
+	if bounds == nil {
+		return
+	}
+	scale := 1.
+	if max.X > 0 && bounds.Width > max.X {
+		scale = max.X / bounds.Width
+	}
+	if max.Y > 0 && bounds.Height > max.Y {
+		scale = math.Min(scale, max.Y/bounds.Height)
+	}
+	if scale == 1 {
+		return
+	}
+	scaleToBox(g, *geo.NewBox(bounds.TopLeft, bounds.Width*scale, bounds.Height*scale))
+}
+
+// contentBounds is the smallest box containing the objects and routes of the laid out g, or nil if it has neither
+func contentBounds(g *d2graph.Graph) *geo.Box {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	add := func(x, y float64) {
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	for _, obj := range g.Objects {
+		add(obj.TopLeft.X, obj.TopLeft.Y)
+		add(obj.TopLeft.X+obj.Width, obj.TopLeft.Y+obj.Height)
+	}
+	for _, e := range g.Edges {
+		for _, p := range e.Route {
+			add(p.X, p.Y)
+		}
+	}
+	if math.IsInf(minX, 1) {
+		return nil
+	}
+	return geo.NewBox(geo.NewPoint(minX, minY), maxX-minX, maxY-minY)
+}
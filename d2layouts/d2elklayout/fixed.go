@@ -0,0 +1,236 @@
+package d2elklayout
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"oss.terrastruct.com/util-go/go2"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/label"
+)
+
+// fixedContainers are the containers of FixedContainers, set aside from g while it's laid out
+// so that ELK sees each as a single box
+type fixedContainers struct {
+	// objects and edges are g's before any were set aside
+	objects []*d2graph.Object
+	edges   []*d2graph.Edge
+	// containers are the outermost fixed containers, in the order of g.Objects
+	containers []*d2graph.Object
+	// children are the children of each fixed container and its descendants
+	children map[*d2graph.Object][]*d2graph.Object
+	// internal are the edges between the descendants of the fixed containers
+	internal []*d2graph.Edge
+}
+
+// setAsideFixedContainers sizes the containers of ids to fit their descendants at their top and left
+// and takes the descendants out of g, along with the edges between them.
+// Edges crossing into a fixed container are rejected, since ELK has nothing to route them to.
+func setAsideFixedContainers(g *d2graph.Graph, ids []string) (*fixedContainers, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	fixed := make(map[*d2graph.Object]struct{})
+	for _, id := range sorted {
+		obj, ok := objects[id]
+		if !ok {
+			return nil, fmt.Errorf("fixed layout on unknown object %#v", id)
+		}
+		if len(obj.ChildrenArray) == 0 {
+			return nil, fmt.Errorf("fixed layout on %#v, which isn't a container", id)
+		}
+		fixed[obj] = struct{}{}
+	}
+
+	f := &fixedContainers{
+		objects:  g.Objects,
+		edges:    g.Edges,
+		children: make(map[*d2graph.Object][]*d2graph.Object),
+	}
+	// container is the outermost fixed container obj is inside of, if any
+	container := make(map[*d2graph.Object]*d2graph.Object)
+	for _, obj := range g.Objects {
+		if _, ok := fixed[obj]; !ok {
+			continue
+		}
+		if _, ok := container[obj]; ok {
+			continue
+		}
+		f.containers = append(f.containers, obj)
+		var err error
+		walk(obj, nil, func(desc, _ *d2graph.Object) {
+			if desc == obj || err != nil {
+				return
+			}
+			if desc.Top == nil || desc.Left == nil {
+				err = fmt.Errorf("%#v has no top and left to be placed at in fixed container %#v", desc.AbsID(), obj.AbsID())
+			}
+			container[desc] = obj
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range g.Edges {
+		src, dst := container[e.Src], container[e.Dst]
+		if src != dst {
+			if src == nil {
+				src = dst
+			}
+			return nil, fmt.Errorf("edge %#v crosses into fixed container %#v", e.AbsID(), src.AbsID())
+		}
+		if src != nil && e.Src == e.Dst {
+			return nil, fmt.Errorf("self-loop %#v in fixed container %#v", e.AbsID(), src.AbsID())
+		}
+	}
+
+	for _, obj := range f.containers {
+		f.setAside(obj)
+	}
+	g.Objects = nil
+	for _, obj := range f.objects {
+		if _, ok := container[obj]; !ok {
+			g.Objects = append(g.Objects, obj)
+		}
+	}
+	g.Edges = nil
+	for _, e := range f.edges {
+		if _, ok := container[e.Src]; ok {
+			f.internal = append(f.internal, e)
+		} else {
+			g.Edges = append(g.Edges, e)
+		}
+	}
+	return f, nil
+}
+
+// setAside sizes obj to fit its children at their offsets and detaches them, deepest first.
+// Without a declared size, obj extends as far past its children on the right and bottom
+// as the nearest of them are in from the left and top.
+func (f *fixedContainers) setAside(obj *d2graph.Object) {
+	if len(obj.ChildrenArray) == 0 {
+		return
+	}
+	minLeft, minTop := math.Inf(1), math.Inf(1)
+	right, bottom := 0., 0.
+	for _, ch := range obj.ChildrenArray {
+		f.setAside(ch)
+		left, top := offset(ch)
+		minLeft, minTop = math.Min(minLeft, left), math.Min(minTop, top)
+		right, bottom = math.Max(right, left+ch.Width), math.Max(bottom, top+ch.Height)
+	}
+	if obj.WidthAttr == nil {
+		obj.Width = math.Max(obj.Width, right+minLeft)
+	}
+	if obj.HeightAttr == nil {
+		obj.Height = math.Max(obj.Height, bottom+minTop)
+	}
+	f.children[obj] = obj.ChildrenArray
+	obj.ChildrenArray = nil
+}
+
+// offset is where obj is placed within its parent, by its top and left
+func offset(obj *d2graph.Object) (left, top float64) {
+	l, _ := strconv.Atoi(obj.Left.Value)
+	t, _ := strconv.Atoi(obj.Top.Value)
+	return float64(l), float64(t)
+}
+
+// place positions the descendants of the laid out fixed containers at their offsets
+// and routes the edges between them straight
+func (f *fixedContainers) place(opts *ConfigurableOpts, stats *Stats) {
+	if f == nil {
+		return
+	}
+	var place func(*d2graph.Object)
+	place = func(obj *d2graph.Object) {
+		for _, ch := range f.children[obj] {
+			left, top := offset(ch)
+			ch.TopLeft = geo.NewPoint(obj.TopLeft.X+left, obj.TopLeft.Y+top)
+			place(ch)
+		}
+		if len(f.children[obj]) > 0 {
+			if obj.HasLabel() {
+				obj.LabelPosition = go2.Pointer(string(containerLabelPosition(obj, opts)))
+			}
+			if obj.Icon != nil {
+				obj.IconPosition = go2.Pointer(string(containerIconPosition(opts)))
+				obj.LabelPosition = go2.Pointer(string(containerLabelPosition(obj, opts)))
+			}
+			return
+		}
+		if obj.HasLabel() {
+			if obj.HasOutsideBottomLabel() {
+				obj.LabelPosition = go2.Pointer(string(label.OutsideBottomCenter))
+			} else if obj.Icon != nil {
+				obj.LabelPosition = go2.Pointer(string(label.InsideTopCenter))
+			} else {
+				obj.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+			}
+		}
+		if obj.Icon != nil {
+			obj.IconPosition = go2.Pointer(string(label.InsideMiddleCenter))
+		}
+	}
+	for _, obj := range f.containers {
+		place(obj)
+	}
+	for _, e := range f.internal {
+		e.Route = guardRoute(e, straightRoute(e), stats)
+		if e.Label.Value != "" {
+			e.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+		}
+	}
+}
+
+// restore puts what was set aside back into g
+func (f *fixedContainers) restore(g *d2graph.Graph) {
+	if f == nil {
+		return
+	}
+	for obj, children := range f.children {
+		obj.ChildrenArray = children
+	}
+	g.Objects = f.objects
+	g.Edges = f.edges
+}
+
+// whole is g with what f set aside in it, for passes over the finished layout, before it's restored
+func (f *fixedContainers) whole(g *d2graph.Graph) *d2graph.Graph {
+	if f == nil {
+		return g
+	}
+	return &d2graph.Graph{Root: g.Root, Objects: f.objects, Edges: f.edges}
+}
+
+// dropEdges takes the edges of ids out of g, including what f restores and places
+func dropEdges(g *d2graph.Graph, f *fixedContainers, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	without := func(edges []*d2graph.Edge) []*d2graph.Edge {
+		var kept []*d2graph.Edge
+		for _, e := range edges {
+			if !go2.Contains(ids, e.AbsID()) {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	}
+	g.Edges = without(g.Edges)
+	if f != nil {
+		f.edges = without(f.edges)
+		f.internal = without(f.internal)
+	}
+}
@@ -0,0 +1,56 @@
+package d2elklayout
+
+import (
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// elkDirection is the ELK direction of a d2 direction, DOWN if it's unset
+func elkDirection(direction string) string {
+	switch direction {
+	case "up":
+		return "UP"
+	case "right":
+		return "RIGHT"
+	case "left":
+		return "LEFT"
+	default:
+		return "DOWN"
+	}
+}
+
+// flowDirection is the ELK direction the children of obj flow in: its own direction,
+// else that of the nearest container around it with one, else the diagram's
+func flowDirection(obj *d2graph.Object) string {
+	for o := obj; o != nil; o = o.Parent {
+		if o.Direction.Value != "" {
+			return elkDirection(o.Direction.Value)
+		}
+	}
+	return elkDirection("")
+}
+
+// flipsFlow reports whether obj is a container whose direction turns the flow of its children from that around it.
+// ELK only takes the direction of the root of a hierarchy it lays out at once,
+// so the children of a container that flips the flow are laid out separately.
+func flipsFlow(obj *d2graph.Object) bool {
+	return obj.Parent != nil && len(obj.ChildrenArray) > 0 && obj.Direction.Value != "" &&
+		flowDirection(obj) != flowDirection(obj.Parent)
+}
+
+// flowEndpoint is what ELK connects the end of an edge at obj to, coming from other.
+// ELK can't route edges into the separate layout of a container that flips the flow,
+// so they end on the outermost such container around obj that other is outside of instead.
+func flowEndpoint(obj, other *d2graph.Object) *d2graph.Object {
+	end := obj
+	for o := obj.Parent; o != nil; o = o.Parent {
+		if flipsFlow(o) && (other == o || !other.IsDescendantOf(o)) {
+			end = o
+		}
+	}
+	return end
+}
+
+// crossesFlow reports whether ELK laid e out to a container that flips the flow rather than to its endpoints
+func crossesFlow(e *d2graph.Edge) bool {
+	return flowEndpoint(e.Src, e.Dst) != e.Src || flowEndpoint(e.Dst, e.Src) != e.Dst
+}
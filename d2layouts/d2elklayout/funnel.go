@@ -0,0 +1,87 @@
+package d2elklayout
+
+import (
+	"strings"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2target"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/shape"
+)
+
+// funnelEdges routes the edges entering a node on the same side, two or more of them, into one entry point in the
+// middle of that side, for FunnelEdges. They turn in along a line length out of the side and run into the entry
+// together. Edges whose last segment doesn't run square into the side from at least length out are left as they are,
+// as are those skip reports and those the funnel would run through more objects or bands than before.
+func funnelEdges(g *d2graph.Graph, bands []labelBand, length float64, skip func(*d2graph.Edge) bool) {
+	type entry struct {
+		obj  *d2graph.Object
+		side string
+	}
+	var entries []entry
+	entering := make(map[entry][]*d2graph.Edge)
+	for _, e := range g.Edges {
+		if e.Src == e.Dst || skip(e) {
+			continue
+		}
+		side := entrySide(e.Route, e.Dst.Box, length)
+		if side == "" {
+			continue
+		}
+		k := entry{e.Dst, side}
+		if _, ok := entering[k]; !ok {
+			entries = append(entries, k)
+		}
+		entering[k] = append(entering[k], e)
+	}
+
+	for _, k := range entries {
+		edges := entering[k]
+		if len(edges) < 2 {
+			continue
+		}
+		box := k.obj.Box
+		normal := sideNormal(k.side)
+		center := box.Center()
+		point := geo.NewPoint(center.X+normal[0]*box.Width/2, center.Y+normal[1]*box.Height/2)
+		line := point.AddVector(normal.Multiply(length))
+		s := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(k.obj.Shape.Value)], box)
+		point = shape.TraceToShapeBorder(s, point, line)
+		for _, e := range edges {
+			last := e.Route[len(e.Route)-1]
+			turn := geo.NewPoint(last.X, line.Y)
+			if normal[0] != 0 {
+				turn = geo.NewPoint(line.X, last.Y)
+			}
+			route := append([]*geo.Point{}, e.Route[:len(e.Route)-1]...)
+			for _, p := range []*geo.Point{turn, line, point} {
+				if prev := route[len(route)-1]; !sameCoordinate(prev.X, p.X) || !sameCoordinate(prev.Y, p.Y) {
+					route = append(route, geo.NewPoint(p.X, p.Y))
+				}
+			}
+			if countCollisions(g, bands, e, route) <= countCollisions(g, bands, e, e.Route) {
+				e.Route = route
+			}
+		}
+	}
+}
+
+// entrySide is the ELK port side of box that route's last segment runs square into from at least length out of it,
+// or "" if it doesn't
+func entrySide(route []*geo.Point, box *geo.Box, length float64) string {
+	if len(route) < 2 {
+		return ""
+	}
+	prev, last := route[len(route)-2], route[len(route)-1]
+	switch {
+	case sameCoordinate(prev.X, last.X) && prev.Y <= box.TopLeft.Y-length:
+		return "NORTH"
+	case sameCoordinate(prev.X, last.X) && prev.Y >= box.TopLeft.Y+box.Height+length:
+		return "SOUTH"
+	case sameCoordinate(prev.Y, last.Y) && prev.X <= box.TopLeft.X-length:
+		return "WEST"
+	case sameCoordinate(prev.Y, last.Y) && prev.X >= box.TopLeft.X+box.Width+length:
+		return "EAST"
+	}
+	return ""
+}
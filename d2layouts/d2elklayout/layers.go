@@ -0,0 +1,96 @@
+package d2elklayout
+
+import (
+	"math"
+	"sort"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// spaceLayers moves the layers of g's top-level objects along the layout's direction, with everything inside them,
+// so that their centers are distance apart, for LayerDistance. Top-level objects spanning across each other along
+// the direction are in the same layer, and the first layer stays put. Routes between objects moved alike move with
+// them, as do their label centers, and the others are routed again like Reroute does.
+func spaceLayers(g *d2graph.Graph, distance float64, labelCenters map[*d2graph.Edge]*geo.Point, opts *ConfigurableOpts) {
+	vertical := g.Root.Direction.Value != "right" && g.Root.Direction.Value != "left"
+	span := func(obj *d2graph.Object) (float64, float64) {
+		if vertical {
+			return obj.TopLeft.Y, obj.TopLeft.Y + obj.Height
+		}
+		return obj.TopLeft.X, obj.TopLeft.X + obj.Width
+	}
+
+	tops := append([]*d2graph.Object{}, g.Root.ChildrenArray...)
+	sort.SliceStable(tops, func(i, j int) bool {
+		a, _ := span(tops[i])
+		b, _ := span(tops[j])
+		return a < b
+	})
+	moves := make(map[*d2graph.Object]float64)
+	var layer []*d2graph.Object
+	layerStart, layerEnd := math.Inf(-1), math.Inf(-1)
+	firstCenter := math.NaN()
+	placed := 0
+	closeLayer := func() {
+		if len(layer) == 0 {
+			return
+		}
+		center := (layerStart + layerEnd) / 2
+		if math.IsNaN(firstCenter) {
+			firstCenter = center
+		}
+		d := firstCenter + float64(placed)*distance - center
+		for _, obj := range layer {
+			moves[obj] = d
+		}
+		placed++
+		layer = nil
+	}
+	for _, obj := range tops {
+		start, end := span(obj)
+		if start >= layerEnd {
+			closeLayer()
+			layerStart = start
+		}
+		layer = append(layer, obj)
+		layerEnd = math.Max(layerEnd, end)
+	}
+	closeLayer()
+
+	top := func(obj *d2graph.Object) *d2graph.Object {
+		for obj.Parent != g.Root {
+			obj = obj.Parent
+		}
+		return obj
+	}
+	move := func(p *geo.Point, d float64) *geo.Point {
+		if vertical {
+			return geo.NewPoint(p.X, p.Y+d)
+		}
+		return geo.NewPoint(p.X+d, p.Y)
+	}
+	for _, obj := range g.Objects {
+		obj.TopLeft = move(obj.TopLeft, moves[top(obj)])
+	}
+
+	var bands []labelBand
+	if opts.AvoidContainerLabels {
+		bands = labelBands(g)
+	}
+	for _, e := range g.Edges {
+		d := moves[top(e.Src)]
+		if d != moves[top(e.Dst)] {
+			e.Route = orthogonalRoute(g, bands, e, opts)
+			e.JunctionPoints = nil
+			repairRoute(g, bands, e)
+			continue
+		}
+		movePoints(e, func(p *geo.Point) *geo.Point {
+			return move(p, d)
+		})
+		if c, ok := labelCenters[e]; ok {
+			labelCenters[e] = move(c, d)
+		}
+	}
+}
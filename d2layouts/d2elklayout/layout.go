@@ -1,17 +1,27 @@
 // d2elklayout is a wrapper around the Javascript port of ELK.
 //
+// Layouts are deterministic: the same graph laid out with the same options, RandomSeed included,
+// comes out the same every time.
+//
 // Coordinates are relative to parents.
 // See https://www.eclipse.org/elk/documentation/tooldevelopers/graphdatastructure/coordinatesystem.html
 package d2elklayout
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dop251/goja"
 
@@ -40,9 +50,19 @@ type ELKNode struct {
 	Height        float64     `json:"height"`
 	Children      []*ELKNode  `json:"children,omitempty"`
 	Labels        []*ELKLabel `json:"labels,omitempty"`
+	Ports         []*ELKPort  `json:"ports,omitempty"`
 	LayoutOptions *elkOpts    `json:"layoutOptions,omitempty"`
 }
 
+type ELKPort struct {
+	ID            string   `json:"id"`
+	X             float64  `json:"x"`
+	Y             float64  `json:"y"`
+	Width         float64  `json:"width"`
+	Height        float64  `json:"height"`
+	LayoutOptions *elkOpts `json:"layoutOptions,omitempty"`
+}
+
 type ELKLabel struct {
 	Text          string   `json:"text"`
 	X             float64  `json:"x"`
@@ -58,18 +78,27 @@ type ELKPoint struct {
 }
 
 type ELKEdgeSection struct {
+	ID         string     `json:"id,omitempty"`
 	Start      ELKPoint   `json:"startPoint"`
 	End        ELKPoint   `json:"endPoint"`
 	BendPoints []ELKPoint `json:"bendPoints,omitempty"`
+	// IncomingShape and OutgoingShape are the IDs of the node or port the section starts and ends at, if any,
+	// and IncomingSections and OutgoingSections the IDs of the sections of the same edge before and after it
+	IncomingShape    string   `json:"incomingShape,omitempty"`
+	OutgoingShape    string   `json:"outgoingShape,omitempty"`
+	IncomingSections []string `json:"incomingSections,omitempty"`
+	OutgoingSections []string `json:"outgoingSections,omitempty"`
 }
 
 type ELKEdge struct {
-	ID        string           `json:"id"`
-	Sources   []string         `json:"sources"`
-	Targets   []string         `json:"targets"`
-	Sections  []ELKEdgeSection `json:"sections,omitempty"`
-	Labels    []*ELKLabel      `json:"labels,omitempty"`
-	Container string           `json:"container"`
+	ID             string           `json:"id"`
+	Sources        []string         `json:"sources"`
+	Targets        []string         `json:"targets"`
+	Sections       []ELKEdgeSection `json:"sections,omitempty"`
+	Labels         []*ELKLabel      `json:"labels,omitempty"`
+	Container      string           `json:"container"`
+	JunctionPoints []ELKPoint       `json:"junctionPoints,omitempty"`
+	LayoutOptions  *elkOpts         `json:"layoutOptions,omitempty"`
 }
 
 type ELKGraph struct {
@@ -85,310 +114,1111 @@ type ConfigurableOpts struct {
 	Padding         string `json:"elk.padding,omitempty"`
 	EdgeNodeSpacing int    `json:"spacing.edgeNodeBetweenLayers,omitempty"`
 	SelfLoopSpacing int    `json:"elk.spacing.nodeSelfLoop"`
+	// SelfLoopDistribution is which sides of a node its self-loops go around: EQUALLY, NORTH or NORTH_SOUTH.
+	// Sides are as in a layout flowing right, so NORTH is the left side when flowing down.
+	SelfLoopDistribution string `json:"elk.layered.edgeRouting.selfLoopDistribution,omitempty"`
+	// SelfLoopSides moves self-loops out to a spacing of their own on each side of their nodes, once they're laid out.
+	// ELK only leaves room for SelfLoopSpacing, so loops taken further out than it may run into neighbors.
+	// nil leaves them where ELK put them.
+	SelfLoopSides *SelfLoopSides `json:"-"`
+	// LabelNodeSpacing is the spacing kept between a node's label and its border, where edges attach
+	LabelNodeSpacing int `json:"elk.spacing.labelNode,omitempty"`
+	// EdgeLabelSpacing places edge labels beside their edges, this far from them, instead of on them
+	EdgeLabelSpacing int `json:"elk.spacing.edgeLabel,omitempty"`
+	// SpacingBaseValue scales the layered algorithm's spacings together: ELK derives each from it by a fixed factor.
+	// When it's set, spacings left at their defaults are derived, and ones set to anything else win.
+	// The self-loop spacing is kept, as it's sized for the self-loops' labels.
+	SpacingBaseValue int `json:"elk.layered.spacing.baseValue,omitempty"`
+	// EdgeLabelGap is the least space kept between edge labels. Labels closer than it to another are slid along
+	// their routes, as little as separates them, but not so far that they'd run off the ends. 0 leaves them.
+	EdgeLabelGap int `json:"-"`
+	// EdgeLabelClearance is the least space kept between edge labels and edges other than their own, e.g. ones
+	// running parallel. Labels closer than it to one are slid along their routes or moved beside them, as little
+	// as clears them. 0 leaves them.
+	EdgeLabelClearance int `json:"-"`
+	// EdgeLabelPadding reserves this much room around each side of edge labels, for boxes drawn behind them.
+	// ELK lays the labels out that much larger, and they're centered in the room it leaves them.
+	EdgeLabelPadding int `json:"-"`
+	// MergeEdges routes edges sharing an endpoint through a common point, splitting at junctions
+	MergeEdges bool `json:"elk.layered.mergeEdges,omitempty"`
+	// LayoutQuality trades layout time for appearance with a preset of the layered algorithm's search options:
+	//   fast:     thoroughness 1, greedy cycle breaking, no greedy switch, SIMPLE node placement,
+	//             and declaration order isn't considered
+	//   balanced: thoroughness 8, layer sweep crossing minimization, BRANDES_KOEPF node placement
+	//   best:     thoroughness 20, layer sweep with a two-sided greedy switch, NETWORK_SIMPLEX node placement
+	// Empty is the same as balanced. CycleBreaking takes precedence over the preset's.
+	LayoutQuality string `json:"-"`
+	// LayoutObjective biases the layout toward an objective with a preset of ELK options, over LayoutQuality's:
+	//   compact:     NETWORK_SIMPLEX node placement, LEFT post-compaction and half the spacings between layers
+	//   readable:    layer sweep with a two-sided greedy switch, BRANDES_KOEPF node placement favoring straight edges
+	//   short-edges: NETWORK_SIMPLEX node placement, EDGE_LENGTH post-compaction, half the spacings between layers
+	//                and a straightness priority on edges, under that of CriticalEdges
+	// Options set otherwise than their defaults take precedence over the preset's, and spacings are left as they are
+	// with a SpacingBaseValue. Empty leaves the options as they are.
+	LayoutObjective string `json:"-"`
+	// CycleBreaking is how the layered algorithm picks the edges of cycles to reverse:
+	// GREEDY, DEPTH_FIRST, INTERACTIVE or MODEL_ORDER. Empty leaves ELK's default, GREEDY.
+	CycleBreaking string `json:"elk.layered.cycleBreaking.strategy,omitempty"`
+	// PostCompaction is how the layered algorithm compacts the layout along its layers once the nodes are placed,
+	// closing up the space left between them: LEFT, RIGHT, LEFT_RIGHT_CONSTRAINT_LOCKING,
+	// LEFT_RIGHT_CONNECTION_LOCKING or EDGE_LENGTH. Empty leaves ELK's default, NONE.
+	PostCompaction string `json:"elk.layered.compaction.postCompaction.strategy,omitempty"`
+	// GreedySwitchType is how the layered algorithm refines crossing minimization by swapping neighboring nodes
+	// while that removes crossings: OFF, ONE_SIDED or TWO_SIDED. It takes precedence over the presets of
+	// LayoutQuality and LayoutObjective. Empty leaves theirs, or ELK's default, TWO_SIDED.
+	GreedySwitchType string `json:"-"`
+	// GreedySwitchThreshold is the size of graph, in nodes, from which the greedy switch is left off, as it's slow
+	// on large graphs. 0 runs it whatever the size. nil leaves ELK's default, 40.
+	GreedySwitchThreshold *int `json:"-"`
+	// ComponentOrder is how the layered algorithm orders the unconnected parts of the graph:
+	// NONE, INSIDE_PORT_SIDE_GROUPS or FORCE_MODEL_ORDER, which keeps them in declaration order.
+	// Empty leaves ELK's default, NONE, which orders them by size.
+	ComponentOrder string `json:"elk.layered.considerModelOrder.components,omitempty"`
+	// FavorStraightEdges is whether node placement straightens edges at the expense of balancing nodes
+	// over what they connect to. nil leaves ELK's default, which with orthogonal routing is true.
+	FavorStraightEdges *bool `json:"elk.layered.nodePlacement.favorStraightEdges,omitempty"`
+	// NodeAlignment lines up the nodes of each layer by their TOP, CENTER or BOTTOM in layouts flowing
+	// down or up, and by their LEFT, CENTER or RIGHT in ones flowing right or left, where layers are columns.
+	// Empty leaves ELK's default, which lines them up on the side facing the layer before.
+	NodeAlignment string `json:"-"`
+	// RandomSeed seeds the randomness in ELK's algorithms. 0 leaves ELK's default seed.
+	RandomSeed int `json:"elk.randomSeed,omitempty"`
+	// NodeMargins reserves space around leaf nodes without growing them, in the format of Padding,
+	// e.g. [top=20,left=0,bottom=20,right=0]. ELK's layered algorithm works out node margins by itself,
+	// so nodes are laid out that much larger instead of setting elk.margins.
+	NodeMargins string `json:"-"`
+	// LeadOut is how far routes run straight out of the nodes they connect before their first bend.
+	// Bends are moved further out where there's room. 0 leaves routes as ELK bends them.
+	LeadOut int `json:"-"`
+	// StubLength is how far routes run straight out of their source and into their target, the same at both ends,
+	// by moving their first and last bends. It's shortened to what the shorter end has room for, and routes
+	// with only two bends have their middle segment centered. Routes that would cut through more objects are
+	// left as they are. 0 leaves routes as they are.
+	StubLength int `json:"-"`
+	// MaxBends caps the number of bends on each edge after bend deletion. 0 means no cap.
+	MaxBends int `json:"-"`
+	// MinSegmentLength removes jogs, segments between two bends shorter than it, by lining up the segments on
+	// either side where that doesn't cut through objects or cross edges it didn't before. 0 keeps them.
+	MinSegmentLength int `json:"-"`
+	// NodeLabelPosition places the labels of leaf nodes, e.g. OUTSIDE_TOP_CENTER.
+	// Defaults to INSIDE_MIDDLE_CENTER. Nodes with icons or built-in outside labels keep their placement.
+	NodeLabelPosition string `json:"-"`
+	// OverflowLabelPosition places the labels of leaf nodes given a width or height too small to fit them inside
+	// outside of them instead, making room for them there, e.g. OUTSIDE_BOTTOM_CENTER. It must be an outside
+	// position, and outside NodeLabelPositions are kept. Empty leaves such labels overflowing their nodes.
+	OverflowLabelPosition string `json:"-"`
+	// UniformNodeSize is the minimum width, X, and height, Y, of every leaf node, growing smaller ones to match
+	// for tidy grids. Shapes that keep their aspect ratio, like circles, grow to the larger of the two. nil leaves
+	// nodes at the size of their contents.
+	UniformNodeSize *geo.Point `json:"-"`
+	// KeepELKEndpoints ends routes where ELK ends them, on the bounding boxes of their endpoints, instead of tracing
+	// them on to the borders of the shapes, which can leave the last segments askew. It suits ports fixed to sides.
+	KeepELKEndpoints bool `json:"-"`
+	// CenterChildren centers the children of containers across them, within their padding, where ELK leaves them
+	// to one side of containers wider than they are, as algorithms other than layered do. Edges leaving moved
+	// children are routed again like Reroute does.
+	CenterChildren bool `json:"-"`
+	// AvoidCrossings tries to reroute edges off the edges they cross once they're routed, best effort, by taking
+	// them around the other side of objects they pass. Reroutes that would run into objects are not taken.
+	// Stats report the crossings left. Straight and critical edges and those with Waypoints keep their routes,
+	// though others may go around them.
+	AvoidCrossings bool `json:"-"`
+	// LeafIconSide places the icons of leaf nodes with labels in the middle of their "left" or "right" side,
+	// with their labels in the middle of the other, instead of labels over icons, growing nodes to fit both side
+	// by side. RTL swaps them like NodeLabelPosition. Images, nodes with labels below them and the descendants
+	// of FixedContainers keep their placement.
+	LeafIconSide string `json:"-"`
+	// ContainerLabelAlignment aligns the labels across the tops of containers left, center or right.
+	// Icons go on the opposite side to left and right aligned labels. By default labels are centered,
+	// or at the end of the top opposite icons.
+	ContainerLabelAlignment string `json:"-"`
+	// ShiftBottomLabels moves labels below their nodes, like those of people and images, left or right along the bottom
+	// when routes run through them, such as edges leaving from the bottom. Labels too wide to clear them stay put.
+	ShiftBottomLabels bool `json:"-"`
+	// AvoidContainerLabels keeps routes between the descendants of a container out of the band across its top
+	// that its label and icon are drawn in, routing around it like around objects.
+	// Routes into and out of the container still cross it where they must.
+	AvoidContainerLabels bool `json:"-"`
+	// RTL places labels and icons for right-to-left text: the icons of containers go top right, with their labels
+	// top left, and the left and right of NodeLabelPosition are swapped, along with the side ELK makes room for it on.
+	RTL bool `json:"-"`
+	// Mirror reflects the finished layout across its middle, horizontal swapping left and right and vertical
+	// swapping top and bottom, without laying it out again. Label and icon positions are reflected with it.
+	Mirror string `json:"-"`
+	// ChildOverflow is what's done about children ELK leaves poking out of their containers: "error" fails the layout
+	// naming them and "grow" grows the containers over them, to their padding, which may then overlap their
+	// neighbors. They're left as they are by default.
+	ChildOverflow string `json:"-"`
+	// RouteCoordinateSpace is what the routes and junction points of edges are relative to: "absolute", the default,
+	// or "container-relative", the top left of the container they're drawn within, for renderers that draw edges
+	// inside their containers' transforms. That's the innermost container of both endpoints, or the endpoint
+	// containing the other. Objects stay absolute, and Reroute expects routes to be absolute.
+	RouteCoordinateSpace string `json:"-"`
+	// DesiredEdgeLength is the length the stress algorithm aims for on every edge
+	DesiredEdgeLength float64 `json:"elk.stress.desiredEdgeLength,omitempty"`
+	// StressEpsilon is the stress improvement under which the stress algorithm stops iterating
+	StressEpsilon float64 `json:"elk.stress.epsilon,omitempty"`
+	// OrderedPorts attaches edges around each node in the order they were declared.
+	// Nodes grow to fit their ports at ELK's port spacing, elk.spacing.portPort.
+	// With or without it, the end of an edge whose arrowhead has a class naming a side of its node, one of
+	// elk-port-north, elk-port-south, elk-port-east or elk-port-west, e.g. target-arrowhead.class: elk-port-north,
+	// is attached to that side. The hint is ignored on containers, which edges are routed into.
+	OrderedPorts bool `json:"-"`
+	// MaxWidth wraps the layout when it would come out wider, trying to fit within it.
+	// 0 means no limit.
+	MaxWidth float64 `json:"-"`
+	// MaxDimensions scales the finished layout down, keeping its aspect ratio, to fit within a width, X, and height, Y,
+	// e.g. for thumbnails, without laying it out again. Layouts that already fit are left as they are, never scaled up.
+	// Labels and icons keep their size, like in LayoutToBox. 0 means no limit on that dimension.
+	MaxDimensions *geo.Point `json:"-"`
+	// MaxAspectRatio and MinAspectRatio wrap the layout when its width:height comes out over the max, too wide,
+	// or under the min, too tall, tuning how much it wraps to bring it within them. Wrapping only shortens
+	// the layout along its direction, so a layout off the other way, or with MaxWidth set, is left as it is.
+	// 0 means no bound.
+	MaxAspectRatio float64 `json:"-"`
+	MinAspectRatio float64 `json:"-"`
+	// OrderConstraints places objects ahead of their siblings within a layer.
+	// They don't override the layering that edges impose.
+	OrderConstraints []OrderConstraint `json:"-"`
+	// MaxNodesPerLayer caps the objects in each layer, the rows of layouts flowing down or up and the columns of ones
+	// flowing right or left, among the top-level objects and among the children of each container, wrapping the
+	// rest into more layers. ELK's Coffman-Graham layering bounds them, with unconnected objects laid out together
+	// so that they're wrapped too. Bend points of edges spanning layers don't count. 0 means no cap.
+	MaxNodesPerLayer int `json:"-"`
+	// FunnelEdges routes the edges entering a node on the same side into one point in the middle of that side,
+	// converging on a line half of EdgeNodeSpacing out of it, instead of spread along it. Edges that don't arrive
+	// square to the side from at least that far out, STRAIGHT edges and those through Waypoints are left as they are.
+	FunnelEdges bool `json:"-"`
+	// SnapTracks aligns parallel edge segments running within a quarter of EdgeNodeSpacing of each other
+	// onto shared tracks, spacing them evenly where they run side by side
+	SnapTracks bool `json:"-"`
+	// Extra sets any other ELK options on the root, keyed by their ELK option path, e.g.
+	// elk.layered.crossingMinimization.strategy. They're passed verbatim and override the options above.
+	Extra map[string]string `json:"-"`
+	// ContainerAlgorithms lays out the children of containers, keyed by absolute ID, with another ELK algorithm,
+	// e.g. box to arrange them in a grid
+	ContainerAlgorithms map[string]string `json:"-"`
+	// EdgeRouting routes edges, keyed by absolute ID, e.g. (a -> b)[0], as ORTHOGONAL, the default, or STRAIGHT.
+	// Straight edges are drawn as a line between the borders of their endpoints instead of along ELK's route.
+	EdgeRouting map[string]string `json:"-"`
+	// Waypoints are points that edges, keyed by absolute ID, are routed through in order, e.g. to take an edge around
+	// the outside of a diagram. ELK can't be made to route through them, so once routes are final, those edges are
+	// replaced with orthogonal routes through their waypoints, cornering between those out of line, without
+	// regard for what they run into.
+	Waypoints map[string][]geo.Point `json:"-"`
+	// CriticalEdges are edges, by absolute ID, to keep straight, e.g. the happy path of a flow.
+	// ELK favors straightening them over the others, and routes it leaves bent are replaced with a line
+	// across the gap between their endpoints where the two face each other, as long as no object is in the way,
+	// even where it crosses other edges.
+	CriticalEdges []string `json:"-"`
+	// ConstraintEdges are edges, by absolute ID, that only pull their endpoints into place, e.g. into adjacent layers.
+	// ELK lays them out with the others, without their labels, and then they're taken out of the graph's edges
+	// so that they aren't routed or drawn.
+	ConstraintEdges []string `json:"-"`
+	// FixedContainers keeps the authored arrangement of containers, by absolute ID, e.g. a legend. ELK lays each
+	// out as a single box, sized to fit, and its descendants are placed within their parents at their top and left,
+	// which they must all set. Edges between them are drawn straight, and edges from outside into them are rejected.
+	FixedContainers []string `json:"-"`
+	// KeepDeclaredSizes shrinks containers that ELK grew past their declared width or height back to it,
+	// around their center. Children that need more room overflow them.
+	KeepDeclaredSizes bool `json:"-"`
+	// LayerDistance moves the layers of top-level objects along the layout's direction so that their centers are
+	// exactly LayerDistance apart, whatever the sizes of the objects in them. Edges between layers are routed again
+	// like Reroute does. Layers closer than their objects are deep overlap. 0 leaves layers where ELK put them.
+	LayerDistance int `json:"-"`
+	// PreLayout is called with the graph built for ELK before it's sent, to change it in ways the options above can't.
+	// The graph is mapped back onto g by ID, so changing or removing IDs breaks the layout.
+	PreLayout func(*ELKGraph) `json:"-"`
+	// PostLayout is called with g once it's laid out, to adjust it in ways the options above can't, e.g. snapping
+	// objects to a grid. It runs last, after routing and bend deletion, so nothing follows up on its changes:
+	// routes aren't moved with the objects it moves.
+	PostLayout func(*d2graph.Graph) `json:"-"`
+	// ContainerMinimumSize is called with the absolute ID of each container and the minimum size computed for it,
+	// its width as X and height as Y, and returns the minimum size for ELK to keep it at instead.
+	// ExplainOptions shows the minimums as they're sent, in ELK's elk.nodeSize.minimum order.
+	ContainerMinimumSize func(id string, size geo.Point) geo.Point `json:"-"`
+	// BestEffort lays out graphs roughly instead of failing when ctx is done before ELK finishes, e.g. for previews.
+	// The layout is the best ELK finished in time, if it tried several within MaxWidth, or else objects are
+	// placed in grids, nested in their containers, with their edges drawn straight. Stats report when it was.
+	BestEffort bool `json:"-"`
+	// FallbackAlgorithm is the algorithm the layout is retried with once if ELK rejects the graph under Algorithm.
+	// Empty means no retry.
+	FallbackAlgorithm string `json:"-"`
+	// Columns arranges the top-level objects in a grid that many columns wide. Graphs without edges or containers
+	// are placed in rows in declaration order, each column as wide as its widest object.
+	// ELK can't place others in columns, so their layers are wrapped toward the grid's aspect ratio instead.
+	// 0 means no grid.
+	Columns int `json:"-"`
+	// ColumnGutter is the space between the rows and columns of the grid. 0 uses NodeSpacing.
+	ColumnGutter int `json:"-"`
+	// OrphanCorner gathers orphans, top-level objects without edges or children, into a square grid beside the rest
+	// of the layout in the "top-left", "top-right", "bottom-left" or "bottom-right" corner, instead of ELK placing
+	// them among it. The grid's gutter is ColumnGutter. PreLayout doesn't see orphans. Empty leaves them to ELK.
+	OrphanCorner string `json:"-"`
+	// FlattenSingleChildContainers replaces containers that wrap a single child with the child before laying out,
+	// moving their edges onto it. It changes g, so the containers are gone from its objects, and absolute IDs in
+	// the other options refer to objects where they are after flattening.
+	FlattenSingleChildContainers bool `json:"-"`
+	// RootPadding is the margin kept around the whole diagram, in the format of Padding,
+	// e.g. [top=20,left=20,bottom=20,right=20], so that the objects start at its top and left.
+	// By default ELK keeps 12 on every side, and Columns grids and rough layouts keep to the top and left of Padding.
+	RootPadding string `json:"-"`
+	// MergeBidirectional merges each edge with one the opposite way between the same objects into one route, drawn
+	// with arrowheads at both ends, e.g. a -> b and b -> a into a <-> b, before laying out. It changes g: the later
+	// edge of each pair is taken out of its edges, and the earlier one gets its arrowhead at its source, so options
+	// naming edges by ID refer to the edges left. Edges with labels, arrowheads at both ends or a source arrowhead, and
+	// pairs that differ otherwise than by their arrowheads, e.g. in style, classes or links, are kept as they are.
+	MergeBidirectional bool `json:"-"`
+	// Diagnose reports on the layout in Stats' Diagnostics, for attaching to bug reports
+	Diagnose bool `json:"-"`
+	// PaddingScale multiplies the padding of containers by this factor for each level they're nested below
+	// the top level, e.g. 0.5 halves it at every level in. The top keeps room for labels and icons.
+	// 0 means no scaling.
+	PaddingScale float64 `json:"-"`
+	// ArrowheadInset ends routes short of the borders they point at by the length of their arrowheads,
+	// for renderers that draw arrowheads past the ends of routes so that their tips touch the border
+	ArrowheadInset bool `json:"-"`
+}
+
+// OrderConstraint requires the object Before to come ahead of the object After.
+// Both are absolute IDs and must share a parent.
+type OrderConstraint struct {
+	Before string
+	After  string
 }
 
 var DefaultOpts = ConfigurableOpts{
-	Algorithm:       "layered",
-	NodeSpacing:     70.0,
-	Padding:         "[top=50,left=50,bottom=50,right=50]",
-	EdgeNodeSpacing: 40.0,
-	SelfLoopSpacing: 50.0,
+	Algorithm:            "layered",
+	NodeSpacing:          70.0,
+	Padding:              "[top=50,left=50,bottom=50,right=50]",
+	EdgeNodeSpacing:      40.0,
+	SelfLoopSpacing:      50.0,
+	SelfLoopDistribution: "EQUALLY",
 }
 
 var port_spacing = 40.
 var edge_node_spacing = 40
 
+// elkNodeLabelPlacements maps the label positions leaf nodes accept to elk.nodeLabels.placement
+var elkNodeLabelPlacements = map[label.Position]string{
+	label.OutsideTopLeft:      "OUTSIDE V_TOP H_LEFT",
+	label.OutsideTopCenter:    "OUTSIDE V_TOP H_CENTER",
+	label.OutsideTopRight:     "OUTSIDE V_TOP H_RIGHT",
+	label.OutsideLeftTop:      "OUTSIDE H_LEFT V_TOP H_PRIORITY",
+	label.OutsideLeftMiddle:   "OUTSIDE H_LEFT V_CENTER H_PRIORITY",
+	label.OutsideLeftBottom:   "OUTSIDE H_LEFT V_BOTTOM H_PRIORITY",
+	label.OutsideRightTop:     "OUTSIDE H_RIGHT V_TOP H_PRIORITY",
+	label.OutsideRightMiddle:  "OUTSIDE H_RIGHT V_CENTER H_PRIORITY",
+	label.OutsideRightBottom:  "OUTSIDE H_RIGHT V_BOTTOM H_PRIORITY",
+	label.OutsideBottomLeft:   "OUTSIDE V_BOTTOM H_LEFT",
+	label.OutsideBottomCenter: "OUTSIDE V_BOTTOM H_CENTER",
+	label.OutsideBottomRight:  "OUTSIDE V_BOTTOM H_RIGHT",
+	label.InsideTopLeft:       "INSIDE V_TOP H_LEFT",
+	label.InsideTopCenter:     "INSIDE V_TOP H_CENTER",
+	label.InsideTopRight:      "INSIDE V_TOP H_RIGHT",
+	label.InsideMiddleLeft:    "INSIDE V_CENTER H_LEFT",
+	label.InsideMiddleCenter:  "INSIDE V_CENTER H_CENTER",
+	label.InsideMiddleRight:   "INSIDE V_CENTER H_RIGHT",
+	label.InsideBottomLeft:    "INSIDE V_BOTTOM H_LEFT",
+	label.InsideBottomCenter:  "INSIDE V_BOTTOM H_CENTER",
+	label.InsideBottomRight:   "INSIDE V_BOTTOM H_RIGHT",
+}
+
 type elkOpts struct {
 	EdgeNode                     int    `json:"elk.spacing.edgeNode,omitempty"`
+	NodeNode                     int    `json:"elk.spacing.nodeNode,omitempty"`
 	FixedAlignment               string `json:"elk.layered.nodePlacement.bk.fixedAlignment,omitempty"`
 	Thoroughness                 int    `json:"elk.layered.thoroughness,omitempty"`
 	EdgeEdgeBetweenLayersSpacing int    `json:"elk.layered.spacing.edgeEdgeBetweenLayers,omitempty"`
 	Direction                    string `json:"elk.direction"`
 	HierarchyHandling            string `json:"elk.hierarchyHandling,omitempty"`
 	InlineEdgeLabels             bool   `json:"elk.edgeLabels.inline,omitempty"`
+	EdgeLabelsPlacement          string `json:"elk.edgeLabels.placement,omitempty"`
+	StraightnessPriority         int    `json:"elk.layered.priority.straightness,omitempty"`
 	ForceNodeModelOrder          bool   `json:"elk.layered.crossingMinimization.forceNodeModelOrder,omitempty"`
 	ConsiderModelOrder           string `json:"elk.layered.considerModelOrder.strategy,omitempty"`
 
-	SelfLoopDistribution string `json:"elk.layered.edgeRouting.selfLoopDistribution,omitempty"`
-
 	NodeSizeConstraints string `json:"elk.nodeSize.constraints,omitempty"`
 	ContentAlignment    string `json:"elk.contentAlignment,omitempty"`
 	NodeSizeMinimum     string `json:"elk.nodeSize.minimum,omitempty"`
+	NodeLabelsPlacement string `json:"elk.nodeLabels.placement,omitempty"`
+
+	CrossingMinimization            string `json:"elk.layered.crossingMinimization.strategy,omitempty"`
+	GreedySwitch                    string `json:"elk.layered.crossingMinimization.greedySwitch.type,omitempty"`
+	GreedySwitchHierarchical        string `json:"elk.layered.crossingMinimization.greedySwitchHierarchical.type,omitempty"`
+	GreedySwitchActivationThreshold *int   `json:"elk.layered.crossingMinimization.greedySwitch.activationThreshold,omitempty"`
+	NodePlacement                   string `json:"elk.layered.nodePlacement.strategy,omitempty"`
+
+	LayeringStrategy            string `json:"elk.layered.layering.strategy,omitempty"`
+	LayerBound                  int    `json:"elk.layered.layering.coffmanGraham.layerBound,omitempty"`
+	SeparateConnectedComponents *bool  `json:"elk.separateConnectedComponents,omitempty"`
+
+	WrappingStrategy         string  `json:"elk.layered.wrapping.strategy,omitempty"`
+	WrappingCorrectionFactor float64 `json:"elk.layered.wrapping.correctionFactor,omitempty"`
+	AspectRatio              float64 `json:"elk.aspectRatio,omitempty"`
+
+	EdgeRouting string `json:"elk.edgeRouting,omitempty"`
+
+	PortConstraints string `json:"elk.portConstraints,omitempty"`
+	PortSide        string `json:"elk.port.side,omitempty"`
+	PortIndex       *int   `json:"elk.port.index,omitempty"`
+	Alignment       string `json:"elk.alignment,omitempty"`
 
 	ConfigurableOpts
 }
 
+func (opts elkOpts) MarshalJSON() ([]byte, error) {
+	type plainOpts elkOpts
+	raw, err := json.Marshal(plainOpts(opts))
+	if err != nil || len(opts.Extra) == 0 {
+		return raw, err
+	}
+	merged := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range opts.Extra {
+		merged[k] = v
+	}
+	return json.Marshal(merged)
+}
+
+func (opts *elkOpts) UnmarshalJSON(b []byte) error {
+	type plainOpts elkOpts
+	plain := plainOpts(*opts)
+	err := json.Unmarshal(b, &plain)
+	if err == nil {
+		*opts = elkOpts(plain)
+		return nil
+	}
+
+	// Extra options come back as the strings they were set as,
+	// which the typed options they override may not unmarshal from, so they're kept as extra
+	var all map[string]json.RawMessage
+	if json.Unmarshal(b, &all) != nil {
+		return err
+	}
+	plain = plainOpts(*opts)
+	extra := make(map[string]string)
+	for k, v := range opts.Extra {
+		extra[k] = v
+	}
+	for k, v := range all {
+		single, _ := json.Marshal(map[string]json.RawMessage{k: v})
+		if json.Unmarshal(single, &plain) != nil {
+			var s string
+			if json.Unmarshal(v, &s) != nil {
+				return err
+			}
+			extra[k] = s
+		}
+	}
+	plain.Extra = extra
+	*opts = elkOpts(plain)
+	return nil
+}
+
 func DefaultLayout(ctx context.Context, g *d2graph.Graph) (err error) {
 	return Layout(ctx, g, nil)
 }
 
-func Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (err error) {
+func Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) error {
+	_, _, err := layout(ctx, nil, g, opts)
+	return err
+}
+
+// LayoutWithStats lays out g like Layout and reports on how it went
+func LayoutWithStats(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (*Stats, error) {
+	_, stats, err := layout(ctx, nil, g, opts)
+	return stats, err
+}
+
+// LayoutToJSON lays out g like Layout and returns the graph ELK computed, as JSON.
+// Coordinates are relative to parents, as ELK gives them, and include the edge sections.
+// Children and edges are sorted by ID so that outputs can be diffed.
+func LayoutToJSON(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) ([]byte, error) {
+	elkGraph, _, err := layout(ctx, nil, g, opts)
+	if err != nil {
+		return nil, err
+	}
+	sortELKGraph(elkGraph)
+	return json.MarshalIndent(elkGraph, "", "  ")
+}
+
+// layout lays out g with e, or with a new Engine if e is nil
+func layout(ctx context.Context, e *Engine, g *d2graph.Graph, opts *ConfigurableOpts) (_ *ELKGraph, _ *Stats, err error) {
+	start := time.Now()
 	if opts == nil {
 		opts = &DefaultOpts
 	}
 	defer xdefer.Errorf(&err, "failed to ELK layout")
 
-	vm := goja.New()
-
-	console := vm.NewObject()
-	if err := vm.Set("console", console); err != nil {
-		return err
+	if err := validateOpts(opts); err != nil {
+		return nil, nil, err
 	}
-
-	if _, err := vm.RunString(elkJS); err != nil {
-		return err
+	// Every path below places by the same spacings, ELK's or not
+	opts = withRootAttributes(g, opts)
+	if opts.FlattenSingleChildContainers {
+		flattenSingleChildContainers(g)
 	}
-	if _, err := vm.RunString(setupJS); err != nil {
-		return err
+	if opts.MergeBidirectional {
+		mergeBidirectional(g)
 	}
-
-	elkGraph := &ELKGraph{
-		ID: "root",
-		LayoutOptions: &elkOpts{
-			Thoroughness:                 8,
-			EdgeEdgeBetweenLayersSpacing: 50,
-			EdgeNode:                     edge_node_spacing,
-			HierarchyHandling:            "INCLUDE_CHILDREN",
-			FixedAlignment:               "BALANCED",
-			ConsiderModelOrder:           "NODES_AND_EDGES",
-			NodeSizeConstraints:          "MINIMUM_SIZE",
-			ContentAlignment:             "H_CENTER V_CENTER",
-			ConfigurableOpts: ConfigurableOpts{
-				Algorithm:       opts.Algorithm,
-				NodeSpacing:     opts.NodeSpacing,
-				EdgeNodeSpacing: opts.EdgeNodeSpacing,
-				SelfLoopSpacing: opts.SelfLoopSpacing,
-			},
-		},
+	if err := validateOrderConstraints(g, opts.OrderConstraints); err != nil {
+		return nil, nil, err
 	}
-	if elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing == DefaultOpts.SelfLoopSpacing {
-		// +5 for a tiny bit of padding
-		elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing = go2.Max(elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing, childrenMaxSelfLoop(g.Root, g.Root.Direction.Value == "down" || g.Root.Direction.Value == "" || g.Root.Direction.Value == "up")/2+5)
+	if err := validateContainerAlgorithms(g, opts.ContainerAlgorithms); err != nil {
+		return nil, nil, err
 	}
-	switch g.Root.Direction.Value {
-	case "down":
-		elkGraph.LayoutOptions.Direction = "DOWN"
-	case "up":
-		elkGraph.LayoutOptions.Direction = "UP"
-	case "right":
-		elkGraph.LayoutOptions.Direction = "RIGHT"
-	case "left":
-		elkGraph.LayoutOptions.Direction = "LEFT"
-	default:
-		elkGraph.LayoutOptions.Direction = "DOWN"
+	if err := validateEdgeRouting(g, opts.EdgeRouting); err != nil {
+		return nil, nil, err
 	}
+	if err := validateEdgeIDs(g, opts.CriticalEdges, "critical path"); err != nil {
+		return nil, nil, err
+	}
+	if err := validateEdgeIDs(g, opts.ConstraintEdges, "constraint"); err != nil {
+		return nil, nil, err
+	}
+	if err := validateWaypoints(g, opts.Waypoints); err != nil {
+		return nil, nil, err
+	}
+	fixed, err := setAsideFixedContainers(g, opts.FixedContainers)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fixed.restore(g)
 
-	elkNodes := make(map[*d2graph.Object]*ELKNode)
-	elkEdges := make(map[*d2graph.Edge]*ELKEdge)
-
-	// BFS
-	var walk func(*d2graph.Object, *d2graph.Object, func(*d2graph.Object, *d2graph.Object))
-	walk = func(obj, parent *d2graph.Object, fn func(*d2graph.Object, *d2graph.Object)) {
-		if obj.Parent != nil {
-			fn(obj, parent)
-		}
-		for _, ch := range obj.ChildrenArray {
-			walk(ch, obj, fn)
-		}
+	elkGraph := BuildELKGraph(g, opts)
+	stats := &Stats{}
+	var orphans []*ELKNode
+	if opts.OrphanCorner != "" {
+		orphans = setAsideOrphans(g, elkGraph)
 	}
 
-	walk(g.Root, nil, func(obj, parent *d2graph.Object) {
-		incoming := 0.
-		outgoing := 0.
-		for _, e := range g.Edges {
-			if e.Src == obj {
-				outgoing++
-			}
-			if e.Dst == obj {
-				incoming++
-			}
+	// Objects without edges or containers between them are placed in Columns without ELK
+	if opts.Columns > 0 && isGrid(g) {
+		placeGrid(elkGraph, opts)
+	} else if len(g.Objects) >= 2 || len(g.Edges) > 0 {
+		if opts.PreLayout != nil {
+			opts.PreLayout(elkGraph)
 		}
-		if incoming >= 2 || outgoing >= 2 {
-			switch g.Root.Direction.Value {
-			case "right", "left":
-				obj.Height = math.Max(obj.Height, math.Max(incoming, outgoing)*port_spacing)
-			default:
-				obj.Width = math.Max(obj.Width, math.Max(incoming, outgoing)*port_spacing)
+		if e == nil {
+			e, err = NewEngine()
+			if err != nil {
+				return nil, nil, err
 			}
 		}
-
-		height := obj.Height
-		width := obj.Width
-		if obj.HasLabel() {
-			if obj.HasOutsideBottomLabel() || obj.Icon != nil {
-				height += float64(obj.LabelDimensions.Height) + label.PADDING
+		var out *ELKGraph
+		var outOpts *ConfigurableOpts
+		if e.cache != nil {
+			out, outOpts, err = e.cache.layoutELK(ctx, e, g, elkGraph, opts)
+		} else {
+			out, outOpts, err = e.layoutELK(ctx, g, elkGraph, opts)
+		}
+		switch {
+		case err == nil:
+			elkGraph, opts = out, outOpts
+		case opts.BestEffort && ctx.Err() != nil:
+			stats.BestEffort = true
+			if out != nil {
+				elkGraph, opts = out, outOpts
+			} else {
+				placeRough(elkGraph, opts)
 			}
-			width = go2.Max(width, float64(obj.LabelDimensions.Width))
+		default:
+			return nil, nil, err
 		}
-
-		n := &ELKNode{
-			ID:     obj.AbsID(),
-			Width:  width,
-			Height: height,
+	} else if opts.RootPadding != "" {
+		// A lone node has nothing to be arranged against, so it's left at the origin without paying for
+		// starting ELK, or moved within RootPadding
+		top, left, _, _, _ := parseSides(opts.RootPadding)
+		for _, n := range elkGraph.Children {
+			n.X, n.Y = left, top
 		}
+	}
+	placeOrphans(elkGraph, orphans, opts.OrphanCorner, gridGutter(opts))
 
-		if len(obj.ChildrenArray) > 0 {
-			n.LayoutOptions = &elkOpts{
-				ForceNodeModelOrder:          true,
-				Thoroughness:                 8,
-				EdgeEdgeBetweenLayersSpacing: 50,
-				HierarchyHandling:            "INCLUDE_CHILDREN",
-				FixedAlignment:               "BALANCED",
-				EdgeNode:                     edge_node_spacing,
-				ConsiderModelOrder:           "NODES_AND_EDGES",
-				NodeSizeConstraints:          "MINIMUM_SIZE",
-				ContentAlignment:             "H_CENTER V_CENTER",
-				ConfigurableOpts: ConfigurableOpts{
-					NodeSpacing:     opts.NodeSpacing,
-					EdgeNodeSpacing: opts.EdgeNodeSpacing,
-					SelfLoopSpacing: opts.SelfLoopSpacing,
-					Padding:         opts.Padding,
-				},
-			}
-			if n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing == DefaultOpts.SelfLoopSpacing {
-				n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing = go2.Max(n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing, childrenMaxSelfLoop(obj, g.Root.Direction.Value == "down" || g.Root.Direction.Value == "" || g.Root.Direction.Value == "up")/2+5)
-			}
-
-			switch elkGraph.LayoutOptions.Direction {
-			case "DOWN", "UP":
-				n.LayoutOptions.NodeSizeMinimum = fmt.Sprintf("(%d, %d)", int(math.Ceil(height)), int(math.Ceil(width)))
-			case "RIGHT", "LEFT":
-				n.LayoutOptions.NodeSizeMinimum = fmt.Sprintf("(%d, %d)", int(math.Ceil(width)), int(math.Ceil(height)))
-			}
-
-			if n.LayoutOptions.Padding == DefaultOpts.Padding {
-				labelHeight := 0
-				if obj.HasLabel() {
-					labelHeight = obj.LabelDimensions.Height + label.PADDING
-				}
-
-				n.Height += 100 + float64(labelHeight)
-				n.Width += 100
-				contentBox := geo.NewBox(geo.NewPoint(0, 0), float64(n.Width), float64(n.Height))
-				shapeType := d2target.DSL_SHAPE_TO_SHAPE_TYPE[obj.Shape.Value]
-				s := shape.NewShape(shapeType, contentBox)
-
-				paddingTop := n.Height - s.GetInnerBox().Height
-				n.Height -= (100 + float64(labelHeight))
-				n.Width -= 100
-
-				iconHeight := 0
-				if obj.Icon != nil && obj.Shape.Value != d2target.ShapeImage {
-					iconHeight = d2target.GetIconSize(s.GetInnerBox(), string(label.InsideTopLeft)) + label.PADDING*2
-				}
-
-				paddingTop += float64(go2.Max(labelHeight, iconHeight))
-
-				n.LayoutOptions.Padding = fmt.Sprintf("[top=%d,left=50,bottom=50,right=50]",
-					// Default padding
-					go2.Max(int(math.Ceil(paddingTop)), 50),
-				)
-			}
-		} else {
-			n.LayoutOptions = &elkOpts{
-				SelfLoopDistribution: "EQUALLY",
-			}
+	dropEdges(g, fixed, opts.ConstraintEdges)
+	if err := applyLayout(g, elkGraph, opts, stats); err != nil {
+		return nil, nil, err
+	}
+	fixed.place(opts, stats)
+	mirror(g, opts.Mirror)
+	if opts.MaxDimensions != nil {
+		scaleWithin(fixed.whole(g), *opts.MaxDimensions)
+	}
+	if opts.RouteCoordinateSpace == "container-relative" {
+		relativizeRoutes(g.Edges)
+		if fixed != nil {
+			relativizeRoutes(fixed.internal)
 		}
-
-		if obj.HasLabel() {
-			n.Labels = append(n.Labels, &ELKLabel{
-				Text:   obj.Label.Value,
-				Width:  float64(obj.LabelDimensions.Width),
-				Height: float64(obj.LabelDimensions.Height),
-			})
+	}
+	if opts.PostLayout != nil {
+		fixed.restore(g)
+		opts.PostLayout(g)
+	}
+	if opts.Diagnose {
+		whole := fixed.whole(g)
+		stats.Diagnostics = &Diagnostics{
+			Duration:   time.Since(start),
+			ELKVersion: ELKVersion,
+			Objects:    len(whole.Objects),
+			Edges:      len(whole.Edges),
+			Options:    flattenOpts(elkGraph.LayoutOptions),
 		}
+	}
 
-		if parent == g.Root {
-			elkGraph.Children = append(elkGraph.Children, n)
-		} else {
-			elkNodes[parent].Children = append(elkNodes[parent].Children, n)
-		}
-		elkNodes[obj] = n
-	})
+	return elkGraph, stats, nil
+}
 
-	for _, edge := range g.Edges {
-		e := &ELKEdge{
-			ID:      edge.AbsID(),
-			Sources: []string{edge.Src.AbsID()},
-			Targets: []string{edge.Dst.AbsID()},
-		}
-		if edge.Label.Value != "" {
-			e.Labels = append(e.Labels, &ELKLabel{
-				Text:   edge.Label.Value,
-				Width:  float64(edge.LabelDimensions.Width),
-				Height: float64(edge.LabelDimensions.Height),
-				LayoutOptions: &elkOpts{
-					InlineEdgeLabels: true,
-				},
-			})
+func sortELKGraph(elkGraph *ELKGraph) {
+	var sortNodes func([]*ELKNode)
+	sortNodes = func(nodes []*ELKNode) {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].ID < nodes[j].ID
+		})
+		for _, n := range nodes {
+			sortNodes(n.Children)
 		}
-		elkGraph.Edges = append(elkGraph.Edges, e)
-		elkEdges[edge] = e
 	}
+	sortNodes(elkGraph.Children)
+	sort.SliceStable(elkGraph.Edges, func(i, j int) bool {
+		return elkGraph.Edges[i].ID < elkGraph.Edges[j].ID
+	})
+}
 
-	raw, err := json.Marshal(elkGraph)
-	if err != nil {
-		return err
-	}
+// elkRuns counts the layouts that have been handed to the ELK script
+var elkRuns int64
 
-	loadScript := fmt.Sprintf(`var graph = %s`, raw)
+// Engine holds a JS runtime with ELK loaded, so that laying out many graphs only loads ELK once.
+// An Engine lays out one graph at a time; concurrent calls wait their turn.
+type Engine struct {
+	mu sync.Mutex
+	// vm is nil after ELK's been interrupted, until the next layout loads it again
+	vm *goja.Runtime
 
-	if _, err := vm.RunString(loadScript); err != nil {
-		return err
+	// cache is where the engine of a CachedLayouter looks up layouts before running ELK
+	cache *layoutCache
+}
+
+func NewEngine() (*Engine, error) {
+	e := &Engine{}
+	if err := e.load(); err != nil {
+		return nil, err
 	}
+	return e, nil
+}
 
-	val, err := vm.RunString(`elk.layout(graph)
-.then(s => s)
-.catch(err => err.message)
-`)
+// load gives e a new runtime with ELK loaded
+func (e *Engine) load() error {
+	vm := goja.New()
 
-	if err != nil {
+	console := vm.NewObject()
+	if err := vm.Set("console", console); err != nil {
 		return err
 	}
 
-	p := val.Export()
-	if err != nil {
+	if _, err := vm.RunString(elkJS); err != nil {
+		return err
+	}
+	if _, err := vm.RunString(setupJS); err != nil {
 		return err
 	}
 
-	promise := p.(*goja.Promise)
+	e.vm = vm
+	return nil
+}
 
-	for promise.State() == goja.PromiseStatePending {
-		if err := ctx.Err(); err != nil {
-			return err
-		}
-		continue
-	}
+// Layout is like the package level Layout but reuses the engine's runtime
+func (e *Engine) Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) error {
+	_, _, err := layout(ctx, e, g, opts)
+	return err
+}
 
-	if promise.State() == goja.PromiseStateRejected {
-		return errors.New("ELK: something went wrong")
+// LayoutWithStats is like the package level LayoutWithStats but reuses the engine's runtime
+func (e *Engine) LayoutWithStats(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (*Stats, error) {
+	_, stats, err := layout(ctx, e, g, opts)
+	return stats, err
+}
+
+// layoutELK lays out elkGraph, built from g with opts, retrying with opts.FallbackAlgorithm if ELK rejects it.
+// It returns the options of the layout that succeeded. If ctx is done before it's finished, any layout
+// that was is returned along with the error.
+func (e *Engine) layoutELK(ctx context.Context, g *d2graph.Graph, elkGraph *ELKGraph, opts *ConfigurableOpts) (*ELKGraph, *ConfigurableOpts, error) {
+	elkGraph, err := e.runOpts(ctx, elkGraph, opts)
+	if err == nil {
+		return elkGraph, opts, nil
+	}
+	if ctx.Err() != nil && elkGraph != nil {
+		return elkGraph, opts, err
+	}
+	if opts.FallbackAlgorithm == "" || ctx.Err() != nil {
+		return nil, nil, err
+	}
+	fallbackOpts := fallback(opts)
+	fallbackGraph := BuildELKGraph(g, fallbackOpts)
+	if fallbackOpts.PreLayout != nil {
+		fallbackOpts.PreLayout(fallbackGraph)
+	}
+	fallbackGraph, fallbackErr := e.runOpts(ctx, fallbackGraph, fallbackOpts)
+	if fallbackErr != nil {
+		return nil, nil, fmt.Errorf("%s: %v; fallback %s: %v", opts.Algorithm, err, fallbackOpts.Algorithm, fallbackErr)
 	}
+	return fallbackGraph, fallbackOpts, nil
+}
+
+func fallback(opts *ConfigurableOpts) *ConfigurableOpts {
+	fallbackOpts := *opts
+	fallbackOpts.Algorithm = opts.FallbackAlgorithm
+	return &fallbackOpts
+}
 
-	result := promise.Result().Export()
+// runOpts lays out elkGraph like run, within opts.MaxWidth or else the aspect ratio bounds if they're set
+func (e *Engine) runOpts(ctx context.Context, elkGraph *ELKGraph, opts *ConfigurableOpts) (*ELKGraph, error) {
+	if opts.MaxWidth > 0 {
+		return e.runWithinWidth(ctx, elkGraph, opts.MaxWidth)
+	}
+	if opts.MinAspectRatio > 0 || opts.MaxAspectRatio > 0 {
+		return e.runWithinAspectRatio(ctx, elkGraph, opts.MinAspectRatio, opts.MaxAspectRatio)
+	}
+	if err := e.run(ctx, elkGraph); err != nil {
+		return nil, err
+	}
+	return elkGraph, nil
+}
 
-	var jsonOut map[string]interface{}
-	switch out := result.(type) {
+// elkErrorMessage returns the message of v if it's an error from ELK: a JS Error, a Go error thrown through goja,
+// an object with only the properties of an error, or the message itself
+func elkErrorMessage(v goja.Value) (string, bool) {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return "", false
+	}
+	if obj, ok := v.(*goja.Object); ok && obj.ClassName() == "Error" {
+		// An Error's message isn't enumerable, so it's not exported
+		return obj.Get("message").String(), true
+	}
+	switch out := v.Export().(type) {
 	case string:
-		return fmt.Errorf("ELK layout error: %s", out)
+		return out, true
+	case error:
+		return out.Error(), true
 	case map[string]interface{}:
-		jsonOut = out
-	default:
-		return fmt.Errorf("ELK unexpected return: %v", out)
+		msg, ok := out["message"].(string)
+		if !ok {
+			return "", false
+		}
+		for k := range out {
+			switch k {
+			case "message", "name", "stack", "cause":
+			default:
+				return "", false
+			}
+		}
+		return msg, true
 	}
+	return "", false
+}
 
-	jsonBytes, err := json.Marshal(jsonOut)
-	if err != nil {
-		return err
-	}
+// maxWrapPasses is how many wrapped layouts runWithinWidth and runWithinAspectRatio try in search of one that fits
+const maxWrapPasses = 3
 
-	err = json.Unmarshal(jsonBytes, &elkGraph)
+// runWithinWidth lays out elkGraph like run, but if it comes out wider than maxWidth,
+// it's laid out again with its layers wrapped, tuning how much they wrap to fit.
+// The widest result within maxWidth is returned, or the narrowest if none fit.
+// If ctx is done partway, the best so far is returned along with the error.
+func (e *Engine) runWithinWidth(ctx context.Context, elkGraph *ELKGraph, maxWidth float64) (*ELKGraph, error) {
+	input, err := json.Marshal(elkGraph)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := e.run(ctx, elkGraph); err != nil {
+		return nil, err
+	}
+	width, _ := contentSize(elkGraph)
+	if width <= maxWidth {
+		return elkGraph, nil
 	}
 
-	byID := make(map[string]*d2graph.Object)
+	best, bestWidth := elkGraph, width
+	correctionFactor := 1.
+	for i := 0; i < maxWrapPasses; i++ {
+		wrapped, err := wrappedInput(input, elkGraph, correctionFactor)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.run(ctx, wrapped); err != nil {
+			if ctx.Err() != nil {
+				return best, err
+			}
+			return nil, err
+		}
+
+		width, _ := contentSize(wrapped)
+		if width <= maxWidth {
+			if bestWidth > maxWidth || width > bestWidth {
+				best, bestWidth = wrapped, width
+			}
+		} else if bestWidth > maxWidth && width < bestWidth {
+			best, bestWidth = wrapped, width
+		}
+		// The narrower the correction factor, the narrower the layout, though not proportionally
+		correctionFactor *= maxWidth / width
+	}
+	return best, nil
+}
+
+// runWithinAspectRatio lays out elkGraph like run, but if its width:height comes out over max or under min,
+// where 0 is no bound, it's laid out again with its layers wrapped toward the bound it's past, tuning how much
+// they wrap to land within. Wrapping only shortens the layout along its direction, so a layout off the other way
+// is returned as it is. The first result within bounds is returned, or else the closest.
+// If ctx is done partway, the best so far is returned along with the error.
+func (e *Engine) runWithinAspectRatio(ctx context.Context, elkGraph *ELKGraph, min, max float64) (*ELKGraph, error) {
+	input, err := json.Marshal(elkGraph)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.run(ctx, elkGraph); err != nil {
+		return nil, err
+	}
+	if len(elkGraph.Children) == 0 {
+		return elkGraph, nil
+	}
+	ratio := contentAspectRatio(elkGraph)
+	var target float64
+	switch {
+	case max > 0 && ratio > max:
+		target = max
+	case min > 0 && ratio < min:
+		target = min
+	default:
+		return elkGraph, nil
+	}
+	// Wrapping a horizontal layout makes it narrower, and a vertical one wider
+	horizontal := elkGraph.LayoutOptions.Direction == "RIGHT" || elkGraph.LayoutOptions.Direction == "LEFT"
+	if (target < ratio) != horizontal {
+		return elkGraph, nil
+	}
+
+	// How far off a ratio is, the same either way
+	off := func(ratio float64) float64 {
+		return math.Abs(math.Log(ratio / target))
+	}
+	best, bestOff := elkGraph, off(ratio)
+	correctionFactor := 1.
+	for i := 0; i < maxWrapPasses; i++ {
+		wrapped, err := wrappedInput(input, elkGraph, correctionFactor)
+		if err != nil {
+			return nil, err
+		}
+		wrapped.LayoutOptions.AspectRatio = target
+		if err := e.run(ctx, wrapped); err != nil {
+			if ctx.Err() != nil {
+				return best, err
+			}
+			return nil, err
+		}
+
+		ratio := contentAspectRatio(wrapped)
+		if (max <= 0 || ratio <= max) && (min <= 0 || ratio >= min) {
+			return wrapped, nil
+		}
+		if off(ratio) < bestOff {
+			best, bestOff = wrapped, off(ratio)
+		}
+		// ELK wraps toward the aspect ratio times the correction factor, though it doesn't land on the same measure
+		correctionFactor *= target / ratio
+	}
+	return best, nil
+}
+
+// wrappedInput is elkGraph unmarshaled again from input, its graph before it was laid out,
+// set up to be laid out with its layers wrapped, correctionFactor tuning how much
+func wrappedInput(input []byte, elkGraph *ELKGraph, correctionFactor float64) (*ELKGraph, error) {
+	var wrapped *ELKGraph
+	if err := json.Unmarshal(input, &wrapped); err != nil {
+		return nil, err
+	}
+	// Extra options are marshaled among the rest, so they don't unmarshal back by themselves
+	wrapped.LayoutOptions.Extra = elkGraph.LayoutOptions.Extra
+	wrapped.LayoutOptions.WrappingStrategy = "MULTI_EDGE"
+	wrapped.LayoutOptions.WrappingCorrectionFactor = correctionFactor
+	// ELK fails to wrap while considering the model order
+	wrapped.LayoutOptions.ConsiderModelOrder = ""
+	var clearModelOrder func([]*ELKNode)
+	clearModelOrder = func(nodes []*ELKNode) {
+		for _, n := range nodes {
+			if n.LayoutOptions != nil {
+				n.LayoutOptions.ConsiderModelOrder = ""
+			}
+			clearModelOrder(n.Children)
+		}
+	}
+	clearModelOrder(wrapped.Children)
+	return wrapped, nil
+}
+
+// interruptOnDone interrupts whatever vm is running once ctx is done, until the returned stop is called.
+// stop clears the interrupt if it came too late to stop anything, so that it doesn't stop what vm runs next.
+func interruptOnDone(ctx context.Context, vm *goja.Runtime) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			vm.Interrupt(ctx.Err())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		vm.ClearInterrupt()
+	}
+}
+
+// edgeFrame returns the object whose top left the route of e is relative to, or nil for the root.
+// An edge between a container and one of its descendants is relative to that container, not to
+// its parent, so it's resolved from the endpoints rather than trusting ELK's reported container
+func edgeFrame(edge *d2graph.Edge, e *ELKEdge, byID map[string]*d2graph.Object) *d2graph.Object {
+	if edge.Src != edge.Dst {
+		if edge.Dst.IsDescendantOf(edge.Src) {
+			return edge.Src
+		}
+		if edge.Src.IsDescendantOf(edge.Dst) {
+			return edge.Dst
+		}
+	}
+	if e.Container == "root" {
+		return nil
+	}
+	return byID[e.Container]
+}
+
+// orderSections is e's sections in order along it, from the one with no section before it through the ones each
+// leads out to, as ELK doesn't promise to list them in order. Sections off that chain, such as the branches of
+// hyperedges, follow in the order they're listed.
+func orderSections(e *ELKEdge) []ELKEdgeSection {
+	if len(e.Sections) < 2 {
+		return e.Sections
+	}
+	byID := make(map[string]int)
+	first := -1
+	for i, s := range e.Sections {
+		if s.ID != "" {
+			byID[s.ID] = i
+		}
+		if first == -1 && len(s.IncomingSections) == 0 {
+			first = i
+		}
+	}
+	if first == -1 {
+		return e.Sections
+	}
+
+	ordered := make([]ELKEdgeSection, 0, len(e.Sections))
+	used := make([]bool, len(e.Sections))
+	for i := first; i != -1; {
+		used[i] = true
+		ordered = append(ordered, e.Sections[i])
+		next := -1
+		for _, id := range e.Sections[i].OutgoingSections {
+			if j, ok := byID[id]; ok && !used[j] {
+				next = j
+				break
+			}
+		}
+		i = next
+	}
+	for i, s := range e.Sections {
+		if !used[i] {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+// routeContainer is the container edge is drawn within: the innermost one containing both its endpoints,
+// or the endpoint containing the other, or nil for the root
+func routeContainer(edge *d2graph.Edge) *d2graph.Object {
+	if edge.Src != edge.Dst {
+		if edge.Dst.IsDescendantOf(edge.Src) {
+			return edge.Src
+		}
+		if edge.Src.IsDescendantOf(edge.Dst) {
+			return edge.Dst
+		}
+	}
+	for c := edge.Src.Parent; c != nil && c.Parent != nil; c = c.Parent {
+		if edge.Dst.IsDescendantOf(c) {
+			return c
+		}
+	}
+	return nil
+}
+
+// movePoints moves the points of e's route and its junction points to where move takes them.
+// Routes may share points, so move is given a copy of each, which it may change or replace.
+func movePoints(e *d2graph.Edge, move func(*geo.Point) *geo.Point) {
+	for i, p := range e.Route {
+		e.Route[i] = move(geo.NewPoint(p.X, p.Y))
+	}
+	for i, p := range e.JunctionPoints {
+		e.JunctionPoints[i] = move(geo.NewPoint(p.X, p.Y))
+	}
+}
+
+// relativizeRoutes makes the routes and junction points of edges relative to the top left of their routeContainer
+func relativizeRoutes(edges []*d2graph.Edge) {
+	for _, e := range edges {
+		c := routeContainer(e)
+		if c == nil {
+			continue
+		}
+		movePoints(e, func(p *geo.Point) *geo.Point {
+			return geo.NewPoint(p.X-c.TopLeft.X, p.Y-c.TopLeft.Y)
+		})
+	}
+}
+
+// contentSize is the size of what ELK laid out in elkGraph, without the root's padding
+func contentSize(elkGraph *ELKGraph) (width, height float64) {
+	left, right := math.Inf(1), math.Inf(-1)
+	top, bottom := math.Inf(1), math.Inf(-1)
+	for _, n := range elkGraph.Children {
+		left = math.Min(left, n.X)
+		right = math.Max(right, n.X+n.Width)
+		top = math.Min(top, n.Y)
+		bottom = math.Max(bottom, n.Y+n.Height)
+	}
+	for _, e := range elkGraph.Edges {
+		if e.Container != "root" {
+			continue
+		}
+		for _, s := range e.Sections {
+			for _, p := range append([]ELKPoint{s.Start, s.End}, s.BendPoints...) {
+				left = math.Min(left, p.X)
+				right = math.Max(right, p.X)
+				top = math.Min(top, p.Y)
+				bottom = math.Max(bottom, p.Y)
+			}
+		}
+	}
+	return right - left, bottom - top
+}
+
+// contentAspectRatio is the width:height of what ELK laid out in elkGraph
+func contentAspectRatio(elkGraph *ELKGraph) float64 {
+	width, height := contentSize(elkGraph)
+	return width / height
+}
+
+// run lays out elkGraph with ELK, filling in the computed positions.
+// ELK is interrupted if ctx is done before it's finished.
+func (e *Engine) run(ctx context.Context, elkGraph *ELKGraph) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.vm == nil {
+		if err := e.load(); err != nil {
+			return err
+		}
+	}
+	vm := e.vm
+
+	raw, err := json.Marshal(elkGraph)
+	if err != nil {
+		return err
+	}
+
+	loadScript := fmt.Sprintf(`var graph = %s`, raw)
+
+	if _, err := vm.RunString(loadScript); err != nil {
+		return err
+	}
+	// Don't hold on to this graph once the next is loaded or the engine is idle
+	defer vm.RunString(`graph = undefined`)
+
+	atomic.AddInt64(&elkRuns, 1)
+	stop := interruptOnDone(ctx, vm)
+	val, err := vm.RunString(`elk.layout(graph)`)
+	stop()
+
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			// ELK is left partway through, so it's loaded again for the next layout
+			e.vm = nil
+			return ctx.Err()
+		}
+		return err
+	}
+
+	p := val.Export()
+	if err != nil {
+		return err
+	}
+
+	promise := p.(*goja.Promise)
+
+	for promise.State() == goja.PromiseStatePending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		continue
+	}
+
+	if promise.State() == goja.PromiseStateRejected {
+		if msg, ok := elkErrorMessage(promise.Result()); ok {
+			return fmt.Errorf("ELK layout error: %s", msg)
+		}
+		return errors.New("ELK: something went wrong")
+	}
+
+	result := promise.Result()
+	if msg, ok := elkErrorMessage(result); ok {
+		return fmt.Errorf("ELK layout error: %s", msg)
+	}
+	jsonOut, ok := result.Export().(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("ELK unexpected return: %v", result.Export())
+	}
+
+	jsonBytes, err := json.Marshal(jsonOut)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(jsonBytes, &elkGraph)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// applyLayout moves g's objects and edges to where ELK placed them in elkGraph
+func applyLayout(g *d2graph.Graph, elkGraph *ELKGraph, opts *ConfigurableOpts, stats *Stats) error {
+	elkNodes := make(map[string]*ELKNode)
+	var indexNodes func([]*ELKNode)
+	indexNodes = func(nodes []*ELKNode) {
+		for _, n := range nodes {
+			elkNodes[n.ID] = n
+			indexNodes(n.Children)
+		}
+	}
+	indexNodes(elkGraph.Children)
+
+	byID := make(map[string]*d2graph.Object)
+	// ports are where the ports of nodes are, by ID, before margins and labels are taken off their nodes
+	ports := make(map[string]*geo.Point)
+	// portFacing is the side of its node each port is on, by ID
+	portFacing := make(map[string]string)
 	walk(g.Root, nil, func(obj, parent *d2graph.Object) {
-		n := elkNodes[obj]
+		n := elkNodes[obj.AbsID()]
 
 		parentX := 0.0
 		parentY := 0.0
@@ -397,25 +1227,57 @@ func Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (err
 			parentY = parent.TopLeft.Y
 		}
 		obj.TopLeft = geo.NewPoint(parentX+n.X, parentY+n.Y)
+		for _, p := range n.Ports {
+			ports[p.ID] = geo.NewPoint(obj.TopLeft.X+p.X+p.Width/2, obj.TopLeft.Y+p.Y+p.Height/2)
+			if p.LayoutOptions != nil {
+				portFacing[p.ID] = p.LayoutOptions.PortSide
+			}
+		}
 		obj.Width = n.Width
 		obj.Height = n.Height
+		if len(obj.ChildrenArray) == 0 && obj != g.Root {
+			top, left, bottom, right, _ := parseSides(opts.NodeMargins)
+			obj.TopLeft.X += left
+			obj.TopLeft.Y += top
+			obj.Width -= left + right
+			obj.Height -= top + bottom
+		}
 
+		iconPosition, iconLabelPosition := leafIconPositions(obj, opts)
 		if obj.HasLabel() {
 			if len(obj.ChildrenArray) > 0 {
-				obj.LabelPosition = go2.Pointer(string(label.InsideTopCenter))
+				obj.LabelPosition = go2.Pointer(string(containerLabelPosition(obj, opts)))
+			} else if iconLabelPosition != "" {
+				obj.LabelPosition = go2.Pointer(string(iconLabelPosition))
 			} else if obj.HasOutsideBottomLabel() {
 				obj.LabelPosition = go2.Pointer(string(label.OutsideBottomCenter))
 				obj.Height -= float64(obj.LabelDimensions.Height) + label.PADDING
 			} else if obj.Icon != nil {
 				obj.LabelPosition = go2.Pointer(string(label.InsideTopCenter))
+			} else if labelPosition := leafLabelPosition(obj, opts); labelPosition != "" {
+				obj.LabelPosition = go2.Pointer(string(labelPosition))
+				top, left, bottom, right := outsideLabelMargins(obj, labelPosition)
+				obj.TopLeft.X += left
+				obj.TopLeft.Y += top
+				obj.Width -= left + right
+				obj.Height -= top + bottom
+				if top+bottom > 0 && obj.WidthAttr != nil && obj.Width <= float64(obj.LabelDimensions.Width) {
+					// The node was only widened to its label above or below it
+					if declared, err := strconv.Atoi(obj.WidthAttr.Value); err == nil && obj.Width > float64(declared) {
+						obj.TopLeft.X += (obj.Width - float64(declared)) / 2
+						obj.Width = float64(declared)
+					}
+				}
 			} else {
 				obj.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
 			}
 		}
 		if obj.Icon != nil {
 			if len(obj.ChildrenArray) > 0 {
-				obj.IconPosition = go2.Pointer(string(label.InsideTopLeft))
-				obj.LabelPosition = go2.Pointer(string(label.InsideTopRight))
+				obj.IconPosition = go2.Pointer(string(containerIconPosition(opts)))
+				obj.LabelPosition = go2.Pointer(string(containerLabelPosition(obj, opts)))
+			} else if iconPosition != "" {
+				obj.IconPosition = go2.Pointer(string(iconPosition))
 			} else {
 				obj.IconPosition = go2.Pointer(string(label.InsideMiddleCenter))
 			}
@@ -423,19 +1285,37 @@ func Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (err
 
 		byID[obj.AbsID()] = obj
 	})
+	if err := containChildren(g, elkNodes, opts.ChildOverflow); err != nil {
+		return err
+	}
 
+	elkEdges := make(map[string]*ELKEdge)
+	for _, e := range elkGraph.Edges {
+		elkEdges[e.ID] = e
+		// Labels were laid out with their padding
+		for _, l := range e.Labels {
+			padding := float64(opts.EdgeLabelPadding)
+			l.X += padding
+			l.Y += padding
+			l.Width -= 2 * padding
+			l.Height -= 2 * padding
+		}
+	}
+
+	labelCenters := make(map[*d2graph.Edge]*geo.Point)
 	for _, edge := range g.Edges {
-		e := elkEdges[edge]
+		e := elkEdges[edge.AbsID()]
 
 		parentX := 0.0
 		parentY := 0.0
-		if e.Container != "root" {
-			parentX = byID[e.Container].TopLeft.X
-			parentY = byID[e.Container].TopLeft.Y
+		if frame := edgeFrame(edge, e, byID); frame != nil {
+			parentX = frame.TopLeft.X
+			parentY = frame.TopLeft.Y
 		}
 
 		var points []*geo.Point
-		for _, s := range e.Sections {
+		sections := orderSections(e)
+		for _, s := range sections {
 			points = append(points, &geo.Point{
 				X: parentX + s.Start.X,
 				Y: parentY + s.Start.Y,
@@ -452,49 +1332,2125 @@ func Layout(ctx context.Context, g *d2graph.Graph, opts *ConfigurableOpts) (err
 			})
 		}
 
+		if len(points) == 0 {
+			// Algorithms other than layered leave edges across containers unrouted,
+			// so they go straight between the boxes
+			points = centerLine(edge)
+		} else {
+			// Routes through ports start and end on them
+			if p, ok := ports[sections[0].IncomingShape]; ok {
+				points[0] = geo.NewPoint(p.X, p.Y)
+			}
+			if p, ok := ports[sections[len(sections)-1].OutgoingShape]; ok {
+				points[len(points)-1] = geo.NewPoint(p.X, p.Y)
+			}
+		}
+
+		edge.JunctionPoints = nil
+		for _, jp := range e.JunctionPoints {
+			edge.JunctionPoints = append(edge.JunctionPoints, geo.NewPoint(parentX+jp.X, parentY+jp.Y))
+		}
+
 		startIndex, endIndex := 0, len(points)-1
 		srcShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Src.Shape.Value)], edge.Src.Box)
 		dstShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Dst.Shape.Value)], edge.Dst.Box)
 
-		// trace the edge to the specific shape's border
-		points[startIndex] = shape.TraceToShapeBorder(srcShape, points[startIndex], points[startIndex+1])
-		points[endIndex] = shape.TraceToShapeBorder(dstShape, points[endIndex], points[endIndex-1])
+		if opts.NodeMargins != "" {
+			// Routes end at the margins of leaves
+			if len(edge.Src.ChildrenArray) == 0 {
+				points[startIndex] = clipToBox(edge.Src.Box, points[startIndex], points[startIndex+1])
+			}
+			if len(edge.Dst.ChildrenArray) == 0 {
+				points[endIndex] = clipToBox(edge.Dst.Box, points[endIndex], points[endIndex-1])
+			}
+		}
+
+		if !opts.KeepELKEndpoints {
+			// trace the edge to the specific shape's border
+			points[startIndex] = shape.TraceToShapeBorder(srcShape, points[startIndex], points[startIndex+1])
+			points[endIndex] = shape.TraceToShapeBorder(dstShape, points[endIndex], points[endIndex-1])
+		}
+		points = guardRoute(edge, points, stats)
+		if len(sections) > 0 {
+			// Routes through ports arrive square to their sides, so arrowheads drawn along their ends point into them
+			if side := portFacing[sections[0].IncomingShape]; side != "" {
+				reverseRoute(points)
+				points = squareToSide(points, side)
+				reverseRoute(points)
+			}
+			if side := portFacing[sections[len(sections)-1].OutgoingShape]; side != "" {
+				points = squareToSide(points, side)
+			}
+		}
 
 		if edge.Label.Value != "" {
 			edge.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+			if opts.EdgeLabelSpacing > 0 && len(e.Labels) > 0 {
+				l := e.Labels[0]
+				labelCenters[edge] = geo.NewPoint(parentX+l.X+l.Width/2, parentY+l.Y+l.Height/2)
+			}
 		}
 
 		edge.Route = points
 	}
 
-	deleteBends(g)
+	if opts.CenterChildren {
+		centerChildren(g, elkNodes, labelCenters, opts)
+	}
+	if opts.KeepDeclaredSizes {
+		keepDeclaredSizes(g)
+	}
+	if opts.LayerDistance > 0 {
+		spaceLayers(g, float64(opts.LayerDistance), labelCenters, opts)
+	}
+	if opts.SelfLoopSides != nil {
+		spaceSelfLoops(g, *opts.SelfLoopSides)
+	}
+	var bands []labelBand
+	if opts.AvoidContainerLabels {
+		bands = labelBands(g)
+	}
+	// Edges into containers that flip the flow were laid out to the containers, so they're routed to their endpoints
+	for _, e := range g.Edges {
+		if crossesFlow(e) {
+			e.Route = orthogonalRoute(g, bands, e, opts)
+			e.JunctionPoints = nil
+			repairRoute(g, bands, e)
+		}
+	}
+	mergeNearPoints(g)
+	idx := newCollisionIndex(g)
+	// Stress routes edges as straight lines, so there are no bends to delete
+	if opts.Algorithm != "stress" {
+		deleteBends(g, idx)
+	}
+	if opts.MaxBends > 0 {
+		capBends(g, idx, opts.MaxBends)
+	}
+	if opts.SnapTracks {
+		snapTracks(g, float64(opts.EdgeNodeSpacing)/4.)
+		mergeNearPoints(g)
+	}
+	if opts.MinSegmentLength > 0 {
+		removeJogs(g, bands, float64(opts.MinSegmentLength))
+	}
+	repairCollisions(g, bands)
+	if opts.LeadOut > 0 {
+		leadOut(g, bands, float64(opts.LeadOut))
+	}
+	if opts.StubLength > 0 {
+		stubRoutes(g, bands, float64(opts.StubLength))
+	}
+	for _, edge := range g.Edges {
+		if go2.Contains(opts.CriticalEdges, edge.AbsID()) {
+			straighten(g, bands, edge)
+		}
+	}
+	// Straight edges and those through waypoints are drawn once the routes around them are final, so that no pass bends them
+	for _, edge := range g.Edges {
+		if opts.EdgeRouting[edge.AbsID()] == "STRAIGHT" {
+			edge.Route = guardRoute(edge, straightRoute(edge), stats)
+			edge.JunctionPoints = nil
+		}
+		if waypoints, ok := opts.Waypoints[edge.AbsID()]; ok {
+			edge.Route = waypointRoute(edge, waypoints)
+			edge.JunctionPoints = nil
+		}
+	}
+	if opts.AvoidCrossings {
+		uncross(g, bands, opts)
+		crossings := CountCrossings(g)
+		stats.Crossings = &crossings
+	}
+	if opts.FunnelEdges {
+		funnelEdges(g, bands, float64(opts.EdgeNodeSpacing)/2, func(e *d2graph.Edge) bool {
+			_, ok := opts.Waypoints[e.AbsID()]
+			return ok || opts.EdgeRouting[e.AbsID()] == "STRAIGHT"
+		})
+	}
+	if opts.ArrowheadInset {
+		insetArrowheads(g, bands)
+	}
+	// Routes are final, so labels can be placed along them
+	for _, edge := range g.Edges {
+		if center, ok := labelCenters[edge]; ok {
+			placeLabelBeside(edge, center)
+		}
+	}
+	if opts.EdgeLabelGap > 0 {
+		separateEdgeLabels(g, float64(opts.EdgeLabelGap))
+	}
+	if opts.EdgeLabelClearance > 0 {
+		clearEdgeLabels(g, float64(opts.EdgeLabelClearance), float64(opts.EdgeLabelGap))
+	}
+	if opts.ShiftBottomLabels {
+		shiftBottomLabels(g, opts)
+	}
+	return nil
+}
+
+// centerLine is the line between the centers of the boxes of edge's endpoints, clipped to the boxes
+func centerLine(edge *d2graph.Edge) []*geo.Point {
+	start, end := edge.Src.Box.Center(), edge.Dst.Box.Center()
+	segment := *geo.NewSegment(start, end)
+	if intersections := edge.Src.Box.Intersections(segment); len(intersections) > 0 {
+		start = intersections[0]
+	}
+	if intersections := edge.Dst.Box.Intersections(segment); len(intersections) > 0 {
+		end = intersections[0]
+	}
+	return []*geo.Point{start, end}
+}
+
+// straightRoute is the line between the borders of the shapes of edge's endpoints, along the line between their centers
+func straightRoute(edge *d2graph.Edge) []*geo.Point {
+	route := centerLine(edge)
+	srcShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Src.Shape.Value)], edge.Src.Box)
+	dstShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Dst.Shape.Value)], edge.Dst.Box)
+	start := shape.TraceToShapeBorder(srcShape, route[0], route[1])
+	end := shape.TraceToShapeBorder(dstShape, route[1], route[0])
+	return []*geo.Point{start, end}
+}
+
+// fallbackRouteLength is how far the route of an edge between stacked objects goes out of its source
+const fallbackRouteLength = 20
+
+// guardRoute is route, traced between the borders of edge's endpoints, unless its ends coincide, as they do
+// when the endpoints are stacked. Then it's a short line down out of the bottom of the source, so the edge
+// is still drawn, and the substitution is warned about in stats.
+func guardRoute(edge *d2graph.Edge, route []*geo.Point, stats *Stats) []*geo.Point {
+	start, end := route[0], route[len(route)-1]
+	// Tracing from a point to itself gives NaN, which fails the comparison too
+	if geo.EuclideanDistance(start.X, start.Y, end.X, end.Y) >= geo.PRECISION {
+		return route
+	}
+	stats.warn(fmt.Sprintf("edge %#v has endpoints at the same point, so it was routed out of the bottom of %#v", edge.AbsID(), edge.Src.AbsID()))
+	box := edge.Src.Box
+	start = geo.NewPoint(box.TopLeft.X+box.Width/2, box.TopLeft.Y+box.Height)
+	return []*geo.Point{start, geo.NewPoint(start.X, start.Y+fallbackRouteLength)}
+}
+
+// portLead is how far routes arriving at a port from behind its side are led out of it to turn in
+const portLead = 20.
+
+// squareToSide makes the last segment of route run square into side, the ELK port side its end is on,
+// bending the segment before it to meet it. Routes arriving from behind the side are led out of it first.
+func squareToSide(route []*geo.Point, side string) []*geo.Point {
+	n := len(route)
+	if n < 2 {
+		return route
+	}
+	end, prev := route[n-1], route[n-2]
+	normal := sideNormal(side)
+	if normal == nil {
+		return route
+	}
+	vertical := normal[0] == 0
+	if vertical && sameCoordinate(prev.X, end.X) || !vertical && sameCoordinate(prev.Y, end.Y) {
+		return route
+	}
+	// A corner meeting the end square, in line with prev along the side
+	corner := func(from *geo.Point) *geo.Point {
+		if vertical {
+			return geo.NewPoint(end.X, from.Y)
+		}
+		return geo.NewPoint(from.X, end.Y)
+	}
+
+	out := (prev.X-end.X)*normal[0] + (prev.Y-end.Y)*normal[1]
+	if out < geo.PRECISION {
+		lead := end.AddVector(normal.Multiply(portLead))
+		var turn *geo.Point
+		if vertical {
+			turn = geo.NewPoint(prev.X, lead.Y)
+		} else {
+			turn = geo.NewPoint(lead.X, prev.Y)
+		}
+		return append(route[:n-1:n-1], turn, lead, end)
+	}
+	squared := append([]*geo.Point{}, route...)
+	if n > 2 {
+		before := route[n-3]
+		if vertical && sameCoordinate(before.Y, prev.Y) || !vertical && sameCoordinate(before.X, prev.X) {
+			// The segment into prev runs along the side, so prev slides along it
+			squared[n-2] = corner(prev)
+			return squared
+		}
+	}
+	return append(squared[:n-1], corner(prev), end)
+}
 
+// sideNormal is the unit vector pointing out of the ELK port side side of a node, or nil if side isn't one
+func sideNormal(side string) geo.Vector {
+	switch side {
+	case "NORTH":
+		return geo.Vector{0, -1}
+	case "SOUTH":
+		return geo.Vector{0, 1}
+	case "EAST":
+		return geo.Vector{1, 0}
+	case "WEST":
+		return geo.Vector{-1, 0}
+	}
 	return nil
 }
 
-// deleteBends is a shim for ELK to delete unnecessary bends
-// see https://github.com/terrastruct/d2/issues/1030
-func deleteBends(g *d2graph.Graph) {
-	// Get rid of S-shapes at the source and the target
-	// TODO there might be value in repeating this. removal of an S shape introducing another S shape that can still be removed
-	for _, isSource := range []bool{true, false} {
-		for ei, e := range g.Edges {
-			if len(e.Route) < 4 {
-				continue
-			}
-			if e.Src == e.Dst {
-				continue
-			}
-			var endpoint *d2graph.Object
-			var start *geo.Point
-			var corner *geo.Point
-			var end *geo.Point
+// placeLabelBeside positions edge's label beside its route, as far along it and on the same side as center,
+// the middle of where ELK put the label
+func placeLabelBeside(edge *d2graph.Edge, center *geo.Point) {
+	route := geo.Route(edge.Route)
+	length := route.Length()
+	if length == 0 {
+		return
+	}
 
-			if isSource {
-				start = e.Route[0]
-				corner = e.Route[1]
-				end = e.Route[2]
-				endpoint = e.Src
+	distance, closestD := 0., math.Inf(1)
+	traveled := 0.
+	for i := 0; i < len(route)-1; i++ {
+		start, end := route[i], route[i+1]
+		v := start.VectorTo(end)
+		segmentLength := v.Length()
+		if segmentLength == 0 {
+			continue
+		}
+		// The projection of center onto the segment
+		along := ((center.X-start.X)*v[0] + (center.Y-start.Y)*v[1]) / segmentLength
+		along = math.Max(0, math.Min(segmentLength, along))
+		p := start.AddVector(v.Unit().Multiply(along))
+		if d := geo.EuclideanDistance(p.X, p.Y, center.X, center.Y); d < closestD {
+			distance, closestD = traveled+along, d
+		}
+		traveled += segmentLength
+	}
+	percentage := distance / length
+
+	strokeWidth := edgeStrokeWidth(edge)
+	width, height := float64(edge.LabelDimensions.Width), float64(edge.LabelDimensions.Height)
+	position, positionD := label.UnlockedTop, math.Inf(1)
+	for _, p := range []label.Position{label.UnlockedTop, label.UnlockedBottom} {
+		tl, _ := p.GetPointOnRoute(route, strokeWidth, percentage, width, height)
+		if d := geo.EuclideanDistance(tl.X+width/2, tl.Y+height/2, center.X, center.Y); d < positionD {
+			position, positionD = p, d
+		}
+	}
+	edge.LabelPosition = go2.Pointer(string(position))
+	edge.LabelPercentage = go2.Pointer(percentage)
+}
+
+// criticalPriority is the straightness priority ELK gives critical edges over the others' 0
+const criticalPriority = 10
+
+// shortEdgesPriority is the straightness priority ELK gives edges for the short-edges LayoutObjective, under critical edges'
+const shortEdgesPriority = 5
+
+// labelNudge is how far labels are slid along their routes at a time
+const labelNudge = 5.
+
+// movableLabels is the edges of g with labels that can be slid along their routes:
+// those in the middle of their edges, or already unlocked
+func movableLabels(g *d2graph.Graph) []*d2graph.Edge {
+	var edges []*d2graph.Edge
+	for _, edge := range g.Edges {
+		if edge.Label.Value == "" || edge.LabelPosition == nil || len(edge.Route) < 2 {
+			continue
+		}
+		position := label.Position(*edge.LabelPosition)
+		if position != label.InsideMiddleCenter && !position.IsUnlocked() {
+			continue
+		}
+		edges = append(edges, edge)
+	}
+	return edges
+}
+
+// slideLabel moves edge's label to the closest percentage along its route where its box at one of positions
+// is clear, trying them in order, and returns the box. Labels in the middle of their edges are unlocked to move them.
+// It's nil if there's nowhere clear short of the ends.
+func slideLabel(edge *d2graph.Edge, positions []label.Position, clear func(*geo.Box) bool) *geo.Box {
+	length := geo.Route(edge.Route).Length()
+	width, height := float64(edge.LabelDimensions.Width), float64(edge.LabelDimensions.Height)
+	// Far enough from the ends to stay off the objects there
+	margin := math.Max(width, height) / 2 / length
+	percentage := labelPercentage(edge)
+	for d := 0.; d < length; d += labelNudge {
+		for _, p := range []float64{percentage + d/length, percentage - d/length} {
+			if p < margin || p > 1-margin {
+				continue
+			}
+			for _, position := range positions {
+				if box := labelBoxAt(edge, position, p); clear(box) {
+					if position == label.InsideMiddleCenter {
+						position = label.UnlockedMiddle
+					}
+					edge.LabelPosition = go2.Pointer(string(position))
+					edge.LabelPercentage = go2.Pointer(p)
+					return box
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// separateEdgeLabels slides edge labels less than gap apart along their routes until they aren't.
+// Each overlap is resolved by moving the later label the least distance that clears it of every other label,
+// or the earlier one if the later can't be moved. Labels in the middle of their edges are unlocked to move them.
+func separateEdgeLabels(g *d2graph.Graph, gap float64) {
+	edges := movableLabels(g)
+	boxes := make(map[*d2graph.Edge]*geo.Box, len(edges))
+	for _, edge := range edges {
+		boxes[edge] = edgeLabelBox(edge, labelPercentage(edge))
+	}
+	// nudge moves edge's label to the closest percentage along its route where it's clear of the others
+	nudge := func(edge *d2graph.Edge) bool {
+		box := slideLabel(edge, []label.Position{label.Position(*edge.LabelPosition)}, func(box *geo.Box) bool {
+			for _, other := range edges {
+				if other != edge && boxesWithin(box, boxes[other], gap) {
+					return false
+				}
+			}
+			return true
+		})
+		if box == nil {
+			return false
+		}
+		boxes[edge] = box
+		return true
+	}
+
+	for i, edge := range edges {
+		for _, other := range edges[:i] {
+			if boxesWithin(boxes[edge], boxes[other], gap) {
+				if !nudge(edge) {
+					nudge(other)
+				}
+				break
+			}
+		}
+	}
+}
+
+// clearEdgeLabels moves edge labels within clearance of edges other than their own to the closest place along their
+// routes where they're clear of them, on their edges or beside them, for EdgeLabelClearance. Labels that are clear
+// nowhere stay put. They're kept gap from the other labels, for EdgeLabelGap.
+func clearEdgeLabels(g *d2graph.Graph, clearance, gap float64) {
+	edges := movableLabels(g)
+	boxes := make(map[*d2graph.Edge]*geo.Box, len(edges))
+	for _, edge := range edges {
+		boxes[edge] = edgeLabelBox(edge, labelPercentage(edge))
+	}
+	clearOf := func(edge *d2graph.Edge, box *geo.Box) bool {
+		for _, other := range g.Edges {
+			if other == edge {
+				continue
+			}
+			for i := 0; i < len(other.Route)-1; i++ {
+				if segmentWithin(box, *geo.NewSegment(other.Route[i], other.Route[i+1]), clearance) {
+					return false
+				}
+			}
+			if otherBox, ok := boxes[other]; ok && gap > 0 && boxesWithin(box, otherBox, gap) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, edge := range edges {
+		if clearOf(edge, boxes[edge]) {
+			continue
+		}
+		positions := []label.Position{label.Position(*edge.LabelPosition), label.UnlockedTop, label.UnlockedBottom}
+		if box := slideLabel(edge, positions, func(box *geo.Box) bool { return clearOf(edge, box) }); box != nil {
+			boxes[edge] = box
+		}
+	}
+}
+
+// segmentWithin is whether s comes within d of box
+func segmentWithin(box *geo.Box, s geo.Segment, d float64) bool {
+	if box.Intersects(s, d) {
+		return true
+	}
+	// Or lies within it entirely
+	return s.Start.X > box.TopLeft.X-d && s.Start.X < box.TopLeft.X+box.Width+d &&
+		s.Start.Y > box.TopLeft.Y-d && s.Start.Y < box.TopLeft.Y+box.Height+d
+}
+
+// labelPercentage is how far along its route edge's label is
+func labelPercentage(edge *d2graph.Edge) float64 {
+	if label.Position(*edge.LabelPosition).IsUnlocked() && edge.LabelPercentage != nil {
+		return *edge.LabelPercentage
+	}
+	return label.CENTER_LABEL_POSITION
+}
+
+// edgeLabelBox is the box of edge's label at percentage along its route
+func edgeLabelBox(edge *d2graph.Edge, percentage float64) *geo.Box {
+	return labelBoxAt(edge, label.Position(*edge.LabelPosition), percentage)
+}
+
+// labelBoxAt is the box of edge's label at position, percentage along its route
+func labelBoxAt(edge *d2graph.Edge, position label.Position, percentage float64) *geo.Box {
+	if position == label.InsideMiddleCenter {
+		position = label.UnlockedMiddle
+	}
+	width, height := float64(edge.LabelDimensions.Width), float64(edge.LabelDimensions.Height)
+	tl, _ := position.GetPointOnRoute(edge.Route, edgeStrokeWidth(edge), percentage, width, height)
+	return geo.NewBox(tl, width, height)
+}
+
+// boxesWithin is whether a and b are less than gap apart
+func boxesWithin(a, b *geo.Box, gap float64) bool {
+	return a.TopLeft.X < b.TopLeft.X+b.Width+gap && b.TopLeft.X < a.TopLeft.X+a.Width+gap &&
+		a.TopLeft.Y < b.TopLeft.Y+b.Height+gap && b.TopLeft.Y < a.TopLeft.Y+a.Height+gap
+}
+
+func edgeStrokeWidth(edge *d2graph.Edge) float64 {
+	if edge.Style.StrokeWidth != nil {
+		if w, err := strconv.Atoi(edge.Style.StrokeWidth.Value); err == nil {
+			return float64(w)
+		}
+	}
+	return float64(d2target.BaseConnection().StrokeWidth)
+}
+
+// arrowhead is the arrowhead drawn at an end of an edge, as the exporter resolves it
+func arrowhead(hasArrow bool, attrs *d2graph.Attributes) d2target.Arrowhead {
+	if !hasArrow {
+		return d2target.NoArrowhead
+	}
+	if attrs == nil || attrs.Shape.Value == "" {
+		return d2target.TriangleArrowhead
+	}
+	filled := false
+	if attrs.Style.Filled != nil {
+		filled, _ = strconv.ParseBool(attrs.Style.Filled.Value)
+	}
+	return d2target.ToArrowhead(attrs.Shape.Value, filled)
+}
+
+// insetArrowheads pulls the ends of routes with arrowheads back from the borders they reach by the length of
+// the arrowhead, along the last segment. Ends whose segment is too short to take it are left on the border, as are
+// those that would run through more objects or bands than before.
+func insetArrowheads(g *d2graph.Graph, bands []labelBand) {
+	for _, e := range g.Edges {
+		if len(e.Route) < 2 {
+			continue
+		}
+		strokeWidth := edgeStrokeWidth(e)
+		ends := []struct {
+			arrowhead  d2target.Arrowhead
+			end, inner int
+		}{
+			{arrowhead(e.SrcArrow, e.SrcArrowhead), 0, 1},
+			{arrowhead(e.DstArrow, e.DstArrowhead), len(e.Route) - 1, len(e.Route) - 2},
+		}
+		for _, end := range ends {
+			if end.arrowhead == d2target.NoArrowhead {
+				continue
+			}
+			length, _ := end.arrowhead.Dimensions(strokeWidth)
+			v := e.Route[end.end].VectorTo(e.Route[end.inner])
+			// Both ends of a straight route come out of the same segment
+			available := v.Length()
+			if len(e.Route) == 2 {
+				available /= 2
+			}
+			if available <= length {
+				continue
+			}
+			route := append([]*geo.Point{}, e.Route...)
+			route[end.end] = route[end.end].AddVector(v.Unit().Multiply(length))
+			if countCollisions(g, bands, e, route) <= countCollisions(g, bands, e, e.Route) {
+				e.Route = route
+			}
+		}
+	}
+}
+
+// BuildELKGraph converts g into the graph sent to ELK.
+// Objects may be resized to fit their ports and labels.
+// Gaps set on g's root are spacings unless opts sets them.
+func BuildELKGraph(g *d2graph.Graph, opts *ConfigurableOpts) *ELKGraph {
+	if opts == nil {
+		opts = &DefaultOpts
+	}
+	opts = withRootAttributes(g, opts)
+	elkGraph := &ELKGraph{
+		ID: "root",
+		LayoutOptions: &elkOpts{
+			Thoroughness:                 8,
+			EdgeEdgeBetweenLayersSpacing: 50,
+			EdgeNode:                     edge_node_spacing,
+			HierarchyHandling:            "INCLUDE_CHILDREN",
+			FixedAlignment:               "BALANCED",
+			ConsiderModelOrder:           "NODES_AND_EDGES",
+			NodeSizeConstraints:          "MINIMUM_SIZE",
+			ContentAlignment:             "H_CENTER V_CENTER",
+			ConfigurableOpts: ConfigurableOpts{
+				Algorithm:          opts.Algorithm,
+				NodeSpacing:        opts.NodeSpacing,
+				EdgeNodeSpacing:    opts.EdgeNodeSpacing,
+				SelfLoopSpacing:    opts.SelfLoopSpacing,
+				MergeEdges:         opts.MergeEdges,
+				CycleBreaking:      opts.CycleBreaking,
+				PostCompaction:     opts.PostCompaction,
+				ComponentOrder:     opts.ComponentOrder,
+				FavorStraightEdges: opts.FavorStraightEdges,
+				EdgeLabelSpacing:   opts.EdgeLabelSpacing,
+				SpacingBaseValue:   opts.SpacingBaseValue,
+				RandomSeed:         opts.RandomSeed,
+				Extra:              opts.Extra,
+			},
+		},
+	}
+	setLayoutQuality(elkGraph.LayoutOptions, opts)
+	setLayoutObjective(elkGraph.LayoutOptions, opts)
+	setGreedySwitch(elkGraph.LayoutOptions, opts)
+	setMaxNodesPerLayer(elkGraph.LayoutOptions, opts)
+	deriveSpacings(elkGraph.LayoutOptions, opts)
+	if opts.RootPadding != "" {
+		elkGraph.LayoutOptions.Padding = opts.RootPadding
+	}
+	if opts.Columns > 0 && !isGrid(g) {
+		rows := (len(g.Root.ChildrenArray) + opts.Columns - 1) / opts.Columns
+		elkGraph.LayoutOptions.WrappingStrategy = "MULTI_EDGE"
+		elkGraph.LayoutOptions.AspectRatio = float64(opts.Columns) / float64(go2.Max(rows, 1))
+		// ELK fails to wrap while considering the model order
+		elkGraph.LayoutOptions.ConsiderModelOrder = ""
+	}
+	if opts.Algorithm == "stress" {
+		elkGraph.LayoutOptions.DesiredEdgeLength = opts.DesiredEdgeLength
+		elkGraph.LayoutOptions.StressEpsilon = opts.StressEpsilon
+	}
+	if elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing == DefaultOpts.SelfLoopSpacing {
+		// +5 for a tiny bit of padding
+		elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing = go2.Max(elkGraph.LayoutOptions.ConfigurableOpts.SelfLoopSpacing, childrenMaxSelfLoop(g.Root, g.Root.Direction.Value == "down" || g.Root.Direction.Value == "" || g.Root.Direction.Value == "up")/2+5)
+	}
+	elkGraph.LayoutOptions.Direction = elkDirection(g.Root.Direction.Value)
+
+	elkNodes := make(map[*d2graph.Object]*ELKNode)
+
+	walk(g.Root, nil, func(obj, parent *d2graph.Object) {
+		if opts.UniformNodeSize != nil && len(obj.ChildrenArray) == 0 {
+			obj.Width = math.Max(obj.Width, opts.UniformNodeSize.X)
+			obj.Height = math.Max(obj.Height, opts.UniformNodeSize.Y)
+			s := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(obj.Shape.Value)], geo.NewBox(geo.NewPoint(0, 0), obj.Width, obj.Height))
+			if s.AspectRatio1() {
+				obj.Width = math.Max(obj.Width, obj.Height)
+				obj.Height = obj.Width
+			}
+		}
+
+		// Size the node so that every side fits the edges attaching to it,
+		// on the sides facing the way its container flows
+		outSide, inSide := portSides(flowDirection(obj.Parent))
+		sidePorts := make(map[string]float64)
+		for _, e := range g.Edges {
+			if e.Src == obj {
+				sidePorts[outSide]++
+			}
+			if e.Dst == obj {
+				sidePorts[inSide]++
+			}
+		}
+		for _, side := range []string{outSide, inSide} {
+			count := sidePorts[side]
+			if count < 2 {
+				continue
+			}
+			switch side {
+			case "EAST", "WEST":
+				obj.Height = math.Max(obj.Height, count*port_spacing)
+			default:
+				obj.Width = math.Max(obj.Width, count*port_spacing)
+			}
+		}
+
+		labelPosition := leafLabelPosition(obj, opts)
+		fitLabel(obj, labelPosition)
+		iconPosition, _ := leafIconPositions(obj, opts)
+		if iconPosition != "" {
+			fitIconBeside(obj, iconPosition)
+		}
+
+		if obj.Icon != nil && !obj.HasLabel() && len(obj.ChildrenArray) == 0 && obj.Shape.Value != d2target.ShapeImage {
+			// An icon in the middle of a node is sized to half of the node's smaller side,
+			// so small nodes are grown to show their icon at the default size
+			obj.Width = math.Max(obj.Width, 2*d2target.DEFAULT_ICON_SIZE)
+			obj.Height = math.Max(obj.Height, 2*d2target.DEFAULT_ICON_SIZE)
+		}
+
+		height := obj.Height
+		width := obj.Width
+		if obj.HasLabel() {
+			if obj.HasOutsideBottomLabel() || (obj.Icon != nil && iconPosition == "") {
+				height += float64(obj.LabelDimensions.Height) + label.PADDING
+			}
+			width = go2.Max(width, float64(obj.LabelDimensions.Width))
+		}
+		if opts.LabelNodeSpacing > 0 && obj.HasLabel() && len(obj.ChildrenArray) == 0 && !obj.HasOutsideBottomLabel() && !labelPosition.IsOutside() {
+			// Keep the label clear of edges attaching to the border
+			width = go2.Max(width, float64(obj.LabelDimensions.Width+2*opts.LabelNodeSpacing))
+			height = go2.Max(height, float64(obj.LabelDimensions.Height+2*opts.LabelNodeSpacing))
+		}
+		if labelPosition.IsOutside() {
+			top, left, bottom, right := outsideLabelMargins(obj, labelPosition)
+			if left+right > 0 {
+				width = obj.Width + left + right
+			}
+			height += top + bottom
+		}
+		if len(obj.ChildrenArray) == 0 {
+			top, left, bottom, right, _ := parseSides(opts.NodeMargins)
+			width += left + right
+			height += top + bottom
+		}
+
+		n := &ELKNode{
+			ID:     obj.AbsID(),
+			Width:  width,
+			Height: height,
+		}
+
+		if len(obj.ChildrenArray) > 0 {
+			n.LayoutOptions = &elkOpts{
+				ForceNodeModelOrder:          true,
+				Thoroughness:                 8,
+				EdgeEdgeBetweenLayersSpacing: 50,
+				HierarchyHandling:            "INCLUDE_CHILDREN",
+				FixedAlignment:               "BALANCED",
+				EdgeNode:                     edge_node_spacing,
+				ConsiderModelOrder:           "NODES_AND_EDGES",
+				NodeSizeConstraints:          "MINIMUM_SIZE",
+				ContentAlignment:             "H_CENTER V_CENTER",
+				ConfigurableOpts: ConfigurableOpts{
+					NodeSpacing:        opts.NodeSpacing,
+					EdgeNodeSpacing:    opts.EdgeNodeSpacing,
+					SelfLoopSpacing:    opts.SelfLoopSpacing,
+					Padding:            opts.Padding,
+					MergeEdges:         opts.MergeEdges,
+					CycleBreaking:      opts.CycleBreaking,
+					PostCompaction:     opts.PostCompaction,
+					ComponentOrder:     opts.ComponentOrder,
+					FavorStraightEdges: opts.FavorStraightEdges,
+					LabelNodeSpacing:   opts.LabelNodeSpacing,
+					EdgeLabelSpacing:   opts.EdgeLabelSpacing,
+					SpacingBaseValue:   opts.SpacingBaseValue,
+				},
+			}
+			if n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing == DefaultOpts.SelfLoopSpacing {
+				n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing = go2.Max(n.LayoutOptions.ConfigurableOpts.SelfLoopSpacing, childrenMaxSelfLoop(obj, flowDirection(obj) == "DOWN" || flowDirection(obj) == "UP")/2+5)
+			}
+
+			minimum := geo.Point{X: math.Ceil(width), Y: math.Ceil(height)}
+			if opts.ContainerMinimumSize != nil {
+				minimum = opts.ContainerMinimumSize(obj.AbsID(), minimum)
+			}
+			switch elkGraph.LayoutOptions.Direction {
+			case "DOWN", "UP":
+				n.LayoutOptions.NodeSizeMinimum = fmt.Sprintf("(%d, %d)", int(math.Ceil(minimum.Y)), int(math.Ceil(minimum.X)))
+			case "RIGHT", "LEFT":
+				n.LayoutOptions.NodeSizeMinimum = fmt.Sprintf("(%d, %d)", int(math.Ceil(minimum.X)), int(math.Ceil(minimum.Y)))
+			}
+
+			scale := paddingScale(obj, opts)
+			if n.LayoutOptions.Padding == DefaultOpts.Padding {
+				labelHeight := 0
+				if obj.HasLabel() {
+					labelHeight = obj.LabelDimensions.Height + label.PADDING
+				}
+
+				n.Height += 100 + float64(labelHeight)
+				n.Width += 100
+				contentBox := geo.NewBox(geo.NewPoint(0, 0), float64(n.Width), float64(n.Height))
+				shapeType := d2target.DSL_SHAPE_TO_SHAPE_TYPE[obj.Shape.Value]
+				s := shape.NewShape(shapeType, contentBox)
+
+				paddingTop := n.Height - s.GetInnerBox().Height
+				n.Height -= (100 + float64(labelHeight))
+				n.Width -= 100
+
+				iconHeight := 0
+				if obj.Icon != nil && obj.Shape.Value != d2target.ShapeImage {
+					iconHeight = d2target.GetIconSize(s.GetInnerBox(), string(label.InsideTopLeft)) + label.PADDING*2
+				}
+
+				paddingTop += float64(go2.Max(labelHeight, iconHeight))
+
+				side := int(math.Round(50 * scale))
+				n.LayoutOptions.Padding = fmt.Sprintf("[top=%d,left=%d,bottom=%d,right=%d]",
+					// Default padding
+					go2.Max(int(math.Ceil(paddingTop)), side), side, side, side,
+				)
+			} else if scale != 1 {
+				top, left, bottom, right, _ := parseSides(n.LayoutOptions.Padding)
+				n.LayoutOptions.Padding = fmt.Sprintf("[top=%v,left=%v,bottom=%v,right=%v]",
+					top*scale, left*scale, bottom*scale, right*scale,
+				)
+			}
+
+			setLayoutQuality(n.LayoutOptions, opts)
+			setLayoutObjective(n.LayoutOptions, opts)
+			setGreedySwitch(n.LayoutOptions, opts)
+			setMaxNodesPerLayer(n.LayoutOptions, opts)
+			if algorithm, ok := opts.ContainerAlgorithms[obj.AbsID()]; ok {
+				setContainerAlgorithm(n.LayoutOptions, algorithm, opts)
+			}
+			if flipsFlow(obj) {
+				n.LayoutOptions.Direction = flowDirection(obj)
+				n.LayoutOptions.HierarchyHandling = "SEPARATE_CHILDREN"
+			}
+			deriveSpacings(n.LayoutOptions, opts)
+			if opts.ContainerLabelAlignment != "" {
+				n.LayoutOptions.NodeLabelsPlacement = elkNodeLabelPlacements[containerLabelPosition(obj, opts)]
+			}
+		} else {
+			n.LayoutOptions = &elkOpts{
+				NodeLabelsPlacement: elkNodeLabelPlacements[labelPosition],
+				ConfigurableOpts: ConfigurableOpts{
+					LabelNodeSpacing:     opts.LabelNodeSpacing,
+					SelfLoopDistribution: opts.SelfLoopDistribution,
+				},
+			}
+			if n.LayoutOptions.SelfLoopDistribution == "" {
+				n.LayoutOptions.SelfLoopDistribution = DefaultOpts.SelfLoopDistribution
+			}
+		}
+		n.LayoutOptions.Alignment = opts.NodeAlignment
+
+		if obj.HasLabel() {
+			n.Labels = append(n.Labels, &ELKLabel{
+				Text:   obj.Label.Value,
+				Width:  float64(obj.LabelDimensions.Width),
+				Height: float64(obj.LabelDimensions.Height),
+			})
+		}
+
+		if parent == g.Root {
+			elkGraph.Children = append(elkGraph.Children, n)
+		} else {
+			elkNodes[parent].Children = append(elkNodes[parent].Children, n)
+		}
+		elkNodes[obj] = n
+	})
+
+	elkEdges := make(map[*d2graph.Edge]*ELKEdge)
+	for _, edge := range g.Edges {
+		e := &ELKEdge{
+			ID:      edge.AbsID(),
+			Sources: []string{edge.Src.AbsID()},
+			Targets: []string{edge.Dst.AbsID()},
+		}
+		constraint := go2.Contains(opts.ConstraintEdges, edge.AbsID())
+		if edge.Label.Value != "" && !constraint {
+			e.Labels = append(e.Labels, &ELKLabel{
+				Text:   edge.Label.Value,
+				Width:  float64(edge.LabelDimensions.Width + 2*opts.EdgeLabelPadding),
+				Height: float64(edge.LabelDimensions.Height + 2*opts.EdgeLabelPadding),
+				LayoutOptions: &elkOpts{
+					InlineEdgeLabels: opts.EdgeLabelSpacing == 0,
+				},
+			})
+		}
+		// Arrowhead labels are drawn at the ends of routes, so they're only laid out for ELK to make room for
+		for _, arrowhead := range []struct {
+			attrs     *d2graph.Attributes
+			placement string
+		}{{edge.SrcArrowhead, "TAIL"}, {edge.DstArrowhead, "HEAD"}} {
+			if constraint || arrowhead.attrs == nil || arrowhead.attrs.Label.Value == "" {
+				continue
+			}
+			e.Labels = append(e.Labels, &ELKLabel{
+				Text:   arrowhead.attrs.Label.Value,
+				Width:  float64(arrowhead.attrs.LabelDimensions.Width + 2*opts.EdgeLabelPadding),
+				Height: float64(arrowhead.attrs.LabelDimensions.Height + 2*opts.EdgeLabelPadding),
+				LayoutOptions: &elkOpts{
+					EdgeLabelsPlacement: arrowhead.placement,
+				},
+			})
+		}
+		switch opts.EdgeRouting[edge.AbsID()] {
+		case "ORTHOGONAL":
+			e.LayoutOptions = &elkOpts{EdgeRouting: "ORTHOGONAL"}
+		case "STRAIGHT":
+			// ELK still routes the edge, among the others, though it's drawn straight.
+			// Its routings have no straight lines, so it's marked with the closest.
+			e.LayoutOptions = &elkOpts{EdgeRouting: "POLYLINE"}
+		}
+		if go2.Contains(opts.CriticalEdges, edge.AbsID()) {
+			if e.LayoutOptions == nil {
+				e.LayoutOptions = &elkOpts{}
+			}
+			e.LayoutOptions.StraightnessPriority = criticalPriority
+		} else if opts.LayoutObjective == "short-edges" {
+			if e.LayoutOptions == nil {
+				e.LayoutOptions = &elkOpts{}
+			}
+			e.LayoutOptions.StraightnessPriority = shortEdgesPriority
+		}
+		elkGraph.Edges = append(elkGraph.Edges, e)
+		elkEdges[edge] = e
+	}
+
+	if opts.OrderedPorts {
+		addOrderedPorts(g, elkNodes, elkEdges)
+	} else {
+		addSidePorts(g, elkNodes, elkEdges)
+	}
+	for _, edge := range g.Edges {
+		if src := flowEndpoint(edge.Src, edge.Dst); src != edge.Src {
+			elkEdges[edge].Sources = []string{src.AbsID()}
+		}
+		if dst := flowEndpoint(edge.Dst, edge.Src); dst != edge.Dst {
+			elkEdges[edge].Targets = []string{dst.AbsID()}
+		}
+	}
+
+	if len(opts.OrderConstraints) > 0 {
+		// ELK keeps nodes in the order they're given when forced to,
+		// so constrained siblings are reordered and their parent forced
+		if orderChildren(elkGraph.Children, opts.OrderConstraints) {
+			elkGraph.LayoutOptions.ForceNodeModelOrder = true
+		}
+		for _, obj := range g.Objects {
+			if n := elkNodes[obj]; orderChildren(n.Children, opts.OrderConstraints) {
+				n.LayoutOptions.ForceNodeModelOrder = true
+			}
+		}
+	}
+
+	return elkGraph
+}
+
+// validateOpts rejects options ELK would fail on or silently misapply.
+// Spacings and the stress epsilon can be 0 but not negative.
+func validateOpts(opts *ConfigurableOpts) error {
+	spacings := []struct {
+		key   string
+		value float64
+	}{
+		{"spacing.nodeNodeBetweenLayers", float64(opts.NodeSpacing)},
+		{"spacing.edgeNodeBetweenLayers", float64(opts.EdgeNodeSpacing)},
+		{"elk.spacing.nodeSelfLoop", float64(opts.SelfLoopSpacing)},
+		{"elk.spacing.labelNode", float64(opts.LabelNodeSpacing)},
+		{"elk.spacing.edgeLabel", float64(opts.EdgeLabelSpacing)},
+		{"elk.layered.spacing.baseValue", float64(opts.SpacingBaseValue)},
+		{"elk.stress.desiredEdgeLength", opts.DesiredEdgeLength},
+		{"elk.stress.epsilon", opts.StressEpsilon},
+	}
+	for _, s := range spacings {
+		if s.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", s.key, s.value)
+		}
+	}
+
+	if opts.MaxNodesPerLayer < 0 {
+		return fmt.Errorf("max nodes per layer must not be negative, got %v", opts.MaxNodesPerLayer)
+	}
+	if opts.Columns < 0 {
+		return fmt.Errorf("columns must not be negative, got %v", opts.Columns)
+	}
+	if opts.ColumnGutter < 0 {
+		return fmt.Errorf("column gutter must not be negative, got %v", opts.ColumnGutter)
+	}
+	if opts.MinSegmentLength < 0 {
+		return fmt.Errorf("min segment length must not be negative, got %v", opts.MinSegmentLength)
+	}
+	if opts.EdgeLabelClearance < 0 {
+		return fmt.Errorf("edge label clearance must not be negative, got %v", opts.EdgeLabelClearance)
+	}
+	if opts.LayerDistance < 0 {
+		return fmt.Errorf("layer distance must not be negative, got %v", opts.LayerDistance)
+	}
+	if opts.EdgeLabelGap < 0 {
+		return fmt.Errorf("edge label gap must not be negative, got %v", opts.EdgeLabelGap)
+	}
+	if opts.EdgeLabelPadding < 0 {
+		return fmt.Errorf("edge label padding must not be negative, got %v", opts.EdgeLabelPadding)
+	}
+	if opts.LeadOut < 0 {
+		return fmt.Errorf("lead out must not be negative, got %v", opts.LeadOut)
+	}
+	if opts.StubLength < 0 {
+		return fmt.Errorf("stub length must not be negative, got %v", opts.StubLength)
+	}
+	if opts.PaddingScale < 0 {
+		return fmt.Errorf("padding scale must not be negative, got %v", opts.PaddingScale)
+	}
+	if opts.PaddingScale != 0 {
+		if _, _, _, _, ok := parseSides(opts.Padding); !ok {
+			return fmt.Errorf("invalid padding %#v", opts.Padding)
+		}
+	}
+	if opts.RootPadding != "" {
+		if _, _, _, _, ok := parseSides(opts.RootPadding); !ok {
+			return fmt.Errorf("invalid root padding %#v", opts.RootPadding)
+		}
+	}
+	if opts.MaxWidth < 0 {
+		return fmt.Errorf("max width must not be negative, got %v", opts.MaxWidth)
+	}
+	if opts.UniformNodeSize != nil && (opts.UniformNodeSize.X < 0 || opts.UniformNodeSize.Y < 0) {
+		return fmt.Errorf("uniform node size must not be negative, got %vx%v", opts.UniformNodeSize.X, opts.UniformNodeSize.Y)
+	}
+	if s := opts.SelfLoopSides; s != nil && (s.Top < 0 || s.Right < 0 || s.Bottom < 0 || s.Left < 0) {
+		return fmt.Errorf("self-loop sides must not be negative, got %+v", *s)
+	}
+	if opts.MaxDimensions != nil && (opts.MaxDimensions.X < 0 || opts.MaxDimensions.Y < 0) {
+		return fmt.Errorf("max dimensions must not be negative, got %vx%v", opts.MaxDimensions.X, opts.MaxDimensions.Y)
+	}
+	if opts.MaxAspectRatio < 0 {
+		return fmt.Errorf("max aspect ratio must not be negative, got %v", opts.MaxAspectRatio)
+	}
+	if opts.MinAspectRatio < 0 {
+		return fmt.Errorf("min aspect ratio must not be negative, got %v", opts.MinAspectRatio)
+	}
+	if opts.MaxAspectRatio > 0 && opts.MinAspectRatio > opts.MaxAspectRatio {
+		return fmt.Errorf("min aspect ratio must not be over max aspect ratio, got %v and %v", opts.MinAspectRatio, opts.MaxAspectRatio)
+	}
+
+	switch opts.SelfLoopDistribution {
+	case "", "EQUALLY", "NORTH", "NORTH_SOUTH":
+	default:
+		return fmt.Errorf("invalid self-loop distribution %#v", opts.SelfLoopDistribution)
+	}
+
+	switch opts.LayoutQuality {
+	case "", "fast", "balanced", "best":
+	default:
+		return fmt.Errorf("invalid layout quality %#v", opts.LayoutQuality)
+	}
+
+	switch opts.LayoutObjective {
+	case "", "compact", "readable", "short-edges":
+	default:
+		return fmt.Errorf("invalid layout objective %#v", opts.LayoutObjective)
+	}
+
+	switch opts.CycleBreaking {
+	case "", "GREEDY", "DEPTH_FIRST", "INTERACTIVE", "MODEL_ORDER":
+	default:
+		return fmt.Errorf("invalid cycle breaking strategy %#v", opts.CycleBreaking)
+	}
+
+	switch opts.PostCompaction {
+	case "", "NONE", "LEFT", "RIGHT", "LEFT_RIGHT_CONSTRAINT_LOCKING", "LEFT_RIGHT_CONNECTION_LOCKING", "EDGE_LENGTH":
+	default:
+		return fmt.Errorf("invalid post-compaction strategy %#v", opts.PostCompaction)
+	}
+
+	switch opts.GreedySwitchType {
+	case "", "OFF", "ONE_SIDED", "TWO_SIDED":
+	default:
+		return fmt.Errorf("invalid greedy switch type %#v", opts.GreedySwitchType)
+	}
+	if opts.GreedySwitchThreshold != nil && *opts.GreedySwitchThreshold < 0 {
+		return fmt.Errorf("greedy switch threshold must not be negative, got %v", *opts.GreedySwitchThreshold)
+	}
+
+	switch opts.ComponentOrder {
+	case "", "NONE", "INSIDE_PORT_SIDE_GROUPS", "FORCE_MODEL_ORDER":
+	default:
+		return fmt.Errorf("invalid component order %#v", opts.ComponentOrder)
+	}
+
+	switch opts.NodeAlignment {
+	case "", "TOP", "CENTER", "BOTTOM", "LEFT", "RIGHT":
+	default:
+		return fmt.Errorf("invalid node alignment %#v", opts.NodeAlignment)
+	}
+
+	switch opts.OrphanCorner {
+	case "", "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return fmt.Errorf("invalid orphan corner %#v", opts.OrphanCorner)
+	}
+
+	switch opts.Mirror {
+	case "", "horizontal", "vertical":
+	default:
+		return fmt.Errorf("invalid mirror %#v", opts.Mirror)
+	}
+
+	switch opts.ContainerLabelAlignment {
+	case "", "left", "center", "right":
+	default:
+		return fmt.Errorf("invalid container label alignment %#v", opts.ContainerLabelAlignment)
+	}
+
+	switch opts.RouteCoordinateSpace {
+	case "", "absolute", "container-relative":
+	default:
+		return fmt.Errorf("invalid route coordinate space %#v", opts.RouteCoordinateSpace)
+	}
+
+	switch opts.LeafIconSide {
+	case "", "left", "right":
+	default:
+		return fmt.Errorf("invalid leaf icon side %#v", opts.LeafIconSide)
+	}
+
+	switch opts.ChildOverflow {
+	case "", "error", "grow":
+	default:
+		return fmt.Errorf("invalid child overflow %#v", opts.ChildOverflow)
+	}
+
+	if _, _, _, _, ok := parseSides(opts.NodeMargins); !ok {
+		return fmt.Errorf("invalid node margins %#v", opts.NodeMargins)
+	}
+
+	if opts.NodeLabelPosition != "" {
+		if _, ok := elkNodeLabelPlacements[label.Position(opts.NodeLabelPosition)]; !ok {
+			return fmt.Errorf("invalid node label position %#v", opts.NodeLabelPosition)
+		}
+	}
+	if opts.OverflowLabelPosition != "" && !label.Position(opts.OverflowLabelPosition).IsOutside() {
+		return fmt.Errorf("invalid overflow label position %#v", opts.OverflowLabelPosition)
+	}
+
+	keys := make([]string, 0, len(opts.Extra))
+	for k := range opts.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !elkOptionPath.MatchString(k) {
+			return fmt.Errorf("invalid ELK option %#v", k)
+		}
+	}
+	return nil
+}
+
+// elkOptionPath matches ELK option keys, dot separated identifiers like elk.layered.spacing.edgeEdgeBetweenLayers
+var elkOptionPath = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*(\.[a-zA-Z][a-zA-Z0-9]*)*$`)
+
+func validateContainerAlgorithms(g *d2graph.Graph, algorithms map[string]string) error {
+	if len(algorithms) == 0 {
+		return nil
+	}
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	ids := make([]string, 0, len(algorithms))
+	for id := range algorithms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		obj, ok := objects[id]
+		if !ok {
+			return fmt.Errorf("algorithm on unknown object %#v", id)
+		}
+		if len(obj.ChildrenArray) == 0 {
+			return fmt.Errorf("algorithm on %#v, which isn't a container", id)
+		}
+		if algorithms[id] == "" {
+			return fmt.Errorf("empty algorithm on %#v", id)
+		}
+	}
+	return nil
+}
+
+func validateEdgeRouting(g *d2graph.Graph, routing map[string]string) error {
+	if len(routing) == 0 {
+		return nil
+	}
+	edges := make(map[string]*d2graph.Edge)
+	for _, e := range g.Edges {
+		edges[e.AbsID()] = e
+	}
+	ids := make([]string, 0, len(routing))
+	for id := range routing {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		e, ok := edges[id]
+		if !ok {
+			return fmt.Errorf("routing on unknown edge %#v", id)
+		}
+		switch routing[id] {
+		case "ORTHOGONAL":
+		case "STRAIGHT":
+			if e.Src == e.Dst {
+				return fmt.Errorf("straight routing on %#v, which is a self-loop", id)
+			}
+		default:
+			return fmt.Errorf("invalid routing %#v on %#v", routing[id], id)
+		}
+	}
+	return nil
+}
+
+// validateEdgeIDs rejects ids of the edges an option named what is on, if they aren't g's or are self-loops
+func validateEdgeIDs(g *d2graph.Graph, ids []string, what string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	edges := make(map[string]*d2graph.Edge)
+	for _, e := range g.Edges {
+		edges[e.AbsID()] = e
+	}
+	for _, id := range ids {
+		e, ok := edges[id]
+		if !ok {
+			return fmt.Errorf("%s on unknown edge %#v", what, id)
+		}
+		if e.Src == e.Dst {
+			return fmt.Errorf("%s on %#v, which is a self-loop", what, id)
+		}
+	}
+	return nil
+}
+
+// setLayoutQuality sets the search options of opts.LayoutQuality on the options of the root or a container
+func setLayoutQuality(o *elkOpts, opts *ConfigurableOpts) {
+	switch opts.LayoutQuality {
+	case "fast":
+		o.Thoroughness = 1
+		o.GreedySwitch = "OFF"
+		o.GreedySwitchHierarchical = "OFF"
+		o.NodePlacement = "SIMPLE"
+		o.ConsiderModelOrder = ""
+		if o.CycleBreaking == "" {
+			o.CycleBreaking = "GREEDY"
+		}
+	case "balanced":
+		o.Thoroughness = 8
+		o.CrossingMinimization = "LAYER_SWEEP"
+		o.NodePlacement = "BRANDES_KOEPF"
+	case "best":
+		o.Thoroughness = 20
+		o.CrossingMinimization = "LAYER_SWEEP"
+		o.GreedySwitch = "TWO_SIDED"
+		o.GreedySwitchHierarchical = "TWO_SIDED"
+		o.NodePlacement = "NETWORK_SIMPLEX"
+	}
+}
+
+// setLayoutObjective sets the options of opts.LayoutObjective on the options of the root or a container
+func setLayoutObjective(o *elkOpts, opts *ConfigurableOpts) {
+	halveSpacings := func() {
+		if o.SpacingBaseValue != 0 {
+			return
+		}
+		if o.NodeSpacing == DefaultOpts.NodeSpacing {
+			o.NodeSpacing /= 2
+		}
+		if o.EdgeNodeSpacing == DefaultOpts.EdgeNodeSpacing {
+			o.EdgeNodeSpacing /= 2
+		}
+		o.EdgeEdgeBetweenLayersSpacing /= 2
+	}
+	switch opts.LayoutObjective {
+	case "compact":
+		o.NodePlacement = "NETWORK_SIMPLEX"
+		if o.PostCompaction == "" {
+			o.PostCompaction = "LEFT"
+		}
+		halveSpacings()
+	case "readable":
+		o.CrossingMinimization = "LAYER_SWEEP"
+		o.GreedySwitch = "TWO_SIDED"
+		o.GreedySwitchHierarchical = "TWO_SIDED"
+		o.NodePlacement = "BRANDES_KOEPF"
+		if o.FavorStraightEdges == nil {
+			o.FavorStraightEdges = go2.Pointer(true)
+		}
+	case "short-edges":
+		o.NodePlacement = "NETWORK_SIMPLEX"
+		if o.PostCompaction == "" {
+			o.PostCompaction = "EDGE_LENGTH"
+		}
+		halveSpacings()
+	}
+}
+
+// setGreedySwitch sets opts' greedy switch options on the options of the root or a container
+func setGreedySwitch(o *elkOpts, opts *ConfigurableOpts) {
+	if opts.GreedySwitchType != "" {
+		o.GreedySwitch = opts.GreedySwitchType
+		o.GreedySwitchHierarchical = opts.GreedySwitchType
+	}
+	o.GreedySwitchActivationThreshold = opts.GreedySwitchThreshold
+}
+
+// setMaxNodesPerLayer bounds the layers of the root or a container to opts.MaxNodesPerLayer objects.
+// Connected components are otherwise laid out separately, each within the bound, and then packed side by side.
+func setMaxNodesPerLayer(o *elkOpts, opts *ConfigurableOpts) {
+	if opts.MaxNodesPerLayer == 0 || opts.Algorithm != "layered" {
+		return
+	}
+	o.LayeringStrategy = "COFFMAN_GRAHAM"
+	o.LayerBound = opts.MaxNodesPerLayer
+	o.SeparateConnectedComponents = go2.Pointer(false)
+}
+
+// deriveSpacings leaves the spacings of o that are at their defaults for ELK to derive from its SpacingBaseValue,
+// since ELK only derives the ones it isn't given. Only the layered algorithm derives them.
+func deriveSpacings(o *elkOpts, opts *ConfigurableOpts) {
+	if o.SpacingBaseValue == 0 || opts.Algorithm != "layered" {
+		return
+	}
+	if o.NodeSpacing == DefaultOpts.NodeSpacing {
+		o.NodeSpacing = 0
+	}
+	if o.EdgeNodeSpacing == DefaultOpts.EdgeNodeSpacing {
+		o.EdgeNodeSpacing = 0
+	}
+	if o.EdgeNode == edge_node_spacing {
+		o.EdgeNode = 0
+	}
+	o.EdgeEdgeBetweenLayersSpacing = 0
+}
+
+// setContainerAlgorithm scopes containerOpts to algorithm. Other algorithms than layered
+// lay out the container's children separately, so the layered options are swapped for their equivalents.
+func setContainerAlgorithm(containerOpts *elkOpts, algorithm string, opts *ConfigurableOpts) {
+	containerOpts.Algorithm = algorithm
+	if algorithm == "layered" {
+		return
+	}
+	containerOpts.HierarchyHandling = "SEPARATE_CHILDREN"
+	containerOpts.NodeNode = containerOpts.NodeSpacing
+	containerOpts.NodeSpacing = 0
+	containerOpts.EdgeNodeSpacing = 0
+	containerOpts.Thoroughness = 0
+	containerOpts.EdgeEdgeBetweenLayersSpacing = 0
+	containerOpts.FixedAlignment = ""
+	containerOpts.ConsiderModelOrder = ""
+	containerOpts.ForceNodeModelOrder = false
+	containerOpts.MergeEdges = false
+	containerOpts.CycleBreaking = ""
+	containerOpts.PostCompaction = ""
+	containerOpts.ComponentOrder = ""
+	containerOpts.FavorStraightEdges = nil
+	containerOpts.SpacingBaseValue = 0
+	containerOpts.CrossingMinimization = ""
+	containerOpts.GreedySwitch = ""
+	containerOpts.GreedySwitchHierarchical = ""
+	containerOpts.GreedySwitchActivationThreshold = nil
+	containerOpts.LayeringStrategy = ""
+	containerOpts.LayerBound = 0
+	containerOpts.SeparateConnectedComponents = nil
+	containerOpts.NodePlacement = ""
+	if algorithm == "stress" {
+		containerOpts.DesiredEdgeLength = opts.DesiredEdgeLength
+		containerOpts.StressEpsilon = opts.StressEpsilon
+	}
+}
+
+func validateOrderConstraints(g *d2graph.Graph, constraints []OrderConstraint) error {
+	if len(constraints) == 0 {
+		return nil
+	}
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	for _, c := range constraints {
+		before, ok := objects[c.Before]
+		if !ok {
+			return fmt.Errorf("order constraint on unknown object %#v", c.Before)
+		}
+		after, ok := objects[c.After]
+		if !ok {
+			return fmt.Errorf("order constraint on unknown object %#v", c.After)
+		}
+		if before.Parent != after.Parent {
+			return fmt.Errorf("order constraint between %#v and %#v, which don't share a parent", c.Before, c.After)
+		}
+	}
+
+	successors := make(map[string][]string)
+	for _, c := range constraints {
+		successors[c.Before] = append(successors[c.Before], c.After)
+	}
+	visiting := make(map[string]bool)
+	visited := make(map[string]bool)
+	var acyclic func(string) bool
+	acyclic = func(id string) bool {
+		if visiting[id] {
+			return false
+		}
+		if visited[id] {
+			return true
+		}
+		visiting[id] = true
+		for _, next := range successors[id] {
+			if !acyclic(next) {
+				return false
+			}
+		}
+		visiting[id] = false
+		visited[id] = true
+		return true
+	}
+	for _, c := range constraints {
+		if !acyclic(c.Before) {
+			return fmt.Errorf("order constraints on %#v form a cycle", c.Before)
+		}
+	}
+	return nil
+}
+
+// orderChildren reorders nodes so that every constraint between them holds,
+// moving the nodes that must come first ahead of the ones that must follow them.
+// It returns whether any constraint applied to nodes.
+func orderChildren(nodes []*ELKNode, constraints []OrderConstraint) bool {
+	byID := make(map[string]*ELKNode)
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	predecessors := make(map[string][]*ELKNode)
+	for _, c := range constraints {
+		if byID[c.Before] != nil && byID[c.After] != nil {
+			predecessors[c.After] = append(predecessors[c.After], byID[c.Before])
+		}
+	}
+	if len(predecessors) == 0 {
+		return false
+	}
+
+	ordered := make([]*ELKNode, 0, len(nodes))
+	// Nodes are marked before their predecessors are placed so that cycles terminate
+	placed := make(map[string]bool)
+	var place func(*ELKNode)
+	place = func(n *ELKNode) {
+		if placed[n.ID] {
+			return
+		}
+		placed[n.ID] = true
+		for _, p := range predecessors[n.ID] {
+			place(p)
+		}
+		ordered = append(ordered, n)
+	}
+	for _, n := range nodes {
+		place(n)
+	}
+	copy(nodes, ordered)
+	return true
+}
+
+// portSides is the side of a node that edges leave from and the side they enter on in an ELK direction
+func portSides(direction string) (outSide, inSide string) {
+	switch direction {
+	case "UP":
+		return "NORTH", "SOUTH"
+	case "RIGHT":
+		return "EAST", "WEST"
+	case "LEFT":
+		return "WEST", "EAST"
+	default:
+		return "SOUTH", "NORTH"
+	}
+}
+
+// portSideClass prefixes the classes of arrowheads that fix their end of an edge to a side of its node,
+// e.g. target-arrowhead.class: elk-port-north. Classes for styling that are named after sides fix nothing.
+const portSideClass = "elk-port-"
+
+// endpointSide is the ELK port side that a portSideClass among the classes of an edge's arrowhead attaches
+// that end of the edge to, or "" if there's none. Ends on containers aren't fixed, so the hint is ignored there.
+func endpointSide(arrowhead *d2graph.Attributes) string {
+	if arrowhead == nil {
+		return ""
+	}
+	for _, class := range arrowhead.Classes {
+		if len(class) <= len(portSideClass) || !strings.EqualFold(class[:len(portSideClass)], portSideClass) {
+			continue
+		}
+		switch side := strings.ToUpper(class[len(portSideClass):]); side {
+		case "NORTH", "SOUTH", "EAST", "WEST":
+			return side
+		}
+	}
+	return ""
+}
+
+// addSidePorts gives the ends of edges with an endpointSide a port on that side of the leaf nodes they connect.
+// Containers keep edges attached to the node so they can route into its children, so their ends aren't fixed.
+func addSidePorts(g *d2graph.Graph, elkNodes map[*d2graph.Object]*ELKNode, elkEdges map[*d2graph.Edge]*ELKEdge) {
+	addPort := func(obj *d2graph.Object, side, id string) string {
+		if side == "" || len(obj.ChildrenArray) > 0 {
+			return obj.AbsID()
+		}
+		n := elkNodes[obj]
+		n.LayoutOptions.PortConstraints = "FIXED_SIDE"
+		n.Ports = append(n.Ports, &ELKPort{
+			ID: id,
+			LayoutOptions: &elkOpts{
+				PortSide: side,
+			},
+		})
+		return id
+	}
+
+	for _, edge := range g.Edges {
+		if edge.Src == edge.Dst {
+			continue
+		}
+		e := elkEdges[edge]
+		e.Sources = []string{addPort(edge.Src, endpointSide(edge.SrcArrowhead), edge.AbsID()+".src")}
+		e.Targets = []string{addPort(edge.Dst, endpointSide(edge.DstArrowhead), edge.AbsID()+".dst")}
+	}
+}
+
+// addOrderedPorts gives every edge its own port on the leaf nodes it connects,
+// fixing the ports around each node in the order the edges were declared.
+// Outgoing edges leave from the side facing the direction the node's container flows in and incoming edges enter on
+// the opposite side, unless their endpointSide says otherwise.
+func addOrderedPorts(g *d2graph.Graph, elkNodes map[*d2graph.Object]*ELKNode, elkEdges map[*d2graph.Edge]*ELKEdge) {
+	sidePorts := make(map[*d2graph.Object]map[string][]*ELKPort)
+	addPort := func(obj *d2graph.Object, side, id string) string {
+		// Containers keep edges attached to the node so they can route into its children
+		if len(obj.ChildrenArray) > 0 {
+			return obj.AbsID()
+		}
+		if sidePorts[obj] == nil {
+			sidePorts[obj] = make(map[string][]*ELKPort)
+		}
+		sidePorts[obj][side] = append(sidePorts[obj][side], &ELKPort{
+			ID: id,
+			LayoutOptions: &elkOpts{
+				PortSide: side,
+			},
+		})
+		return id
+	}
+
+	for _, edge := range g.Edges {
+		if edge.Src == edge.Dst {
+			continue
+		}
+		srcSide, _ := portSides(flowDirection(edge.Src.Parent))
+		_, dstSide := portSides(flowDirection(edge.Dst.Parent))
+		if side := endpointSide(edge.SrcArrowhead); side != "" {
+			srcSide = side
+		}
+		if side := endpointSide(edge.DstArrowhead); side != "" {
+			dstSide = side
+		}
+		e := elkEdges[edge]
+		e.Sources = []string{addPort(edge.Src, srcSide, edge.AbsID()+".src")}
+		e.Targets = []string{addPort(edge.Dst, dstSide, edge.AbsID()+".dst")}
+	}
+
+	for _, obj := range g.Objects {
+		if sidePorts[obj] == nil {
+			continue
+		}
+		n := elkNodes[obj]
+		n.LayoutOptions.PortConstraints = "FIXED_ORDER"
+		// Grow the node to fit its ports, but never shrink it below how it was sized
+		n.LayoutOptions.NodeSizeConstraints = "PORTS MINIMUM_SIZE"
+		n.LayoutOptions.NodeSizeMinimum = fmt.Sprintf("(%d, %d)", int(math.Ceil(n.Width)), int(math.Ceil(n.Height)))
+		// ELK orders ports clockwise starting from the top-left corner,
+		// so the bottom and left sides are numbered against the declaration order
+		index := 0
+		for _, side := range []string{"NORTH", "EAST", "SOUTH", "WEST"} {
+			ports := sidePorts[obj][side]
+			for i := range ports {
+				p := ports[i]
+				if side == "SOUTH" || side == "WEST" {
+					p = ports[len(ports)-1-i]
+				}
+				p.LayoutOptions.PortIndex = go2.Pointer(index)
+				index++
+				n.Ports = append(n.Ports, p)
+			}
+		}
+	}
+}
+
+// leafLabelPosition is the configured NodeLabelPosition if it applies to obj,
+// or OverflowLabelPosition if obj's label doesn't fit inside it
+func leafLabelPosition(obj *d2graph.Object, opts *ConfigurableOpts) label.Position {
+	if !obj.HasLabel() || len(obj.ChildrenArray) > 0 {
+		return ""
+	}
+	if obj.HasOutsideBottomLabel() || obj.Icon != nil {
+		return ""
+	}
+	position := label.Position(opts.NodeLabelPosition)
+	if opts.OverflowLabelPosition != "" && !position.IsOutside() && labelOverflows(obj) {
+		position = label.Position(opts.OverflowLabelPosition)
+	}
+	if position == "" {
+		return ""
+	}
+	return readingPosition(position, opts)
+}
+
+// labelOverflows reports whether the label of the leaf obj, padded, is wider or taller than the width or height
+// it was given. Shapes sized to their labels, like text, don't overflow.
+func labelOverflows(obj *d2graph.Object) bool {
+	switch strings.ToLower(obj.Shape.Value) {
+	case d2target.ShapeText, d2target.ShapeCode, d2target.ShapeClass, d2target.ShapeSQLTable, d2target.ShapeImage:
+		return false
+	}
+	if obj.WidthAttr != nil {
+		if width, err := strconv.Atoi(obj.WidthAttr.Value); err == nil && obj.LabelDimensions.Width+2*label.PADDING > width {
+			return true
+		}
+	}
+	if obj.HeightAttr != nil {
+		if height, err := strconv.Atoi(obj.HeightAttr.Value); err == nil && obj.LabelDimensions.Height+2*label.PADDING > height {
+			return true
+		}
+	}
+	return false
+}
+
+// leafIconPositions is where LeafIconSide places the icon and label of the leaf obj, side by side,
+// or "" for both if it doesn't apply to obj
+func leafIconPositions(obj *d2graph.Object, opts *ConfigurableOpts) (icon, lbl label.Position) {
+	if opts.LeafIconSide == "" || obj.Icon == nil || !obj.HasLabel() || len(obj.ChildrenArray) > 0 {
+		return "", ""
+	}
+	if obj.Shape.Value == d2target.ShapeImage || obj.HasOutsideBottomLabel() {
+		return "", ""
+	}
+	if opts.LeafIconSide == "right" {
+		return readingPosition(label.InsideMiddleRight, opts), readingPosition(label.InsideMiddleLeft, opts)
+	}
+	return readingPosition(label.InsideMiddleLeft, opts), readingPosition(label.InsideMiddleRight, opts)
+}
+
+// fitIconBeside grows the leaf obj for its icon at iconPosition and its label on the opposite side to fit within
+// its shape without overlapping, each label.PADDING in from its side with as much again between them.
+// Icons are sized to the nodes they're in, so it's fitted again as the icon grows with the node.
+func fitIconBeside(obj *d2graph.Object, iconPosition label.Position) {
+	shapeType := d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(obj.Shape.Value)]
+	for i := 0; i < 4; i++ {
+		s := shape.NewShape(shapeType, geo.NewBox(geo.NewPoint(0, 0), obj.Width, obj.Height))
+		iconSize := float64(d2target.GetIconSize(s.GetInnerBox(), string(iconPosition)))
+		width := iconSize + float64(obj.LabelDimensions.Width) + 3*label.PADDING
+		height := math.Max(iconSize, float64(obj.LabelDimensions.Height)) + 2*label.PADDING
+		if inner := s.GetInnerBox(); inner.Width >= width && inner.Height >= height {
+			return
+		}
+		fitWidth, fitHeight := s.GetDimensionsToFit(width, height, 0, 0)
+		obj.Width, obj.Height = math.Max(obj.Width, fitWidth), math.Max(obj.Height, fitHeight)
+	}
+}
+
+var leftRightSwapper = strings.NewReplacer("LEFT", "RIGHT", "RIGHT", "LEFT")
+
+// containerLabelPosition is where the label of the container obj goes across its top
+func containerLabelPosition(obj *d2graph.Object, opts *ConfigurableOpts) label.Position {
+	switch opts.ContainerLabelAlignment {
+	case "left":
+		return label.InsideTopLeft
+	case "center":
+		return label.InsideTopCenter
+	case "right":
+		return label.InsideTopRight
+	}
+	if obj.Icon != nil {
+		return readingPosition(label.InsideTopRight, opts)
+	}
+	return label.InsideTopCenter
+}
+
+// containerIconPosition is where the icons of containers go across their tops, clear of their labels
+func containerIconPosition(opts *ConfigurableOpts) label.Position {
+	switch opts.ContainerLabelAlignment {
+	case "left":
+		return label.InsideTopRight
+	case "right":
+		return label.InsideTopLeft
+	}
+	return readingPosition(label.InsideTopLeft, opts)
+}
+
+// readingPosition is position as it's placed in the reading direction of opts,
+// swapping left and right for right-to-left text
+func readingPosition(position label.Position, opts *ConfigurableOpts) label.Position {
+	if !opts.RTL {
+		return position
+	}
+	return label.Position(leftRightSwapper.Replace(string(position)))
+}
+
+var (
+	elkSides = regexp.MustCompile(`^\[(\s*(top|left|bottom|right)\s*=\s*\d+(\.\d+)?\s*(,|\]$))*$`)
+	elkSide  = regexp.MustCompile(`(top|left|bottom|right)\s*=\s*(\d+(\.\d+)?)`)
+)
+
+// isGrid is whether g can be placed in a grid without ELK: it has objects, but no edges or containers
+func isGrid(g *d2graph.Graph) bool {
+	if len(g.Edges) > 0 || len(g.Objects) == 0 {
+		return false
+	}
+	for _, obj := range g.Objects {
+		if len(obj.ChildrenArray) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// placeGrid places the nodes of elkGraph in rows of opts.Columns, in order, within the root padding.
+// Each column is as wide as its widest node and each row as tall as its tallest, with nodes centered in their cells.
+func placeGrid(elkGraph *ELKGraph, opts *ConfigurableOpts) {
+	top, left, _, _, _ := parseSides(rootPadding(opts))
+	placeCells(elkGraph.Children, opts.Columns, gridGutter(opts), top, left)
+}
+
+// gridGutter is the space between the rows and columns of grids: ColumnGutter, else NodeSpacing
+func gridGutter(opts *ConfigurableOpts) float64 {
+	if opts.ColumnGutter != 0 {
+		return float64(opts.ColumnGutter)
+	}
+	return float64(opts.NodeSpacing)
+}
+
+// placeRough places the nodes of elkGraph in square grids, in order, for when there's no time for ELK.
+// Containers are grown to fit their children's grids within their padding. Edges are left unrouted.
+func placeRough(elkGraph *ELKGraph, opts *ConfigurableOpts) {
+	gutter := float64(opts.NodeSpacing)
+	var place func([]*ELKNode, string) (float64, float64)
+	place = func(nodes []*ELKNode, padding string) (float64, float64) {
+		for _, n := range nodes {
+			if len(n.Children) > 0 {
+				_, _, bottom, right, _ := parseSides(n.LayoutOptions.Padding)
+				w, h := place(n.Children, n.LayoutOptions.Padding)
+				n.Width, n.Height = math.Max(n.Width, w+right), math.Max(n.Height, h+bottom)
+			}
+		}
+		top, left, _, _, _ := parseSides(padding)
+		return placeCells(nodes, int(math.Ceil(math.Sqrt(float64(len(nodes))))), gutter, top, left)
+	}
+	place(elkGraph.Children, rootPadding(opts))
+}
+
+// rootPadding is the padding that grids and rough layouts keep within at the root: RootPadding, else Padding
+func rootPadding(opts *ConfigurableOpts) string {
+	if opts.RootPadding != "" {
+		return opts.RootPadding
+	}
+	return opts.Padding
+}
+
+// placeCells places nodes in rows of columns, from top and left, with gutter between the rows and columns.
+// It returns how far right and down they reach.
+func placeCells(nodes []*ELKNode, columns int, gutter, top, left float64) (right, bottom float64) {
+	columns = go2.Min(columns, len(nodes))
+	colWidths := make([]float64, columns)
+	var rowHeights []float64
+	for i, n := range nodes {
+		if i%columns == 0 {
+			rowHeights = append(rowHeights, 0)
+		}
+		colWidths[i%columns] = math.Max(colWidths[i%columns], n.Width)
+		rowHeights[i/columns] = math.Max(rowHeights[i/columns], n.Height)
+	}
+
+	colX := make([]float64, columns)
+	x := left
+	for i, w := range colWidths {
+		colX[i] = x
+		x += w + gutter
+	}
+	y := top
+	for i, n := range nodes {
+		if i > 0 && i%columns == 0 {
+			y += rowHeights[i/columns-1] + gutter
+		}
+		n.X = colX[i%columns] + (colWidths[i%columns]-n.Width)/2
+		n.Y = y + (rowHeights[i/columns]-n.Height)/2
+	}
+	if columns == 0 {
+		return left, top
+	}
+	return x - gutter, y + rowHeights[len(rowHeights)-1]
+}
+
+// paddingScale is the factor PaddingScale compounds to at the container obj's level
+func paddingScale(obj *d2graph.Object, opts *ConfigurableOpts) float64 {
+	if opts.PaddingScale == 0 {
+		return 1
+	}
+	return math.Pow(opts.PaddingScale, float64(obj.Level()-1))
+}
+
+// parseSides parses sides in ELK's format for padding and margins, e.g. [top=50,left=50,bottom=50,right=50].
+// Sides left out are 0, and so is everything for an empty s.
+func parseSides(s string) (top, left, bottom, right float64, ok bool) {
+	if s == "" {
+		return 0, 0, 0, 0, true
+	}
+	if !elkSides.MatchString(s) {
+		return 0, 0, 0, 0, false
+	}
+	for _, match := range elkSide.FindAllStringSubmatch(s, -1) {
+		v, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return 0, 0, 0, 0, false
+		}
+		switch match[1] {
+		case "top":
+			top = v
+		case "left":
+			left = v
+		case "bottom":
+			bottom = v
+		case "right":
+			right = v
+		}
+	}
+	return top, left, bottom, right, true
+}
+
+// flattenSingleChildContainers replaces each container with a single child by that child, deepest first,
+// and moves the container's edges onto the child. Containers with edges to their child are kept, since
+// those would become self-loops, as are those whose child's ID is taken among the container's siblings.
+func flattenSingleChildContainers(g *d2graph.Graph) {
+	var flatten func(*d2graph.Object)
+	flatten = func(obj *d2graph.Object) {
+		for _, child := range obj.ChildrenArray {
+			flatten(child)
+		}
+		if obj == g.Root || len(obj.ChildrenArray) != 1 {
+			return
+		}
+		child, parent := obj.ChildrenArray[0], obj.Parent
+		if sibling, ok := parent.Children[strings.ToLower(child.ID)]; ok && sibling != obj {
+			return
+		}
+		for _, e := range g.Edges {
+			if (e.Src == obj && e.Dst == child) || (e.Src == child && e.Dst == obj) {
+				return
+			}
+		}
+
+		delete(parent.Children, strings.ToLower(obj.ID))
+		parent.Children[strings.ToLower(child.ID)] = child
+		for i, c := range parent.ChildrenArray {
+			if c == obj {
+				parent.ChildrenArray[i] = child
+				break
+			}
+		}
+		child.Parent = parent
+		for i, o := range g.Objects {
+			if o == obj {
+				g.Objects = append(g.Objects[:i], g.Objects[i+1:]...)
+				break
+			}
+		}
+		for _, e := range g.Edges {
+			if e.Src == obj {
+				e.Src = child
+			}
+			if e.Dst == obj {
+				e.Dst = child
+			}
+		}
+	}
+	flatten(g.Root)
+}
+
+// mergeBidirectional merges each one-way edge of g without a label into the first earlier one going the opposite way
+// between the same objects with the same attributes, which gets the arrowhead the merged edge has at its destination
+// at its source. It keeps its index unless an edge already both ways between them has it, in which case it's
+// renumbered past theirs, to keep IDs unique.
+func mergeBidirectional(g *d2graph.Graph) {
+	oneWay := func(e *d2graph.Edge) bool {
+		return e.Src != e.Dst && e.Label.Value == "" && e.DstArrow && !e.SrcArrow && e.SrcArrowhead == nil
+	}
+	var kept, both []*d2graph.Edge
+	for _, e := range g.Edges {
+		merged := false
+		if oneWay(e) {
+			for _, k := range kept {
+				if oneWay(k) && k.Src == e.Dst && k.Dst == e.Src && sameAttributes(k, e) {
+					k.SrcArrow = true
+					k.SrcArrowhead = e.DstArrowhead
+					both = append(both, k)
+					merged = true
+					break
+				}
+			}
+		}
+		if !merged {
+			kept = append(kept, e)
+		}
+	}
+	ids := make(map[string]bool)
+	for _, e := range kept {
+		if !go2.Contains(both, e) {
+			ids[e.AbsID()] = true
+		}
+	}
+	for _, e := range both {
+		for ; ids[e.AbsID()]; e.Index++ {
+		}
+		ids[e.AbsID()] = true
+	}
+	g.Edges = kept
+}
+
+// sameAttributes reports whether the edges a and b are styled alike, with the same classes, tooltip, link and so on,
+// so that merging them loses nothing but b's arrowhead at its source
+func sameAttributes(a, b *d2graph.Edge) bool {
+	if a.ZIndex != b.ZIndex {
+		return false
+	}
+	attrsA, errA := json.Marshal(a.Attributes)
+	attrsB, errB := json.Marshal(b.Attributes)
+	return errA == nil && errB == nil && bytes.Equal(attrsA, attrsB)
+}
+
+// keepDeclaredSizes shrinks containers to their declared size around their center.
+// ELK centers their children, so they stay centered, and edges attached to them are clipped to the new border.
+func keepDeclaredSizes(g *d2graph.Graph) {
+	for _, obj := range g.Objects {
+		if len(obj.ChildrenArray) == 0 {
+			continue
+		}
+		width, height := obj.Width, obj.Height
+		if obj.WidthAttr != nil {
+			if declared, err := strconv.Atoi(obj.WidthAttr.Value); err == nil {
+				width = math.Min(width, float64(declared))
+			}
+		}
+		if obj.HeightAttr != nil {
+			if declared, err := strconv.Atoi(obj.HeightAttr.Value); err == nil {
+				height = math.Min(height, float64(declared))
+			}
+		}
+		if width == obj.Width && height == obj.Height {
+			continue
+		}
+
+		obj.TopLeft = geo.NewPoint(obj.TopLeft.X+(obj.Width-width)/2, obj.TopLeft.Y+(obj.Height-height)/2)
+		obj.Width, obj.Height = width, height
+		for _, e := range g.Edges {
+			if len(e.Route) < 2 {
+				continue
+			}
+			if e.Src == obj {
+				e.Route[0] = clipToBox(obj.Box, e.Route[0], e.Route[1])
+			}
+			if e.Dst == obj {
+				e.Route[len(e.Route)-1] = clipToBox(obj.Box, e.Route[len(e.Route)-1], e.Route[len(e.Route)-2])
+			}
+		}
+	}
+}
+
+// clipToBox moves end, the end of a route's leg from prev, along the leg onto the nearest point of box's border
+func clipToBox(box *geo.Box, end, prev *geo.Point) *geo.Point {
+	v := prev.VectorTo(end)
+	if v.Length() == 0 {
+		return end
+	}
+	extent := v.Unit().Multiply(box.Width + box.Height)
+	leg := *geo.NewSegment(end.AddVector(extent.Reverse()), end.AddVector(extent))
+
+	closest, closestD := end, math.Inf(1)
+	for _, p := range box.Intersections(leg) {
+		if d := geo.EuclideanDistance(end.X, end.Y, p.X, p.Y); d < closestD {
+			closest, closestD = p, d
+		}
+	}
+	return closest
+}
+
+// fitLabel grows a leaf sized smaller than the label inside it, like an object given its size
+// before its label was measured. Declared widths and heights are kept.
+func fitLabel(obj *d2graph.Object, position label.Position) {
+	if !obj.HasLabel() || len(obj.ChildrenArray) > 0 || obj.Icon != nil || obj.HasOutsideBottomLabel() || position.IsOutside() {
+		return
+	}
+	dslShape := strings.ToLower(obj.Shape.Value)
+	switch dslShape {
+	case d2target.ShapeText, d2target.ShapeCode, d2target.ShapeClass, d2target.ShapeSQLTable, d2target.ShapeImage:
+		// The label is the content these are sized to
+		return
+	}
+
+	width, height := obj.Width, obj.Height
+	if obj.WidthAttr == nil {
+		width = math.Max(width, float64(obj.LabelDimensions.Width+2*label.PADDING))
+	}
+	if obj.HeightAttr == nil {
+		height = math.Max(height, float64(obj.LabelDimensions.Height+2*label.PADDING))
+	}
+	if width == obj.Width && height == obj.Height {
+		return
+	}
+	obj.Width, obj.Height = width, height
+	if dslShape == d2target.ShapeCircle || dslShape == d2target.ShapeSquare {
+		sideLength := math.Max(obj.Width, obj.Height)
+		obj.Width = sideLength
+		obj.Height = sideLength
+	}
+}
+
+// outsideLabelMargins is the space an outside label at position takes up on each side of obj
+func outsideLabelMargins(obj *d2graph.Object, position label.Position) (top, left, bottom, right float64) {
+	labelWidth := float64(obj.LabelDimensions.Width) + label.PADDING
+	labelHeight := float64(obj.LabelDimensions.Height) + label.PADDING
+	switch position {
+	case label.OutsideTopLeft, label.OutsideTopCenter, label.OutsideTopRight:
+		top = labelHeight
+	case label.OutsideBottomLeft, label.OutsideBottomCenter, label.OutsideBottomRight:
+		bottom = labelHeight
+	case label.OutsideLeftTop, label.OutsideLeftMiddle, label.OutsideLeftBottom:
+		left = labelWidth
+	case label.OutsideRightTop, label.OutsideRightMiddle, label.OutsideRightBottom:
+		right = labelWidth
+	}
+	return top, left, bottom, right
+}
+
+// shiftBottomLabels moves the labels below objects that routes run through to where along the bottom they don't,
+// trying the side text starts from first
+func shiftBottomLabels(g *d2graph.Graph, opts *ConfigurableOpts) {
+	for _, obj := range g.Objects {
+		if !obj.HasLabel() || obj.LabelPosition == nil {
+			continue
+		}
+		position := label.Position(*obj.LabelPosition)
+		switch position {
+		case label.OutsideBottomLeft, label.OutsideBottomCenter, label.OutsideBottomRight:
+		default:
+			continue
+		}
+		if !labelCrossed(g, obj, position) {
+			continue
+		}
+		for _, p := range []label.Position{
+			readingPosition(label.OutsideBottomLeft, opts),
+			readingPosition(label.OutsideBottomRight, opts),
+			label.OutsideBottomCenter,
+		} {
+			if p != position && !labelCrossed(g, obj, p) {
+				obj.LabelPosition = go2.Pointer(string(p))
+				break
+			}
+		}
+	}
+}
+
+// labelCrossed is whether a route runs through obj's label at position
+func labelCrossed(g *d2graph.Graph, obj *d2graph.Object, position label.Position) bool {
+	width, height := float64(obj.LabelDimensions.Width), float64(obj.LabelDimensions.Height)
+	box := geo.NewBox(position.GetPointOnBox(obj.Box, label.PADDING, width, height), width, height)
+	for _, e := range g.Edges {
+		for i := 0; i < len(e.Route)-1; i++ {
+			if box.Intersects(*geo.NewSegment(e.Route[i], e.Route[i+1]), 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walk visits every object below obj depth-first, parents before children
+func walk(obj, parent *d2graph.Object, fn func(*d2graph.Object, *d2graph.Object)) {
+	if obj.Parent != nil {
+		fn(obj, parent)
+	}
+	for _, ch := range obj.ChildrenArray {
+		walk(ch, obj, fn)
+	}
+}
+
+// routeEpsilon is how far apart two route coordinates can be and still be treated as the same
+const routeEpsilon = 1.
+
+func sameCoordinate(a, b float64) bool {
+	return geo.PrecisionCompare(a, b, routeEpsilon) == 0
+}
+
+// mergeNearPoints drops route points that are within routeEpsilon of the previous point.
+// ELK occasionally emits these, leaving degenerate segments that hide bends from deleteBends.
+// Bends that the merge straightens out are dropped as well.
+func mergeNearPoints(g *d2graph.Graph) {
+	near := func(p1, p2 *geo.Point) bool {
+		return sameCoordinate(p1.X, p2.X) && sameCoordinate(p1.Y, p2.Y)
+	}
+	collinear := func(p1, p2, p3 *geo.Point) bool {
+		return (sameCoordinate(p1.X, p2.X) && sameCoordinate(p2.X, p3.X)) ||
+			(sameCoordinate(p1.Y, p2.Y) && sameCoordinate(p2.Y, p3.Y))
+	}
+	for _, e := range g.Edges {
+		if len(e.Route) < 3 {
+			continue
+		}
+		route := []*geo.Point{e.Route[0]}
+		merged := false
+		for _, p := range e.Route[1 : len(e.Route)-1] {
+			if near(p, route[len(route)-1]) {
+				merged = true
+			} else {
+				route = append(route, p)
+			}
+		}
+		// The endpoint was traced to the shape border, so it's the one kept
+		end := e.Route[len(e.Route)-1]
+		if len(route) > 1 && near(end, route[len(route)-1]) {
+			route = route[:len(route)-1]
+			merged = true
+		}
+		route = append(route, end)
+		if !merged {
+			continue
+		}
+
+		straightened := []*geo.Point{route[0]}
+		for i := 1; i < len(route)-1; i++ {
+			if !collinear(straightened[len(straightened)-1], route[i], route[i+1]) {
+				straightened = append(straightened, route[i])
+			}
+		}
+		e.Route = append(straightened, end)
+	}
+}
+
+const (
+	attachMarginFraction = 0.25
+	minAttachMargin      = 2.
+	maxAttachMargin      = 10.
+)
+
+// attachMargin is how far from the corners of a node side of the given length an edge must attach
+func attachMargin(length float64) float64 {
+	return math.Max(minAttachMargin, math.Min(maxAttachMargin, length*attachMarginFraction))
+}
+
+// deleteBends is a shim for ELK to delete unnecessary bends
+// see https://github.com/terrastruct/d2/issues/1030
+func deleteBends(g *d2graph.Graph, idx *collisionIndex) {
+	// Get rid of S-shapes at the source and the target
+	// TODO there might be value in repeating this. removal of an S shape introducing another S shape that can still be removed
+	for _, isSource := range []bool{true, false} {
+		for ei, e := range g.Edges {
+			if len(e.Route) < 4 {
+				continue
+			}
+			if e.Src == e.Dst {
+				continue
+			}
+			var endpoint *d2graph.Object
+			var start *geo.Point
+			var corner *geo.Point
+			var end *geo.Point
+
+			if isSource {
+				start = e.Route[0]
+				corner = e.Route[1]
+				end = e.Route[2]
+				endpoint = e.Src
 			} else {
 				start = e.Route[len(e.Route)-1]
 				corner = e.Route[len(e.Route)-2]
@@ -502,176 +3458,918 @@ func deleteBends(g *d2graph.Graph) {
 				endpoint = e.Dst
 			}
 
-			isHorizontal := math.Ceil(start.Y) == math.Ceil(corner.Y)
+			isHorizontal := sameCoordinate(start.Y, corner.Y)
+
+			// Make sure it's still attached
+			if isHorizontal {
+				margin := attachMargin(endpoint.Height)
+				if end.Y <= endpoint.TopLeft.Y+margin {
+					continue
+				}
+				if end.Y >= endpoint.TopLeft.Y+endpoint.Height-margin {
+					continue
+				}
+			} else {
+				margin := attachMargin(endpoint.Width)
+				if end.X <= endpoint.TopLeft.X+margin {
+					continue
+				}
+				if end.X >= endpoint.TopLeft.X+endpoint.Width-margin {
+					continue
+				}
+			}
+
+			var newStart *geo.Point
+			if isHorizontal {
+				newStart = geo.NewPoint(start.X, end.Y)
+			} else {
+				newStart = geo.NewPoint(end.X, start.Y)
+			}
+
+			endpointShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(endpoint.Shape.Value)], endpoint.Box)
+			newStart = shape.TraceToShapeBorder(endpointShape, newStart, end)
+
+			// Check that the new segment doesn't collide with anything new
+
+			oldSegment := geo.NewSegment(start, corner)
+			newSegment := geo.NewSegment(newStart, end)
+
+			oldIntersects := idx.countObjectIntersects(e.Src, e.Dst, *oldSegment)
+			newIntersects := idx.countObjectIntersects(e.Src, e.Dst, *newSegment)
+
+			if newIntersects > oldIntersects {
+				continue
+			}
+
+			oldCrossingsCount, oldOverlapsCount, oldCloseOverlapsCount, oldTouchingCount := idx.countEdgeIntersects(g.Edges[ei], *oldSegment)
+			newCrossingsCount, newOverlapsCount, newCloseOverlapsCount, newTouchingCount := idx.countEdgeIntersects(g.Edges[ei], *newSegment)
+
+			if newCrossingsCount > oldCrossingsCount {
+				continue
+			}
+			if newOverlapsCount > oldOverlapsCount {
+				continue
+			}
+
+			if newCloseOverlapsCount > oldCloseOverlapsCount {
+				continue
+			}
+			if newTouchingCount > oldTouchingCount {
+				continue
+			}
+
+			// commit
+			if isSource {
+				g.Edges[ei].Route = append(
+					[]*geo.Point{newStart},
+					e.Route[3:]...,
+				)
+			} else {
+				g.Edges[ei].Route = append(
+					e.Route[:len(e.Route)-3],
+					newStart,
+				)
+			}
+			idx.updateEdge(ei)
+		}
+	}
+	// Get rid of ladders
+	// ELK likes to do these for some reason
+	// .   ┌─
+	// . ┌─┘
+	// . │
+	// We want to transform these into L-shapes
+	for ei, e := range g.Edges {
+		if len(e.Route) < 6 {
+			continue
+		}
+		if e.Src == e.Dst {
+			continue
+		}
+
+		for i := 1; i < len(e.Route)-3; i++ {
+			if removeLadder(g, idx, ei, i, 0) {
+				break
+			}
+		}
+	}
+	// Get rid of zig-zags, runs that step off the line they're on and then back onto it
+	// . ──┐ ┌──
+	// .   └─┘
+	// We want to run these straight through
+	for ei, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		for removed := true; removed; {
+			removed = false
+			for i := 1; i < len(g.Edges[ei].Route)-4; i++ {
+				if removeZigZag(g, idx, ei, i) {
+					removed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// removeLadder replaces the two bends of the ladder step at e.Route[i:i+3] with a single corner,
+// as long as doing so doesn't introduce new collisions.
+// closeOverlapSlack is how many more close overlaps with other edges the new segments may have than the old ones.
+func removeLadder(g *d2graph.Graph, idx *collisionIndex, ei, i, closeOverlapSlack int) bool {
+	e := g.Edges[ei]
+	before := e.Route[i-1]
+	start := e.Route[i]
+	corner := e.Route[i+1]
+	end := e.Route[i+2]
+	after := e.Route[i+3]
+
+	// S-shape on sources only concerned one segment, since the other was just along the bound of endpoint
+	// These concern two segments
+
+	var newCorner *geo.Point
+	if sameCoordinate(start.X, corner.X) {
+		newCorner = geo.NewPoint(end.X, start.Y)
+		// not ladder
+		if (end.X > start.X) != (start.X > before.X) {
+			return false
+		}
+		if (end.Y > start.Y) != (after.Y > end.Y) {
+			return false
+		}
+	} else {
+		newCorner = geo.NewPoint(start.X, end.Y)
+		if (end.Y > start.Y) != (start.Y > before.Y) {
+			return false
+		}
+		if (end.X > start.X) != (after.X > end.X) {
+			return false
+		}
+	}
+
+	oldS1 := geo.NewSegment(start, corner)
+	oldS2 := geo.NewSegment(corner, end)
+
+	newS1 := geo.NewSegment(start, newCorner)
+	newS2 := geo.NewSegment(newCorner, end)
+
+	// Check that the new segments doesn't collide with anything new
+	oldIntersects := idx.countObjectIntersects(e.Src, e.Dst, *oldS1) + idx.countObjectIntersects(e.Src, e.Dst, *oldS2)
+	newIntersects := idx.countObjectIntersects(e.Src, e.Dst, *newS1) + idx.countObjectIntersects(e.Src, e.Dst, *newS2)
+
+	if newIntersects > oldIntersects {
+		return false
+	}
+
+	oldCrossingsCount1, oldOverlapsCount1, oldCloseOverlapsCount1, oldTouchingCount1 := idx.countEdgeIntersects(g.Edges[ei], *oldS1)
+	oldCrossingsCount2, oldOverlapsCount2, oldCloseOverlapsCount2, oldTouchingCount2 := idx.countEdgeIntersects(g.Edges[ei], *oldS2)
+	oldCrossingsCount := oldCrossingsCount1 + oldCrossingsCount2
+	oldOverlapsCount := oldOverlapsCount1 + oldOverlapsCount2
+	oldCloseOverlapsCount := oldCloseOverlapsCount1 + oldCloseOverlapsCount2
+	oldTouchingCount := oldTouchingCount1 + oldTouchingCount2
+
+	newCrossingsCount1, newOverlapsCount1, newCloseOverlapsCount1, newTouchingCount1 := idx.countEdgeIntersects(g.Edges[ei], *newS1)
+	newCrossingsCount2, newOverlapsCount2, newCloseOverlapsCount2, newTouchingCount2 := idx.countEdgeIntersects(g.Edges[ei], *newS2)
+	newCrossingsCount := newCrossingsCount1 + newCrossingsCount2
+	newOverlapsCount := newOverlapsCount1 + newOverlapsCount2
+	newCloseOverlapsCount := newCloseOverlapsCount1 + newCloseOverlapsCount2
+	newTouchingCount := newTouchingCount1 + newTouchingCount2
+
+	if newCrossingsCount > oldCrossingsCount {
+		return false
+	}
+	if newOverlapsCount > oldOverlapsCount {
+		return false
+	}
+
+	if newCloseOverlapsCount > oldCloseOverlapsCount+closeOverlapSlack {
+		return false
+	}
+	if newTouchingCount > oldTouchingCount {
+		return false
+	}
+
+	// commit
+	g.Edges[ei].Route = append(append(
+		e.Route[:i],
+		newCorner,
+	),
+		e.Route[i+3:]...,
+	)
+	idx.updateEdge(ei)
+	return true
+}
+
+// removeZigZag replaces the zig-zag at e.Route[i:i+4], off the line of the runs either side, across and back onto it,
+// with a straight run along the line, as long as doing so doesn't introduce new collisions.
+func removeZigZag(g *d2graph.Graph, idx *collisionIndex, ei, i int) bool {
+	e := g.Edges[ei]
+	before := e.Route[i-1]
+	start := e.Route[i]
+	out := e.Route[i+1]
+	back := e.Route[i+2]
+	end := e.Route[i+3]
+	after := e.Route[i+4]
+
+	// The runs either side must be on one line, carried on in the same direction across the zig-zag,
+	// else it's a U-turn
+	if sameCoordinate(start.X, out.X) {
+		if !sameCoordinate(before.Y, start.Y) || !sameCoordinate(start.Y, end.Y) || !sameCoordinate(end.Y, after.Y) {
+			return false
+		}
+		if (start.X > before.X) != (end.X > start.X) || (after.X > end.X) != (end.X > start.X) {
+			return false
+		}
+	} else {
+		if !sameCoordinate(before.X, start.X) || !sameCoordinate(start.X, end.X) || !sameCoordinate(end.X, after.X) {
+			return false
+		}
+		if (start.Y > before.Y) != (end.Y > start.Y) || (after.Y > end.Y) != (end.Y > start.Y) {
+			return false
+		}
+	}
+
+	oldSegments := []*geo.Segment{geo.NewSegment(start, out), geo.NewSegment(out, back), geo.NewSegment(back, end)}
+	newSegment := geo.NewSegment(start, end)
+
+	// Check that the new segment doesn't collide with anything new
+	oldIntersects := 0
+	var oldCrossingsCount, oldOverlapsCount, oldCloseOverlapsCount, oldTouchingCount int
+	for _, s := range oldSegments {
+		oldIntersects += idx.countObjectIntersects(e.Src, e.Dst, *s)
+		crossings, overlaps, closeOverlaps, touching := idx.countEdgeIntersects(e, *s)
+		oldCrossingsCount += crossings
+		oldOverlapsCount += overlaps
+		oldCloseOverlapsCount += closeOverlaps
+		oldTouchingCount += touching
+	}
+	if idx.countObjectIntersects(e.Src, e.Dst, *newSegment) > oldIntersects {
+		return false
+	}
+	newCrossingsCount, newOverlapsCount, newCloseOverlapsCount, newTouchingCount := idx.countEdgeIntersects(e, *newSegment)
+	if newCrossingsCount > oldCrossingsCount {
+		return false
+	}
+	if newOverlapsCount > oldOverlapsCount {
+		return false
+	}
+	if newCloseOverlapsCount > oldCloseOverlapsCount {
+		return false
+	}
+	if newTouchingCount > oldTouchingCount {
+		return false
+	}
+
+	// commit, the runs either side joining into one
+	g.Edges[ei].Route = append(e.Route[:i], e.Route[i+4:]...)
+	idx.updateEdge(ei)
+	return true
+}
+
+// maxBendsCloseOverlapSlack is how many extra close overlaps capBends tolerates per straightening
+const maxBendsCloseOverlapSlack = 1
+
+// capBends keeps removing ladder steps from edges with more than maxBends bends,
+// first under the same rules as deleteBends and then tolerating a few more close overlaps.
+// Edges that still can't be straightened enough are left as the best effort.
+func capBends(g *d2graph.Graph, idx *collisionIndex, maxBends int) {
+	for ei, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		for slack := 0; slack <= maxBendsCloseOverlapSlack; slack++ {
+			for len(g.Edges[ei].Route)-2 > maxBends {
+				removed := false
+				for i := 1; i < len(g.Edges[ei].Route)-3; i++ {
+					if removeLadder(g, idx, ei, i, slack) {
+						removed = true
+						break
+					}
+				}
+				if !removed {
+					break
+				}
+			}
+		}
+	}
+}
+
+// removeJogs removes segments shorter than minLength between two bends, shifting the run after the jog,
+// or else the one before it, in line with the other. Runs ending at a node slide along its border, so they
+// must stay attached to it. Jogs are kept if removing them would cut through more objects or cross more edges.
+func removeJogs(g *d2graph.Graph, bands []labelBand, minLength float64) {
+	for _, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		for i := 1; i < len(e.Route)-2; i++ {
+			if route, ok := removeJog(g, bands, e, i, minLength); ok {
+				e.Route = route
+				// The segments around the jog are now one, which may be next to another jog
+				i = 0
+			}
+		}
+	}
+}
+
+// removeJog returns the route of e without the jog from e.Route[i] to e.Route[i+1], if it's one that can go
+func removeJog(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge, i int, minLength float64) ([]*geo.Point, bool) {
+	start, end := e.Route[i], e.Route[i+1]
+	jog := start.VectorTo(end)
+	length := jog.Length()
+	if length == 0 || length >= minLength {
+		return nil, false
+	}
+	horizontal := sameCoordinate(start.Y, end.Y)
+	if !horizontal && !sameCoordinate(start.X, end.X) {
+		return nil, false
+	}
+	// Both neighboring segments must run across the jog, so that it's a step in the route rather than a turn
+	for _, s := range [][2]*geo.Point{{e.Route[i-1], start}, {end, e.Route[i+2]}} {
+		if horizontal == sameCoordinate(s[0].Y, s[1].Y) {
+			return nil, false
+		}
+	}
 
-			// Make sure it's still attached
-			if isHorizontal {
-				if end.Y <= endpoint.TopLeft.Y+10 {
-					continue
-				}
-				if end.Y >= endpoint.TopLeft.Y+endpoint.Height-10 {
+	for _, after := range []bool{true, false} {
+		route := append([]*geo.Point{}, e.Route...)
+		// The run shifted is from the jog up to the next bend, which may be an endpoint
+		run, shift := []int{i + 1, i + 2}, jog.Multiply(-1)
+		endpoint := e.Dst
+		if !after {
+			run, shift = []int{i, i - 1}, jog
+			endpoint = e.Src
+		}
+		for _, j := range run {
+			route[j] = route[j].AddVector(shift)
+		}
+		if terminal := run[1]; terminal == 0 || terminal == len(route)-1 {
+			p := route[terminal]
+			if horizontal {
+				margin := attachMargin(endpoint.Width)
+				if p.X <= endpoint.TopLeft.X+margin || p.X >= endpoint.TopLeft.X+endpoint.Width-margin {
 					continue
 				}
 			} else {
-				if end.X <= endpoint.TopLeft.X+10 {
-					continue
-				}
-				if end.X >= endpoint.TopLeft.X+endpoint.Width-10 {
+				margin := attachMargin(endpoint.Height)
+				if p.Y <= endpoint.TopLeft.Y+margin || p.Y >= endpoint.TopLeft.Y+endpoint.Height-margin {
 					continue
 				}
 			}
+			endpointShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(endpoint.Shape.Value)], endpoint.Box)
+			route[terminal] = shape.TraceToShapeBorder(endpointShape, p, route[run[0]])
+		}
+		// The jog's ends now meet where the runs either side of it are in line, so neither is a bend
+		route = append(route[:i], route[i+2:]...)
 
-			var newStart *geo.Point
-			if isHorizontal {
-				newStart = geo.NewPoint(start.X, end.Y)
-			} else {
-				newStart = geo.NewPoint(end.X, start.Y)
-			}
+		if countCollisions(g, bands, e, route) > countCollisions(g, bands, e, e.Route) {
+			continue
+		}
+		oldCrossings, oldOverlaps := countRouteEdgeIntersects(g, e, e.Route)
+		newCrossings, newOverlaps := countRouteEdgeIntersects(g, e, route)
+		if newCrossings > oldCrossings || newOverlaps > oldOverlaps {
+			continue
+		}
+		return route, true
+	}
+	return nil, false
+}
 
-			endpointShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(endpoint.Shape.Value)], endpoint.Box)
-			newStart = shape.TraceToShapeBorder(endpointShape, newStart, end)
+// countRouteEdgeIntersects sums countEdgeIntersects' crossings and overlaps over the segments of route
+func countRouteEdgeIntersects(g *d2graph.Graph, e *d2graph.Edge, route []*geo.Point) (crossings, overlaps int) {
+	for i := 0; i < len(route)-1; i++ {
+		c, o, _, _ := countEdgeIntersects(g, e, *geo.NewSegment(route[i], route[i+1]))
+		crossings += c
+		overlaps += o
+	}
+	return crossings, overlaps
+}
 
-			// Check that the new segment doesn't collide with anything new
+// trackSegment is an interior segment of an edge route, from Route[i] to Route[i+1]
+type trackSegment struct {
+	edge       *d2graph.Edge
+	i          int
+	horizontal bool
+	coord      float64
+}
 
-			oldSegment := geo.NewSegment(start, corner)
-			newSegment := geo.NewSegment(newStart, end)
+func (ts trackSegment) segment() geo.Segment {
+	return *geo.NewSegment(ts.edge.Route[ts.i], ts.edge.Route[ts.i+1])
+}
+
+// snapTracks groups parallel interior segments whose coordinates chain within tolerance of each other.
+// A group whose segments never run side by side is moved onto the one track at their mean;
+// otherwise its segments are spread evenly across the group's extent, keeping their order so they don't overlap.
+// First and last segments are left alone to keep edges attached, and groups that would
+// run into more objects are left as they were.
+func snapTracks(g *d2graph.Graph, tolerance float64) {
+	if tolerance <= 0 {
+		return
+	}
+	var segments []trackSegment
+	for _, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		for i := 1; i < len(e.Route)-2; i++ {
+			start, end := e.Route[i], e.Route[i+1]
+			if sameCoordinate(start.Y, end.Y) && !sameCoordinate(start.X, end.X) {
+				segments = append(segments, trackSegment{e, i, true, start.Y})
+			} else if sameCoordinate(start.X, end.X) && !sameCoordinate(start.Y, end.Y) {
+				segments = append(segments, trackSegment{e, i, false, start.X})
+			}
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		if segments[i].horizontal != segments[j].horizontal {
+			return segments[i].horizontal
+		}
+		return segments[i].coord < segments[j].coord
+	})
 
-			oldIntersects := countObjectIntersects(g, e.Src, e.Dst, *oldSegment)
-			newIntersects := countObjectIntersects(g, e.Src, e.Dst, *newSegment)
+	for start := 0; start < len(segments); {
+		end := start + 1
+		for end < len(segments) && segments[end].horizontal == segments[start].horizontal &&
+			segments[end].coord-segments[end-1].coord <= tolerance {
+			end++
+		}
+		if end-start > 1 {
+			snapGroup(g, segments[start:end])
+		}
+		start = end
+	}
+}
 
-			if newIntersects > oldIntersects {
-				continue
+func snapGroup(g *d2graph.Graph, group []trackSegment) {
+	horizontal := group[0].horizontal
+	sideBySide := false
+	edges := make(map[*d2graph.Edge]struct{})
+	for i := range group {
+		if _, ok := edges[group[i].edge]; ok {
+			// Snapping an edge onto itself only collapses a jog, which bend deletion already considered
+			return
+		}
+		edges[group[i].edge] = struct{}{}
+		for j := i + 1; j < len(group); j++ {
+			if group[i].segment().Overlaps(group[j].segment(), !horizontal, 0.) {
+				sideBySide = true
 			}
+		}
+	}
 
-			oldCrossingsCount, oldOverlapsCount, oldCloseOverlapsCount, oldTouchingCount := countEdgeIntersects(g, g.Edges[ei], *oldSegment)
-			newCrossingsCount, newOverlapsCount, newCloseOverlapsCount, newTouchingCount := countEdgeIntersects(g, g.Edges[ei], *newSegment)
+	low, high := group[0].coord, group[len(group)-1].coord
+	mean := 0.
+	for _, ts := range group {
+		mean += ts.coord
+	}
+	mean /= float64(len(group))
 
-			if newCrossingsCount > oldCrossingsCount {
-				continue
+	before := 0
+	for _, ts := range group {
+		before += countTrackObjectIntersects(g, ts)
+	}
+
+	moved := make([][2]geo.Point, len(group))
+	for i, ts := range group {
+		moved[i] = [2]geo.Point{*ts.edge.Route[ts.i], *ts.edge.Route[ts.i+1]}
+		coord := mean
+		if sideBySide {
+			coord = low + (high-low)*float64(i)/float64(len(group)-1)
+		}
+		if horizontal {
+			ts.edge.Route[ts.i].Y = coord
+			ts.edge.Route[ts.i+1].Y = coord
+		} else {
+			ts.edge.Route[ts.i].X = coord
+			ts.edge.Route[ts.i+1].X = coord
+		}
+	}
+
+	after := 0
+	for _, ts := range group {
+		after += countTrackObjectIntersects(g, ts)
+	}
+	if after > before {
+		for i, ts := range group {
+			*ts.edge.Route[ts.i] = moved[i][0]
+			*ts.edge.Route[ts.i+1] = moved[i][1]
+		}
+	}
+}
+
+// countTrackObjectIntersects counts the objects run into by ts and the segments on either side of it,
+// which stretch as it moves
+func countTrackObjectIntersects(g *d2graph.Graph, ts trackSegment) int {
+	count := 0
+	for i := ts.i - 1; i <= ts.i+1; i++ {
+		s := *geo.NewSegment(ts.edge.Route[i], ts.edge.Route[i+1])
+		count += countObjectIntersects(g, ts.edge.Src, ts.edge.Dst, s)
+	}
+	return count
+}
+
+// detourMargin is how far detours keep from the objects they go around
+var detourMargin = float64(edge_node_spacing) / 2
+
+// repairCollisions detours routes around the objects they cut through, and the bands they must stay out of.
+// Each detour goes around the side that's shorter, unless the other cuts through fewer objects,
+// and is only kept if the route then cuts through fewer objects than before.
+// Runs along the tops of containers can also be lowered out of their bands instead.
+func repairCollisions(g *d2graph.Graph, bands []labelBand) {
+	for _, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		repairRoute(g, bands, e)
+	}
+}
+
+// repairRoute detours e's route around what it cuts through, like repairCollisions
+func repairRoute(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge) {
+	collisions := countCollisions(g, bands, e, e.Route)
+	for attempt := 0; collisions > 0 && attempt < len(g.Objects)+len(bands); attempt++ {
+		i, obstacle := firstCollision(g, bands, e, e.Route)
+		var best []*geo.Point
+		bestCollisions := collisions
+		candidates := detours(e.Route, i, obstacle)
+		for _, b := range bands {
+			if b.box == obstacle {
+				if route, ok := belowBand(e.Route, obstacle); ok {
+					candidates = append(candidates, route)
+				}
 			}
-			if newOverlapsCount > oldOverlapsCount {
-				continue
+		}
+		for _, route := range candidates {
+			if c := countCollisions(g, bands, e, route); c < bestCollisions ||
+				(best != nil && c == bestCollisions && geo.Route(route).Length() < geo.Route(best).Length()) {
+				best, bestCollisions = route, c
 			}
+		}
+		if best == nil {
+			break
+		}
+		e.Route, collisions = best, bestCollisions
+	}
+}
 
-			if newCloseOverlapsCount > oldCloseOverlapsCount {
-				continue
+// leadOut moves the first and last bends of routes out to length from their endpoints, along with the
+// segments after them, so routes leave nodes straight before turning. Routes without a segment parallel to the
+// terminal one to take up the move, or that would cut through more objects, are left as they are.
+func leadOut(g *d2graph.Graph, bands []labelBand, length float64) {
+	for _, e := range g.Edges {
+		if e.Src == e.Dst {
+			continue
+		}
+		for _, fromEnd := range []bool{false, true} {
+			route := append([]*geo.Point{}, e.Route...)
+			if fromEnd {
+				reverseRoute(route)
 			}
-			if newTouchingCount > oldTouchingCount {
+			if !leadOutStart(route, length) {
 				continue
 			}
-
-			// commit
-			if isSource {
-				g.Edges[ei].Route = append(
-					[]*geo.Point{newStart},
-					e.Route[3:]...,
-				)
-			} else {
-				g.Edges[ei].Route = append(
-					e.Route[:len(e.Route)-3],
-					newStart,
-				)
+			if fromEnd {
+				reverseRoute(route)
+			}
+			if countCollisions(g, bands, e, route) <= countCollisions(g, bands, e, e.Route) {
+				e.Route = route
 			}
 		}
 	}
-	// Get rid of ladders
-	// ELK likes to do these for some reason
-	// .   ┌─
-	// . ┌─┘
-	// . │
-	// We want to transform these into L-shapes
-	for ei, e := range g.Edges {
-		if len(e.Route) < 6 {
+}
+
+// leadOutStart moves route's first bend out to length from its start, reporting whether it did
+func leadOutStart(route []*geo.Point, length float64) bool {
+	if len(route) < 4 {
+		return false
+	}
+	first := route[0].VectorTo(route[1])
+	current := first.Length()
+	if current >= length || current == 0 {
+		return false
+	}
+	horizontal := sameCoordinate(route[0].Y, route[1].Y)
+	if !horizontal && !sameCoordinate(route[0].X, route[1].X) {
+		return false
+	}
+	// The segment after the bend must run on the same way, with room left to take up the move
+	next := route[2].VectorTo(route[3])
+	if horizontal != sameCoordinate(route[2].Y, route[3].Y) || first[0]*next[0]+first[1]*next[1] <= 0 {
+		return false
+	}
+	remaining := next.Length() - (length - current)
+	if remaining <= 0 || (len(route) == 4 && remaining < length) {
+		return false
+	}
+
+	shift := first.Unit().Multiply(length - current)
+	route[1] = route[1].AddVector(shift)
+	route[2] = route[2].AddVector(shift)
+	return true
+}
+
+// stubRoutes moves the first and last bends of routes so that they run straight for length out of both
+// of their endpoints, or as long as the shorter end has room for
+func stubRoutes(g *d2graph.Graph, bands []labelBand, length float64) {
+	for _, e := range g.Edges {
+		if e.Src == e.Dst {
 			continue
 		}
-		if e.Src == e.Dst {
+		route := append([]*geo.Point{}, e.Route...)
+		if !stubRoute(route, length) {
 			continue
 		}
+		if countCollisions(g, bands, e, route) <= countCollisions(g, bands, e, e.Route) {
+			e.Route = route
+		}
+	}
+}
 
-		for i := 1; i < len(e.Route)-3; i++ {
-			before := e.Route[i-1]
-			start := e.Route[i]
-			corner := e.Route[i+1]
-			end := e.Route[i+2]
-			after := e.Route[i+3]
-
-			// S-shape on sources only concerned one segment, since the other was just along the bound of endpoint
-			// These concern two segments
-
-			var newCorner *geo.Point
-			if math.Ceil(start.X) == math.Ceil(corner.X) {
-				newCorner = geo.NewPoint(end.X, start.Y)
-				// not ladder
-				if (end.X > start.X) != (start.X > before.X) {
-					continue
-				}
-				if (end.Y > start.Y) != (after.Y > end.Y) {
-					continue
-				}
-			} else {
-				newCorner = geo.NewPoint(start.X, end.Y)
-				if (end.Y > start.Y) != (start.Y > before.Y) {
-					continue
-				}
-				if (end.X > start.X) != (after.X > end.X) {
-					continue
-				}
+// stubRoute moves route's first and last bends to the same distance from its ends, reporting whether it did
+func stubRoute(route []*geo.Point, length float64) bool {
+	n := len(route)
+	if n < 4 {
+		return false
+	}
+	startRoom, ok := stubRoom(route[0], route[1], route[2], route[3])
+	if !ok {
+		return false
+	}
+	endRoom, ok := stubRoom(route[n-1], route[n-2], route[n-3], route[n-4])
+	if !ok {
+		return false
+	}
+	stub := math.Min(length, math.Min(startRoom, endRoom))
+	if n == 4 {
+		// The ends share the segment between them, so they're only the same length with it centered
+		stub = startRoom
+	}
+	moved := moveStub(route, 0, 1, 2, stub)
+	return moveStub(route, n-1, n-2, n-3, stub) || moved
+}
+
+// stubRoom is how long the orthogonal segment from end to bend can be made by moving bend and corner,
+// shortening the segment from corner to next that runs the same way, while keeping half of their length for it
+func stubRoom(end, bend, corner, next *geo.Point) (float64, bool) {
+	horizontal := sameCoordinate(end.Y, bend.Y)
+	if !horizontal && !sameCoordinate(end.X, bend.X) {
+		return 0, false
+	}
+	first, after := end.VectorTo(bend), corner.VectorTo(next)
+	if horizontal != sameCoordinate(corner.Y, next.Y) || first[0]*after[0]+first[1]*after[1] <= 0 {
+		return 0, false
+	}
+	return (first.Length() + after.Length()) / 2, true
+}
+
+// moveStub moves route[bend] and route[corner] along the segment from route[end] to route[bend]
+// until it's length long
+func moveStub(route []*geo.Point, end, bend, corner int, length float64) bool {
+	first := route[end].VectorTo(route[bend])
+	current := first.Length()
+	if current == 0 || math.Abs(current-length) < 1 {
+		return false
+	}
+	shift := first.Unit().Multiply(length - current)
+	route[bend] = route[bend].AddVector(shift)
+	route[corner] = route[corner].AddVector(shift)
+	return true
+}
+
+// straighten replaces e's route with an orthogonal line across the gap between its endpoints, if it's bent
+// and there's a line that runs clear of objects. The middle of where the endpoints face each other is tried first,
+// then in line with either end of the route. Other edges aren't in the way.
+func straighten(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge) {
+	n := len(e.Route)
+	if n < 2 || n == 2 && (sameCoordinate(e.Route[0].X, e.Route[1].X) || sameCoordinate(e.Route[0].Y, e.Route[1].Y)) {
+		return
+	}
+	if e.Src.IsDescendantOf(e.Dst) || e.Dst.IsDescendantOf(e.Src) {
+		return
+	}
+	src, dst := e.Src.Box, e.Dst.Box
+	var lines [][]*geo.Point
+	// Across a gap above or below, at x
+	if srcY, dstY, ok := facing(src.TopLeft.Y, src.Height, dst.TopLeft.Y, dst.Height); ok {
+		lo, hi := math.Max(src.TopLeft.X, dst.TopLeft.X), math.Min(src.TopLeft.X+src.Width, dst.TopLeft.X+dst.Width)
+		for _, x := range []float64{(lo + hi) / 2, e.Route[0].X, e.Route[n-1].X} {
+			if lo <= x && x <= hi {
+				lines = append(lines, []*geo.Point{geo.NewPoint(x, srcY), geo.NewPoint(x, dstY)})
+			}
+		}
+	}
+	// Across a gap to the left or right, at y
+	if srcX, dstX, ok := facing(src.TopLeft.X, src.Width, dst.TopLeft.X, dst.Width); ok {
+		lo, hi := math.Max(src.TopLeft.Y, dst.TopLeft.Y), math.Min(src.TopLeft.Y+src.Height, dst.TopLeft.Y+dst.Height)
+		for _, y := range []float64{(lo + hi) / 2, e.Route[0].Y, e.Route[n-1].Y} {
+			if lo <= y && y <= hi {
+				lines = append(lines, []*geo.Point{geo.NewPoint(srcX, y), geo.NewPoint(dstX, y)})
 			}
+		}
+	}
+
+	srcShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(e.Src.Shape.Value)], src)
+	dstShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(e.Dst.Shape.Value)], dst)
+	for _, line := range lines {
+		route := []*geo.Point{
+			shape.TraceToShapeBorder(srcShape, line[0], line[1]),
+			shape.TraceToShapeBorder(dstShape, line[1], line[0]),
+		}
+		if countCollisions(g, bands, e, route) == 0 {
+			e.Route = route
+			e.JunctionPoints = nil
+			return
+		}
+	}
+}
 
-			oldS1 := geo.NewSegment(start, corner)
-			oldS2 := geo.NewSegment(corner, end)
+// facing is where the spans from aMin and bMin, aSize and bSize long, face each other across a gap, if they do
+func facing(aMin, aSize, bMin, bSize float64) (a, b float64, ok bool) {
+	switch {
+	case aMin+aSize <= bMin:
+		return aMin + aSize, bMin, true
+	case bMin+bSize <= aMin:
+		return aMin, bMin + bSize, true
+	}
+	return 0, 0, false
+}
 
-			newS1 := geo.NewSegment(start, newCorner)
-			newS2 := geo.NewSegment(newCorner, end)
+func reverseRoute(route []*geo.Point) {
+	for i, j := 0, len(route)-1; i < j; i, j = i+1, j-1 {
+		route[i], route[j] = route[j], route[i]
+	}
+}
 
-			// Check that the new segments doesn't collide with anything new
-			oldIntersects := countObjectIntersects(g, e.Src, e.Dst, *oldS1) + countObjectIntersects(g, e.Src, e.Dst, *oldS2)
-			newIntersects := countObjectIntersects(g, e.Src, e.Dst, *newS1) + countObjectIntersects(g, e.Src, e.Dst, *newS2)
+// isObstacle is whether e's route must stay out of obj.
+// Edges have to cross the borders of the objects they connect and of their ancestors.
+func isObstacle(e *d2graph.Edge, obj *d2graph.Object) bool {
+	return !e.Src.IsDescendantOf(obj) && !e.Dst.IsDescendantOf(obj)
+}
 
-			if newIntersects > oldIntersects {
-				continue
-			}
+// labelBand is the band across the top of a container that its label and icon are drawn in
+type labelBand struct {
+	container *d2graph.Object
+	box       *geo.Box
+}
+
+// labelBands are the bands of g's containers with labels or icons at their tops, in the order of g.Objects
+func labelBands(g *d2graph.Graph) []labelBand {
+	var bands []labelBand
+	for _, obj := range g.Objects {
+		if len(obj.ChildrenArray) == 0 {
+			continue
+		}
+		height := 0
+		if obj.HasLabel() && obj.LabelPosition != nil && strings.HasPrefix(*obj.LabelPosition, "INSIDE_TOP") {
+			height = obj.LabelDimensions.Height + label.PADDING
+		}
+		if obj.Icon != nil && obj.Shape.Value != d2target.ShapeImage {
+			height = go2.Max(height, d2target.GetIconSize(obj.Box, string(label.InsideTopLeft))+label.PADDING*2)
+		}
+		if height > 0 {
+			bands = append(bands, labelBand{obj, geo.NewBox(obj.TopLeft.Copy(), obj.Width, float64(height))})
+		}
+	}
+	return bands
+}
 
-			oldCrossingsCount1, oldOverlapsCount1, oldCloseOverlapsCount1, oldTouchingCount1 := countEdgeIntersects(g, g.Edges[ei], *oldS1)
-			oldCrossingsCount2, oldOverlapsCount2, oldCloseOverlapsCount2, oldTouchingCount2 := countEdgeIntersects(g, g.Edges[ei], *oldS2)
-			oldCrossingsCount := oldCrossingsCount1 + oldCrossingsCount2
-			oldOverlapsCount := oldOverlapsCount1 + oldOverlapsCount2
-			oldCloseOverlapsCount := oldCloseOverlapsCount1 + oldCloseOverlapsCount2
-			oldTouchingCount := oldTouchingCount1 + oldTouchingCount2
+// isObstacle is whether e's route must stay out of b: it's between descendants of b's container
+func (b labelBand) isObstacle(e *d2graph.Edge) bool {
+	return e.Src != b.container && e.Dst != b.container && e.Src.IsDescendantOf(b.container) && e.Dst.IsDescendantOf(b.container)
+}
 
-			newCrossingsCount1, newOverlapsCount1, newCloseOverlapsCount1, newTouchingCount1 := countEdgeIntersects(g, g.Edges[ei], *newS1)
-			newCrossingsCount2, newOverlapsCount2, newCloseOverlapsCount2, newTouchingCount2 := countEdgeIntersects(g, g.Edges[ei], *newS2)
-			newCrossingsCount := newCrossingsCount1 + newCrossingsCount2
-			newOverlapsCount := newOverlapsCount1 + newOverlapsCount2
-			newCloseOverlapsCount := newCloseOverlapsCount1 + newCloseOverlapsCount2
-			newTouchingCount := newTouchingCount1 + newTouchingCount2
+// collides is whether s crosses into b or runs inside it, as routes turning along the top of a container do
+func (b labelBand) collides(s geo.Segment) bool {
+	inside := func(p *geo.Point) bool {
+		return p.X > b.box.TopLeft.X && p.X < b.box.TopLeft.X+b.box.Width &&
+			p.Y > b.box.TopLeft.Y && p.Y < b.box.TopLeft.Y+b.box.Height
+	}
+	return b.box.Intersects(s, 0) || inside(s.Start) || inside(s.End)
+}
 
-			if newCrossingsCount > oldCrossingsCount {
-				continue
+// belowBand is route with the horizontal runs of it inside band lowered out of it, and whether there were any.
+// Runs along the ends of route are kept, since they can't move off their endpoints.
+func belowBand(route []*geo.Point, band *geo.Box) ([]*geo.Point, bool) {
+	bottom := band.TopLeft.Y + band.Height
+	out := append([]*geo.Point{}, route...)
+	lowered := false
+	for i := 1; i < len(out)-1; i++ {
+		p := out[i]
+		if p.X <= band.TopLeft.X || p.X >= band.TopLeft.X+band.Width || p.Y <= band.TopLeft.Y || p.Y >= bottom {
+			continue
+		}
+		// The run moves as a whole so the segments into and out of it stay vertical
+		start, end := i, i
+		for start > 0 && sameCoordinate(out[start-1].Y, p.Y) {
+			start--
+		}
+		for end < len(out)-1 && sameCoordinate(out[end+1].Y, p.Y) {
+			end++
+		}
+		if start > 0 && end < len(out)-1 {
+			for j := start; j <= end; j++ {
+				out[j] = geo.NewPoint(out[j].X, bottom+detourMargin)
 			}
-			if newOverlapsCount > oldOverlapsCount {
-				continue
+			lowered = true
+		}
+		i = end
+	}
+	return out, lowered
+}
+
+// firstCollision is the index of the first segment of route that runs into an object or band e must stay out of,
+// and the box of what it runs into
+func firstCollision(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge, route []*geo.Point) (int, *geo.Box) {
+	for i := 0; i < len(route)-1; i++ {
+		s := *geo.NewSegment(route[i], route[i+1])
+		for _, obj := range g.Objects {
+			if isObstacle(e, obj) && obj.Box.Intersects(s, 0) {
+				return i, obj.Box
+			}
+		}
+		for _, b := range bands {
+			if b.isObstacle(e) && b.collides(s) {
+				return i, b.box
 			}
+		}
+	}
+	return -1, nil
+}
 
-			if newCloseOverlapsCount > oldCloseOverlapsCount {
-				continue
+func countCollisions(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge, route []*geo.Point) int {
+	count := 0
+	for i := 0; i < len(route)-1; i++ {
+		s := *geo.NewSegment(route[i], route[i+1])
+		for _, obj := range g.Objects {
+			if isObstacle(e, obj) && obj.Box.Intersects(s, 0) {
+				count++
 			}
-			if newTouchingCount > oldTouchingCount {
-				continue
+		}
+		for _, b := range bands {
+			if b.isObstacle(e) && b.collides(s) {
+				count++
 			}
+		}
+	}
+	return count
+}
 
-			// commit
-			g.Edges[ei].Route = append(append(
-				e.Route[:i],
-				newCorner,
-			),
-				e.Route[i+3:]...,
-			)
-			break
+// detours returns route with the orthogonal segment from route[i] going around box on either side.
+// There are none if the segment isn't orthogonal or starts or ends beside box.
+func detours(route []*geo.Point, i int, box *geo.Box) [][]*geo.Point {
+	start, end := route[i], route[i+1]
+	horizontal := sameCoordinate(start.Y, end.Y)
+	if !horizontal && !sameCoordinate(start.X, end.X) {
+		return nil
+	}
+
+	// Along the segment and across it, so a vertical segment is handled like a horizontal one
+	along := func(p *geo.Point) float64 {
+		if horizontal {
+			return p.X
 		}
+		return p.Y
+	}
+	point := func(alongCoord, acrossCoord float64) *geo.Point {
+		if horizontal {
+			return geo.NewPoint(alongCoord, acrossCoord)
+		}
+		return geo.NewPoint(acrossCoord, alongCoord)
+	}
+	low, high := box.TopLeft.X-detourMargin, box.TopLeft.X+box.Width+detourMargin
+	sideA, sideB := box.TopLeft.Y-detourMargin, box.TopLeft.Y+box.Height+detourMargin
+	across := start.Y
+	if !horizontal {
+		low, high = box.TopLeft.Y-detourMargin, box.TopLeft.Y+box.Height+detourMargin
+		sideA, sideB = box.TopLeft.X-detourMargin, box.TopLeft.X+box.Width+detourMargin
+		across = start.X
+	}
+
+	enter, exit := low, high
+	if along(start) > along(end) {
+		enter, exit = high, low
+	}
+	if math.Min(along(start), along(end)) > low || math.Max(along(start), along(end)) < high {
+		return nil
+	}
+
+	var out [][]*geo.Point
+	for _, side := range []float64{sideA, sideB} {
+		detour := append([]*geo.Point{}, route[:i+1]...)
+		detour = append(detour,
+			point(enter, across),
+			point(enter, side),
+			point(exit, side),
+			point(exit, across),
+		)
+		detour = append(detour, route[i+1:]...)
+		out = append(out, detour)
 	}
+	return out
 }
 
+// countObjectIntersects counts the objects other than src and dst that s runs into or near,
+// and the labels outside them, which s must only keep clear of by label.PADDING
 func countObjectIntersects(g *d2graph.Graph, src, dst *d2graph.Object, s geo.Segment) int {
 	count := 0
 	for i, o := range g.Objects {
@@ -681,13 +4379,33 @@ func countObjectIntersects(g *d2graph.Graph, src, dst *d2graph.Object, s geo.Seg
 		if o.Intersects(s, float64(edge_node_spacing)-1) {
 			count++
 		}
+		if box := outsideLabelBox(o); box != nil && box.Intersects(s, label.PADDING) {
+			count++
+		}
 	}
 	return count
 }
 
+// outsideLabelBox is the box of obj's label if it's placed outside obj, or nil
+func outsideLabelBox(obj *d2graph.Object) *geo.Box {
+	if !obj.HasLabel() || obj.LabelPosition == nil {
+		return nil
+	}
+	position := label.Position(*obj.LabelPosition)
+	if !position.IsOutside() {
+		return nil
+	}
+	width, height := float64(obj.LabelDimensions.Width), float64(obj.LabelDimensions.Height)
+	return geo.NewBox(position.GetPointOnBox(obj.Box, label.PADDING, width, height), width, height)
+}
+
+// crosses is whether a pair of segments, one horizontal and one vertical, cross each other
+func crosses(s, other geo.Segment) bool {
+	return sameCoordinate(s.Start.Y, s.End.Y) != sameCoordinate(other.Start.Y, other.End.Y) && s.Intersects(other)
+}
+
 // countEdgeIntersects counts both crossings AND getting too close to a parallel segment
 func countEdgeIntersects(g *d2graph.Graph, sEdge *d2graph.Edge, s geo.Segment) (int, int, int, int) {
-	isHorizontal := math.Ceil(s.Start.Y) == math.Ceil(s.End.Y)
 	crossingsCount := 0
 	overlapsCount := 0
 	closeOverlapsCount := 0
@@ -698,46 +4416,54 @@ func countEdgeIntersects(g *d2graph.Graph, sEdge *d2graph.Edge, s geo.Segment) (
 		}
 
 		for i := 0; i < len(e.Route)-1; i++ {
-			otherS := geo.NewSegment(e.Route[i], e.Route[i+1])
-			otherIsHorizontal := math.Ceil(otherS.Start.Y) == math.Ceil(otherS.End.Y)
-			if isHorizontal == otherIsHorizontal {
-				if s.Overlaps(*otherS, !isHorizontal, 0.) {
-					if isHorizontal {
-						if math.Abs(s.Start.Y-otherS.Start.Y) < float64(edge_node_spacing)/2. {
-							overlapsCount++
-							if math.Abs(s.Start.Y-otherS.Start.Y) < float64(edge_node_spacing)/4. {
-								closeOverlapsCount++
-								if math.Abs(s.Start.Y-otherS.Start.Y) < 1. {
-									touchingCount++
-								}
-							}
-						}
-					} else {
-						if math.Abs(s.Start.X-otherS.Start.X) < float64(edge_node_spacing)/2. {
-							overlapsCount++
-							if math.Abs(s.Start.X-otherS.Start.X) < float64(edge_node_spacing)/4. {
-								closeOverlapsCount++
-								if math.Abs(s.Start.Y-otherS.Start.Y) < 1. {
-									touchingCount++
-								}
-							}
+			crossing, overlaps, closeOverlaps, touching := countSegmentIntersects(s, *geo.NewSegment(e.Route[i], e.Route[i+1]))
+			crossingsCount += crossing
+			overlapsCount += overlaps
+			closeOverlapsCount += closeOverlaps
+			touchingCount += touching
+		}
+
+	}
+	return crossingsCount, overlapsCount, closeOverlapsCount, touchingCount
+}
+
+// countSegmentIntersects is countEdgeIntersects for a single segment of another edge, each count 0 or 1
+func countSegmentIntersects(s, otherS geo.Segment) (crossing, overlaps, closeOverlaps, touching int) {
+	isHorizontal := sameCoordinate(s.Start.Y, s.End.Y)
+	otherIsHorizontal := sameCoordinate(otherS.Start.Y, otherS.End.Y)
+	if isHorizontal == otherIsHorizontal {
+		if s.Overlaps(otherS, !isHorizontal, 0.) {
+			if isHorizontal {
+				if math.Abs(s.Start.Y-otherS.Start.Y) < float64(edge_node_spacing)/2. {
+					overlaps++
+					if math.Abs(s.Start.Y-otherS.Start.Y) < float64(edge_node_spacing)/4. {
+						closeOverlaps++
+						if math.Abs(s.Start.Y-otherS.Start.Y) < 1. {
+							touching++
 						}
 					}
 				}
 			} else {
-				if s.Intersects(*otherS) {
-					crossingsCount++
+				if math.Abs(s.Start.X-otherS.Start.X) < float64(edge_node_spacing)/2. {
+					overlaps++
+					if math.Abs(s.Start.X-otherS.Start.X) < float64(edge_node_spacing)/4. {
+						closeOverlaps++
+						if math.Abs(s.Start.Y-otherS.Start.Y) < 1. {
+							touching++
+						}
+					}
 				}
 			}
 		}
-
+	} else if crosses(s, otherS) {
+		crossing++
 	}
-	return crossingsCount, overlapsCount, closeOverlapsCount, touchingCount
+	return crossing, overlaps, closeOverlaps, touching
 }
 
 func childrenMaxSelfLoop(parent *d2graph.Object, isWidth bool) int {
 	max := 0
-	for _, ch := range parent.Children {
+	for _, ch := range parent.ChildrenArray {
 		for _, e := range parent.Graph.Edges {
 			if e.Src == e.Dst && e.Src == ch && e.Label.Value != "" {
 				if isWidth {
@@ -0,0 +1,4291 @@
+package d2elklayout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"oss.terrastruct.com/util-go/assert"
+	"oss.terrastruct.com/util-go/go2"
+
+	"oss.terrastruct.com/d2/d2compiler"
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2target"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/label"
+	"oss.terrastruct.com/d2/lib/shape"
+	"oss.terrastruct.com/d2/lib/textmeasure"
+)
+
+func compileGraph(t testing.TB, script string) *d2graph.Graph {
+	g, err := d2compiler.Compile("", strings.NewReader(script), nil)
+	assert.Success(t, err)
+
+	ruler, err := textmeasure.NewRuler()
+	assert.Success(t, err)
+	err = g.SetDimensions(nil, ruler, nil)
+	assert.Success(t, err)
+	return g
+}
+
+func layoutGraph(t testing.TB, script string, opts *ConfigurableOpts) *d2graph.Graph {
+	g := compileGraph(t, script)
+	err := Layout(context.Background(), g, opts)
+	assert.Success(t, err)
+	return g
+}
+
+func TestJunctionPoints(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.MergeEdges = true
+	g := layoutGraph(t, `
+a -> b
+a -> c
+a -> d
+`, &opts)
+
+	count := 0
+	for _, e := range g.Edges {
+		for _, jp := range e.JunctionPoints {
+			count++
+			// Junctions are shared with the edge's own route, in absolute coordinates
+			onRoute := false
+			for i := 0; i < len(e.Route)-1; i++ {
+				if jp.OnOrthogonalSegment(e.Route[i], e.Route[i+1]) {
+					onRoute = true
+				}
+			}
+			assert.True(t, onRoute)
+		}
+	}
+	assert.True(t, count > 0)
+
+	g = layoutGraph(t, `
+a -> b
+a -> c
+a -> d
+`, nil)
+	for _, e := range g.Edges {
+		assert.Equal(t, 0, len(e.JunctionPoints))
+	}
+}
+
+func TestMaxBends(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `a -> b`)
+	a := g.Objects[0]
+	b := g.Objects[1]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 100)
+	b.Box = geo.NewBox(geo.NewPoint(250, 400), 100, 100)
+
+	// A staircase from the bottom of a to the top of b with 10 bends
+	route := []*geo.Point{geo.NewPoint(50, 100)}
+	for i := 0; i < 5; i++ {
+		x := 50 + float64(i)*50
+		y := 150 + float64(i)*50
+		route = append(route, geo.NewPoint(x, y), geo.NewPoint(x+50, y))
+	}
+	route = append(route, geo.NewPoint(300, 400))
+	g.Edges[0].Route = route
+	assert.Equal(t, 10, len(g.Edges[0].Route)-2)
+
+	deleteBends(g, newCollisionIndex(g))
+	assert.True(t, len(g.Edges[0].Route)-2 > 4)
+
+	capBends(g, newCollisionIndex(g), 4)
+	assert.True(t, len(g.Edges[0].Route)-2 <= 4)
+	assert.True(t, g.Edges[0].Route[0].Equals(geo.NewPoint(50, 100)))
+	assert.True(t, g.Edges[0].Route[len(g.Edges[0].Route)-1].Equals(geo.NewPoint(300, 400)))
+}
+
+func TestNodeLabelPosition(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		position  label.Position
+		placement string
+		reserved  float64
+	}{
+		{
+			position:  label.OutsideTopCenter,
+			placement: "OUTSIDE V_TOP H_CENTER",
+			reserved:  1,
+		},
+		{
+			position:  label.InsideBottomCenter,
+			placement: "INSIDE V_BOTTOM H_CENTER",
+			reserved:  0,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(string(tc.position), func(t *testing.T) {
+			t.Parallel()
+
+			opts := DefaultOpts
+			opts.NodeLabelPosition = string(tc.position)
+
+			g := compileGraph(t, `a -> b`)
+			a := g.Objects[0]
+			height := a.Height
+			elkGraph := BuildELKGraph(g, &opts)
+			assert.Equal(t, tc.placement, elkGraph.Children[0].LayoutOptions.NodeLabelsPlacement)
+			assert.Equal(t, height+tc.reserved*float64(a.LabelDimensions.Height+label.PADDING), elkGraph.Children[0].Height)
+
+			g = layoutGraph(t, `a -> b`, &opts)
+			a, b := g.Objects[0], g.Objects[1]
+			assert.Equal(t, string(tc.position), *a.LabelPosition)
+			assert.Equal(t, string(tc.position), *b.LabelPosition)
+			assert.Equal(t, height, a.Height)
+
+			// b's label stays clear of a
+			bLabel := label.Position(*b.LabelPosition).GetPointOnBox(b.Box, label.PADDING, float64(b.LabelDimensions.Width), float64(b.LabelDimensions.Height))
+			assert.True(t, bLabel.Y > a.TopLeft.Y+a.Height)
+		})
+	}
+
+	opts := DefaultOpts
+	opts.NodeLabelPosition = string(label.UnlockedTop)
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid node label position "UNLOCKED_TOP"`)
+}
+
+func TestEstimateCost(t *testing.T) {
+	t.Parallel()
+
+	scripts := []string{
+		``,
+		`a`,
+		`a -> b`,
+		`a -> b -> c`,
+		`a -> b -> c; a -> c`,
+		`x: { a -> b -> c; a -> c }`,
+		`x: { y: { a -> b -> c; a -> c } }`,
+		`x: { y: { a -> b -> c; a -> c } }; x.y.a -> d; d -> e`,
+	}
+
+	var prev Cost
+	for i, script := range scripts {
+		cost := EstimateCost(compileGraph(t, script))
+		if i > 0 {
+			assert.True(t, cost.Score > prev.Score)
+		}
+		prev = cost
+	}
+	assert.Equal(t, Cost{Nodes: 7, Edges: 5, MaxDepth: 3, Score: 138}, prev)
+}
+
+func TestLabelNodeSpacing(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.LabelNodeSpacing = 30
+
+	elkGraph := BuildELKGraph(compileGraph(t, `a -> b`), &opts)
+	for _, n := range elkGraph.Children {
+		assert.Equal(t, 30, n.LayoutOptions.LabelNodeSpacing)
+	}
+
+	g := layoutGraph(t, `a -> "a node with a long label"`, &opts)
+	b := g.Objects[1]
+	assert.True(t, b.Width >= float64(b.LabelDimensions.Width+2*30))
+	assert.True(t, b.Height >= float64(b.LabelDimensions.Height+2*30))
+
+	labelTL := label.Position(*b.LabelPosition).GetPointOnBox(b.Box, label.PADDING, float64(b.LabelDimensions.Width), float64(b.LabelDimensions.Height))
+	labelBox := geo.NewBox(labelTL, float64(b.LabelDimensions.Width), float64(b.LabelDimensions.Height))
+	route := g.Edges[0].Route
+	for i := 0; i < len(route)-1; i++ {
+		assert.False(t, labelBox.Intersects(*geo.NewSegment(route[i], route[i+1]), float64(opts.LabelNodeSpacing)-1))
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	runs := atomic.LoadInt64(&elkRuns)
+	g := layoutGraph(t, `a: hello`, nil)
+	assert.Equal(t, runs, atomic.LoadInt64(&elkRuns))
+
+	a := g.Objects[0]
+	assert.Equal(t, geo.Point{X: 0, Y: 0}, *a.TopLeft)
+	assert.True(t, a.Width >= float64(a.LabelDimensions.Width))
+	assert.True(t, a.Height >= float64(a.LabelDimensions.Height))
+	assert.Equal(t, string(label.InsideMiddleCenter), *a.LabelPosition)
+
+	g = layoutGraph(t, `a -> a`, nil)
+	assert.Equal(t, runs+1, atomic.LoadInt64(&elkRuns))
+	assert.True(t, len(g.Edges[0].Route) > 2)
+}
+
+func TestOrderedPorts(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.OrderedPorts = true
+
+	// Declared in the reverse order of the targets, so ELK can't get the order right by accident
+	script := `
+a
+b
+c
+x -> c
+x -> b
+x -> a
+`
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	x := elkGraph.Children[3]
+	assert.Equal(t, "FIXED_ORDER", x.LayoutOptions.PortConstraints)
+	assert.Equal(t, 3, len(x.Ports))
+	for _, p := range x.Ports {
+		assert.Equal(t, "SOUTH", p.LayoutOptions.PortSide)
+	}
+	assert.Equal(t, "(x -> c)[0].src", elkGraph.Edges[0].Sources[0])
+
+	g := layoutGraph(t, script, &opts)
+	for i := 0; i < len(g.Edges)-1; i++ {
+		assert.Equal(t, g.Edges[i].Route[0].Y, g.Edges[i+1].Route[0].Y)
+		assert.True(t, g.Edges[i].Route[0].X < g.Edges[i+1].Route[0].X)
+	}
+
+	g = layoutGraph(t, "direction: right\n"+script, &opts)
+	for i := 0; i < len(g.Edges)-1; i++ {
+		assert.Equal(t, g.Edges[i].Route[0].X, g.Edges[i+1].Route[0].X)
+		assert.True(t, g.Edges[i].Route[0].Y < g.Edges[i+1].Route[0].Y)
+	}
+}
+
+func TestOrderedPortsNodeSize(t *testing.T) {
+	t.Parallel()
+
+	script := `
+hub -> a
+hub -> b
+hub -> c
+hub -> d
+hub -> e
+hub -> f
+`
+	opts := DefaultOpts
+	opts.OrderedPorts = true
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	hub := elkGraph.Children[0]
+	assert.Equal(t, "PORTS MINIMUM_SIZE", hub.LayoutOptions.NodeSizeConstraints)
+	assert.Equal(t, fmt.Sprintf("(%d, %d)", int(math.Ceil(hub.Width)), int(math.Ceil(hub.Height))), hub.LayoutOptions.NodeSizeMinimum)
+
+	g := layoutGraph(t, script, &opts)
+	assert.Equal(t, 6*port_spacing, g.Objects[0].Width)
+
+	// Ports spaced further apart than the node was sized for grow it
+	opts.Extra = map[string]string{"elk.spacing.portPort": "60"}
+	g = layoutGraph(t, script, &opts)
+	hubObj := g.Objects[0]
+	assert.True(t, hubObj.Width >= 5*60)
+	for _, e := range g.Edges {
+		assert.True(t, e.Route[0].X > hubObj.TopLeft.X && e.Route[0].X < hubObj.TopLeft.X+hubObj.Width)
+	}
+}
+
+func TestMergeNearPoints(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `a -> b`)
+	a := g.Objects[0]
+	b := g.Objects[1]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 100)
+	b.Box = geo.NewBox(geo.NewPoint(0, 300), 100, 100)
+
+	// An S-shape out of a, with a near-duplicate corner hiding it
+	g.Edges[0].Route = []*geo.Point{
+		geo.NewPoint(30, 100),
+		geo.NewPoint(30, 150),
+		geo.NewPoint(30.2, 150.1),
+		geo.NewPoint(70, 150),
+		geo.NewPoint(70, 300),
+		geo.NewPoint(70.1, 300),
+	}
+
+	mergeNearPoints(g)
+	assert.Equal(t, 4, len(g.Edges[0].Route))
+	assert.True(t, g.Edges[0].Route[1].Equals(geo.NewPoint(30, 150)))
+	assert.True(t, g.Edges[0].Route[3].Equals(geo.NewPoint(70.1, 300)))
+
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, 2, len(g.Edges[0].Route))
+	assert.True(t, g.Edges[0].Route[0].Equals(geo.NewPoint(70, 100)))
+}
+
+func TestPortSpacing(t *testing.T) {
+	t.Parallel()
+
+	// x has 3 edges entering on one side and 1 leaving on the other
+	script := `
+a -> x
+b -> x
+c -> x
+x -> d
+`
+	g := compileGraph(t, script)
+	width, height := g.Objects[1].Width, g.Objects[1].Height
+	elkGraph := BuildELKGraph(g, &DefaultOpts)
+	x := elkGraph.Children[1]
+	assert.Equal(t, "x", x.ID)
+	assert.Equal(t, 3*port_spacing, x.Width)
+	assert.Equal(t, height, x.Height)
+
+	elkGraph = BuildELKGraph(compileGraph(t, "direction: right\n"+script), &DefaultOpts)
+	x = elkGraph.Children[1]
+	assert.Equal(t, width, x.Width)
+	assert.Equal(t, 3*port_spacing, x.Height)
+}
+
+func TestLayoutToJSON(t *testing.T) {
+	t.Parallel()
+
+	script := `
+z -> a
+x: {
+  c -> b
+}
+a -> x.b
+`
+	out1, err := LayoutToJSON(context.Background(), compileGraph(t, script), nil)
+	assert.Success(t, err)
+	out2, err := LayoutToJSON(context.Background(), compileGraph(t, script), nil)
+	assert.Success(t, err)
+	assert.Equal(t, string(out1), string(out2))
+
+	var elkGraph ELKGraph
+	err = json.Unmarshal(out1, &elkGraph)
+	assert.Success(t, err)
+	assert.Equal(t, 3, len(elkGraph.Children))
+	assert.Equal(t, "a", elkGraph.Children[0].ID)
+	assert.Equal(t, "x", elkGraph.Children[1].ID)
+	assert.Equal(t, "x.b", elkGraph.Children[1].Children[0].ID)
+	assert.Equal(t, "z", elkGraph.Children[2].ID)
+	assert.Equal(t, "(a -> x.b)[0]", elkGraph.Edges[0].ID)
+	for _, e := range elkGraph.Edges {
+		assert.Equal(t, 1, len(e.Sections))
+	}
+	assert.True(t, elkGraph.Children[1].Width > 0)
+}
+
+func TestStress(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.Algorithm = "stress"
+	opts.DesiredEdgeLength = 200
+	opts.StressEpsilon = 0.01
+
+	script := `
+a -> b
+b -> c
+c -> a
+a -> d
+x: {
+  e -> f
+}
+d -> x.f
+`
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	assert.Equal(t, 200., elkGraph.LayoutOptions.DesiredEdgeLength)
+	assert.Equal(t, 0.01, elkGraph.LayoutOptions.StressEpsilon)
+
+	g := layoutGraph(t, script, &opts)
+	finite := func(f float64) bool {
+		return !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	for _, obj := range g.Objects {
+		assert.True(t, finite(obj.TopLeft.X) && finite(obj.TopLeft.Y))
+	}
+	for _, e := range g.Edges {
+		assert.Equal(t, 2, len(e.Route))
+		for _, p := range e.Route {
+			assert.True(t, finite(p.X) && finite(p.Y))
+		}
+	}
+
+	// Stress options are only sent along with the stress algorithm
+	opts.Algorithm = "layered"
+	elkGraph = BuildELKGraph(compileGraph(t, script), &opts)
+	assert.Equal(t, 0., elkGraph.LayoutOptions.DesiredEdgeLength)
+
+	opts.Algorithm = "stress"
+	opts.StressEpsilon = -1
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: elk.stress.epsilon must not be negative, got -1`)
+}
+
+func TestAttachMargin(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 10., attachMargin(100))
+	assert.Equal(t, 5., attachMargin(20))
+	assert.Equal(t, 2., attachMargin(4))
+
+	g := compileGraph(t, `a -> b`)
+	a := g.Objects[0]
+	b := g.Objects[1]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(100, 0), 20, 20)
+
+	// An S-shape out of the right of a, 12px down a 20px side.
+	// A fixed 10px margin would consider it detached.
+	g.Edges[0].Route = []*geo.Point{
+		geo.NewPoint(20, 5),
+		geo.NewPoint(40, 5),
+		geo.NewPoint(40, 12),
+		geo.NewPoint(100, 12),
+	}
+
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, 2, len(g.Edges[0].Route))
+	assert.True(t, g.Edges[0].Route[0].Equals(geo.NewPoint(20, 12)))
+}
+
+func TestOrderConstraints(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> x
+b -> x
+c -> x
+y: {
+  d
+  e
+}
+`
+	opts := DefaultOpts
+	opts.OrderConstraints = []OrderConstraint{
+		{Before: "c", After: "a"},
+		{Before: "y.e", After: "y.d"},
+	}
+
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	assert.True(t, elkGraph.LayoutOptions.ForceNodeModelOrder)
+	var ids []string
+	for _, n := range elkGraph.Children {
+		ids = append(ids, n.ID)
+	}
+	assert.Equal(t, "c a x b y", strings.Join(ids, " "))
+	assert.Equal(t, "y.e", elkGraph.Children[4].Children[0].ID)
+
+	g := layoutGraph(t, script, &opts)
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	assert.True(t, objects["c"].TopLeft.X < objects["a"].TopLeft.X)
+	assert.Equal(t, objects["c"].TopLeft.Y, objects["a"].TopLeft.Y)
+	assert.True(t, objects["y.e"].TopLeft.X < objects["y.d"].TopLeft.X)
+
+	invalid := []struct {
+		constraints []OrderConstraint
+		err         string
+	}{
+		{
+			constraints: []OrderConstraint{{Before: "a", After: "z"}},
+			err:         `failed to ELK layout: order constraint on unknown object "z"`,
+		},
+		{
+			constraints: []OrderConstraint{{Before: "a", After: "y.d"}},
+			err:         `failed to ELK layout: order constraint between "a" and "y.d", which don't share a parent`,
+		},
+		{
+			constraints: []OrderConstraint{{Before: "a", After: "b"}, {Before: "b", After: "c"}, {Before: "c", After: "a"}},
+			err:         `failed to ELK layout: order constraints on "a" form a cycle`,
+		},
+	}
+	for _, tc := range invalid {
+		opts.OrderConstraints = tc.constraints
+		err := Layout(context.Background(), compileGraph(t, script), &opts)
+		assert.ErrorString(t, err, tc.err)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	t.Parallel()
+
+	e, err := NewEngine()
+	assert.Success(t, err)
+
+	scripts := []string{
+		`a -> b -> c`,
+		`x: { a -> b }; x.a -> c`,
+		`a -> b -> c`,
+	}
+	for _, script := range scripts {
+		g := compileGraph(t, script)
+		err := e.Layout(context.Background(), g, nil)
+		assert.Success(t, err)
+
+		exp := layoutGraph(t, script, nil)
+		for i, obj := range g.Objects {
+			assert.True(t, exp.Objects[i].TopLeft.Equals(obj.TopLeft))
+		}
+		for i, edge := range g.Edges {
+			assert.Equal(t, len(exp.Edges[i].Route), len(edge.Route))
+			for j, p := range edge.Route {
+				assert.True(t, exp.Edges[i].Route[j].Equals(p))
+			}
+		}
+	}
+}
+
+const benchmarkScript = `
+a -> b -> c
+a -> d
+x: {
+  e -> f
+}
+d -> x.e
+`
+
+func BenchmarkLayout(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		g := compileGraph(b, benchmarkScript)
+		err := Layout(context.Background(), g, nil)
+		assert.Success(b, err)
+	}
+}
+
+func BenchmarkEngineLayout(b *testing.B) {
+	e, err := NewEngine()
+	assert.Success(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g := compileGraph(b, benchmarkScript)
+		err := e.Layout(context.Background(), g, nil)
+		assert.Success(b, err)
+	}
+}
+
+func TestNegativeSpacing(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		set  func(*ConfigurableOpts)
+		err  string
+	}{
+		{
+			name: "node",
+			set:  func(opts *ConfigurableOpts) { opts.NodeSpacing = -10 },
+			err:  `failed to ELK layout: spacing.nodeNodeBetweenLayers must not be negative, got -10`,
+		},
+		{
+			name: "edge_node",
+			set:  func(opts *ConfigurableOpts) { opts.EdgeNodeSpacing = -1 },
+			err:  `failed to ELK layout: spacing.edgeNodeBetweenLayers must not be negative, got -1`,
+		},
+		{
+			name: "self_loop",
+			set:  func(opts *ConfigurableOpts) { opts.SelfLoopSpacing = -5 },
+			err:  `failed to ELK layout: elk.spacing.nodeSelfLoop must not be negative, got -5`,
+		},
+		{
+			name: "label_node",
+			set:  func(opts *ConfigurableOpts) { opts.LabelNodeSpacing = -2 },
+			err:  `failed to ELK layout: elk.spacing.labelNode must not be negative, got -2`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := DefaultOpts
+			tc.set(&opts)
+			err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+			assert.ErrorString(t, err, tc.err)
+		})
+	}
+
+	// Touching is fine
+	opts := DefaultOpts
+	opts.NodeSpacing = 0
+	opts.EdgeNodeSpacing = 0
+	layoutGraph(t, `a -> b`, &opts)
+}
+
+func TestIconOnlyNode(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+a: "" {
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+  width: 20
+  height: 20
+}
+b: {
+  width: 20
+  height: 20
+}
+a -> b
+`)
+	a, b := g.Objects[0], g.Objects[1]
+	bWidth, bHeight := b.Width, b.Height
+	err := Layout(context.Background(), g, nil)
+	assert.Success(t, err)
+
+	assert.Equal(t, 64., a.Width)
+	assert.Equal(t, 64., a.Height)
+	assert.Equal(t, d2target.DEFAULT_ICON_SIZE, d2target.GetIconSize(a.Box, *a.IconPosition))
+	// Without an icon, nothing to grow for
+	assert.Equal(t, bWidth, b.Width)
+	assert.Equal(t, bHeight, b.Height)
+}
+
+func TestMaxWidth(t *testing.T) {
+	t.Parallel()
+
+	script := `direction: right
+a -> b -> c -> d -> e -> f -> g -> h -> i -> j
+`
+	width := func(g *d2graph.Graph) float64 {
+		tl, br := boundingBox(g)
+		return br.X - tl.X
+	}
+
+	unwrapped := width(layoutGraph(t, script, nil))
+	assert.True(t, unwrapped > 800)
+
+	opts := DefaultOpts
+	opts.MaxWidth = 800
+	g := layoutGraph(t, script, &opts)
+	assert.True(t, width(g) <= 800)
+	// Not wrapped more than it needs to be
+	assert.True(t, width(g) > 400)
+
+	// Under the limit, nothing changes
+	opts.MaxWidth = unwrapped + 1
+	assert.Equal(t, unwrapped, width(layoutGraph(t, script, &opts)))
+}
+
+func boundingBox(g *d2graph.Graph) (tl, br geo.Point) {
+	tl = geo.Point{X: math.Inf(1), Y: math.Inf(1)}
+	br = geo.Point{X: math.Inf(-1), Y: math.Inf(-1)}
+	for _, obj := range g.Objects {
+		tl.X = math.Min(tl.X, obj.TopLeft.X)
+		tl.Y = math.Min(tl.Y, obj.TopLeft.Y)
+		br.X = math.Max(br.X, obj.TopLeft.X+obj.Width)
+		br.Y = math.Max(br.Y, obj.TopLeft.Y+obj.Height)
+	}
+	for _, e := range g.Edges {
+		for _, p := range e.Route {
+			tl.X = math.Min(tl.X, p.X)
+			tl.Y = math.Min(tl.Y, p.Y)
+			br.X = math.Max(br.X, p.X)
+			br.Y = math.Max(br.Y, p.Y)
+		}
+	}
+	return tl, br
+}
+
+func TestSelfLoopDistribution(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> a
+a -> a
+a -> a
+a -> a
+`
+	// sides is the set of sides of a the self-loops leave from
+	sides := func(g *d2graph.Graph) map[string]bool {
+		a := g.Objects[0]
+		sides := make(map[string]bool)
+		for _, e := range g.Edges {
+			p := e.Route[0]
+			switch {
+			case p.Y == a.TopLeft.Y:
+				sides["NORTH"] = true
+			case p.Y == a.TopLeft.Y+a.Height:
+				sides["SOUTH"] = true
+			case p.X == a.TopLeft.X:
+				sides["WEST"] = true
+			case p.X == a.TopLeft.X+a.Width:
+				sides["EAST"] = true
+			}
+		}
+		return sides
+	}
+
+	assert.Equal(t, 4, len(sides(layoutGraph(t, script, nil))))
+
+	opts := DefaultOpts
+	opts.SelfLoopDistribution = "NORTH"
+	g := layoutGraph(t, "direction: right\n"+script, &opts)
+	assert.Equal(t, 1, len(sides(g)))
+	assert.True(t, sides(g)["NORTH"])
+	g = layoutGraph(t, script, &opts)
+	assert.Equal(t, 1, len(sides(g)))
+	assert.True(t, sides(g)["WEST"])
+
+	opts.SelfLoopDistribution = "SOUTH"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid self-loop distribution "SOUTH"`)
+}
+
+func TestExplainOptions(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+direction: right
+a -> b
+x: {
+  c -> d
+}
+x.c -> a
+`)
+	a := g.Objects[0]
+	width, height := a.Width, a.Height
+
+	opts := DefaultOpts
+	opts.Algorithm = "mrtree"
+	opts.NodeSpacing = 90
+	explanation := ExplainOptions(g, &opts)
+	assert.Equal(t, 2, len(explanation))
+
+	root := explanation["root"].(map[string]interface{})
+	assert.Equal(t, "mrtree", root["elk.algorithm"])
+	assert.Equal(t, "RIGHT", root["elk.direction"])
+	assert.Equal(t, 90., root["spacing.nodeNodeBetweenLayers"])
+
+	x := explanation["x"].(map[string]interface{})
+	assert.Equal(t, 90., x["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, "INCLUDE_CHILDREN", x["elk.hierarchyHandling"])
+
+	assert.Equal(t, width, a.Width)
+	assert.Equal(t, height, a.Height)
+}
+
+func TestAncestorEdge(t *testing.T) {
+	t.Parallel()
+
+	// Nested so that a frame mixed up with the container's parent shows as an offset
+	g := layoutGraph(t, `p: {
+  x: {a; b}
+}
+p.x -> p.x.a
+p.x.b -> p.x
+`, nil)
+
+	byID := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		byID[obj.AbsID()] = obj
+	}
+	onBorder := func(p *geo.Point, obj *d2graph.Object) bool {
+		tl, br := obj.TopLeft, geo.NewPoint(obj.TopLeft.X+obj.Width, obj.TopLeft.Y+obj.Height)
+		if p.X < tl.X-1 || p.X > br.X+1 || p.Y < tl.Y-1 || p.Y > br.Y+1 {
+			return false
+		}
+		return math.Abs(p.X-tl.X) < 1 || math.Abs(p.X-br.X) < 1 ||
+			math.Abs(p.Y-tl.Y) < 1 || math.Abs(p.Y-br.Y) < 1
+	}
+
+	for _, tc := range []struct {
+		edge     string
+		src, dst string
+	}{
+		{"p.(x -> x.a)[0]", "p.x", "p.x.a"},
+		{"p.(x.b -> x)[0]", "p.x.b", "p.x"},
+	} {
+		var edge *d2graph.Edge
+		for _, e := range g.Edges {
+			if e.AbsID() == tc.edge {
+				edge = e
+			}
+		}
+		if edge == nil {
+			t.Fatalf("edge %s not found", tc.edge)
+		}
+		start, end := edge.Route[0], edge.Route[len(edge.Route)-1]
+		if !onBorder(start, byID[tc.src]) {
+			t.Fatalf("%s starts at %v, off the border of %s", tc.edge, start, tc.src)
+		}
+		if !onBorder(end, byID[tc.dst]) {
+			t.Fatalf("%s ends at %v, off the border of %s", tc.edge, end, tc.dst)
+		}
+	}
+}
+
+func TestSnapTracks(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `a -> b
+c -> d
+e -> f
+`)
+	for i, obj := range g.Objects {
+		x := float64(i/2) * 20
+		y := 0.
+		if i%2 == 1 {
+			x += 200
+			y = 300
+		}
+		obj.Box = geo.NewBox(geo.NewPoint(x, y), 20, 20)
+	}
+	// Three Z-shapes whose middles run side by side, a few pixels apart
+	for i, y := range []float64{100, 104, 110} {
+		x := float64(i)*20 + 10
+		g.Edges[i].Route = []*geo.Point{
+			geo.NewPoint(x, 20),
+			geo.NewPoint(x, y),
+			geo.NewPoint(x+200, y),
+			geo.NewPoint(x+200, 300),
+		}
+	}
+
+	snapTracks(g, 10)
+	for i, y := range []float64{100, 105, 110} {
+		route := g.Edges[i].Route
+		assert.Equal(t, 4, len(route))
+		assert.Equal(t, y, route[1].Y)
+		assert.Equal(t, y, route[2].Y)
+	}
+
+	// Collinear segments that don't run side by side share a track
+	for i, y := range []float64{40, 40, 46} {
+		x := float64(i)*20 + 10
+		g.Edges[i].Route = []*geo.Point{
+			geo.NewPoint(x, 20),
+			geo.NewPoint(x, y),
+			geo.NewPoint(x+10, y),
+			geo.NewPoint(x+10, 300),
+		}
+	}
+	snapTracks(g, 10)
+	for _, e := range g.Edges {
+		assert.Equal(t, 42., e.Route[1].Y)
+		assert.Equal(t, 42., e.Route[2].Y)
+	}
+}
+
+func TestExtraOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.Extra = map[string]string{
+		"elk.layered.crossingMinimization.strategy": "INTERACTIVE",
+		"elk.layered.thoroughness":                  "3",
+	}
+	g := compileGraph(t, `x: {a -> b}`)
+	raw, err := json.Marshal(BuildELKGraph(g, &opts))
+	assert.Success(t, err)
+
+	var marshaled struct {
+		LayoutOptions map[string]interface{} `json:"layoutOptions"`
+		Children      []struct {
+			LayoutOptions map[string]interface{} `json:"layoutOptions"`
+		} `json:"children"`
+	}
+	err = json.Unmarshal(raw, &marshaled)
+	assert.Success(t, err)
+	assert.Equal(t, "INTERACTIVE", marshaled.LayoutOptions["elk.layered.crossingMinimization.strategy"])
+	// Overrides the typed option
+	assert.Equal(t, "3", marshaled.LayoutOptions["elk.layered.thoroughness"])
+	assert.Equal(t, "layered", marshaled.LayoutOptions["elk.algorithm"])
+	// Only the root gets them
+	_, ok := marshaled.Children[0].LayoutOptions["elk.layered.crossingMinimization.strategy"]
+	assert.False(t, ok)
+	assert.Equal(t, 8., marshaled.Children[0].LayoutOptions["elk.layered.thoroughness"])
+
+	// ELK applies them
+	opts.Extra = map[string]string{"elk.direction": "RIGHT"}
+	g = layoutGraph(t, `a -> b`, &opts)
+	assert.True(t, g.Objects[1].TopLeft.X > g.Objects[0].TopLeft.X+g.Objects[0].Width)
+	assert.Equal(t, g.Objects[0].TopLeft.Y, g.Objects[1].TopLeft.Y)
+
+	// Including over typed options not set as strings, wrapped or not
+	opts.Extra = map[string]string{"elk.layered.thoroughness": "3"}
+	layoutGraph(t, `x: {a -> b}`, &opts)
+	opts.MaxWidth = 1
+	layoutGraph(t, `a -> b; a -> c; a -> d; a -> e`, &opts)
+	opts.MaxWidth = 0
+
+	opts.Extra = map[string]string{"elk direction": "RIGHT"}
+	err = Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid ELK option "elk direction"`)
+}
+
+func TestContainerAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> grid
+grid: {
+  b; c; d; e; f; g; h; i
+  nested: {j -> k}
+}
+`
+	opts := DefaultOpts
+	opts.ContainerAlgorithms = map[string]string{"grid": "box"}
+	explanation := ExplainOptions(compileGraph(t, script), &opts)
+
+	root := explanation["root"].(map[string]interface{})
+	assert.Equal(t, "layered", root["elk.algorithm"])
+	assert.Equal(t, 70., root["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, 8., root["elk.layered.thoroughness"])
+
+	grid := explanation["grid"].(map[string]interface{})
+	assert.Equal(t, "box", grid["elk.algorithm"])
+	assert.Equal(t, "SEPARATE_CHILDREN", grid["elk.hierarchyHandling"])
+	assert.Equal(t, 70., grid["elk.spacing.nodeNode"])
+	for _, key := range []string{"spacing.nodeNodeBetweenLayers", "elk.layered.thoroughness", "elk.layered.considerModelOrder.strategy"} {
+		_, ok := grid[key]
+		assert.False(t, ok)
+	}
+
+	// Containers within it are layered as usual
+	nested := explanation["grid.nested"].(map[string]interface{})
+	_, ok := nested["elk.algorithm"]
+	assert.False(t, ok)
+	assert.Equal(t, 70., nested["spacing.nodeNodeBetweenLayers"])
+
+	g := layoutGraph(t, script, &opts)
+	columns := make(map[float64]struct{})
+	for _, obj := range g.Objects {
+		if obj.Parent.ID == "grid" {
+			columns[obj.TopLeft.X] = struct{}{}
+		}
+	}
+	assert.True(t, len(columns) > 1)
+
+	opts.ContainerAlgorithms = map[string]string{"a": "box"}
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: algorithm on "a", which isn't a container`)
+	opts.ContainerAlgorithms = map[string]string{"z": "box"}
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: algorithm on unknown object "z"`)
+}
+
+func TestFitLabel(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+a: a label wider than its box
+b: {
+  label: another label wider than its box
+  height: 10
+}
+a -> b
+`)
+	a, b := g.Objects[0], g.Objects[1]
+	// Sized before the labels were measured
+	for _, obj := range g.Objects {
+		obj.Width, obj.Height = 20, 10
+	}
+
+	err := Layout(context.Background(), g, nil)
+	assert.Success(t, err)
+	assert.Equal(t, float64(a.LabelDimensions.Width+2*label.PADDING), a.Width)
+	assert.Equal(t, float64(a.LabelDimensions.Height+2*label.PADDING), a.Height)
+	assert.Equal(t, float64(b.LabelDimensions.Width+2*label.PADDING), b.Width)
+	// Declared
+	assert.Equal(t, 10., b.Height)
+}
+
+func TestKeepDeclaredSizes(t *testing.T) {
+	t.Parallel()
+
+	script := `
+c -> x
+x: {
+  width: 400
+  height: 200
+  a -> b
+}
+x -> d
+`
+	// ELK grows the container to fit its children
+	x, _ := layoutGraph(t, script, nil).Root.HasChild([]string{"x"})
+	assert.True(t, x.Height > 200)
+	center := x.Center()
+
+	opts := DefaultOpts
+	opts.KeepDeclaredSizes = true
+	g := layoutGraph(t, script, &opts)
+	x, _ = g.Root.HasChild([]string{"x"})
+	a, _ := g.Root.HasChild([]string{"x", "a"})
+	assert.Equal(t, 400., x.Width)
+	assert.Equal(t, 200., x.Height)
+	assert.True(t, x.Center().Equals(center))
+	assert.Equal(t, x.Center().X, a.Center().X)
+
+	for _, e := range g.Edges {
+		switch e.AbsID() {
+		case "(c -> x)[0]":
+			assert.Equal(t, x.TopLeft.Y, e.Route[len(e.Route)-1].Y)
+		case "(x -> d)[0]":
+			assert.Equal(t, x.TopLeft.Y+x.Height, e.Route[0].Y)
+		}
+	}
+}
+
+func TestEdgeLabelSpacing(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b: a label on a short edge
+b -> c: {
+  label: and on a bent one
+}
+a -> c
+`
+	g := layoutGraph(t, script, nil)
+	assert.Equal(t, string(label.InsideMiddleCenter), *g.Edges[0].LabelPosition)
+
+	opts := DefaultOpts
+	opts.EdgeLabelSpacing = 20
+	g = layoutGraph(t, script, &opts)
+	for _, e := range g.Edges {
+		if e.Label.Value == "" {
+			continue
+		}
+		position := label.Position(*e.LabelPosition)
+		assert.True(t, position == label.UnlockedTop || position == label.UnlockedBottom)
+
+		width, height := float64(e.LabelDimensions.Width), float64(e.LabelDimensions.Height)
+		tl, _ := position.GetPointOnRoute(e.Route, 2, *e.LabelPercentage, width, height)
+		box := geo.NewBox(tl, width, height)
+		for i := 0; i < len(e.Route)-1; i++ {
+			if box.Intersects(*geo.NewSegment(e.Route[i], e.Route[i+1]), 0) {
+				t.Fatalf("label of %s on its route", e.AbsID())
+			}
+		}
+	}
+}
+
+func TestFallbackAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	script := `a -> b -> c -> a`
+	// ELK lays out cycles even with mrtree, so an algorithm it doesn't have stands in for one rejecting the graph
+	opts := DefaultOpts
+	opts.Algorithm = "org.example.unknown"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.Error(t, err)
+
+	opts.FallbackAlgorithm = "layered"
+	g := layoutGraph(t, script, &opts)
+	for _, e := range g.Edges {
+		assert.True(t, len(e.Route) >= 2)
+	}
+
+	opts.FallbackAlgorithm = "org.example.unknown2"
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "org.example.unknown: "))
+	assert.True(t, strings.Contains(err.Error(), "; fallback org.example.unknown2: "))
+}
+
+func TestRepairCollisions(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+a -> b
+obstacle
+`)
+	a, b, obstacle := g.Objects[0], g.Objects[1], g.Objects[2]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(0, 200), 20, 20)
+	// More of it is left of the route, so the detour goes right
+	obstacle.Box = geo.NewBox(geo.NewPoint(-20, 90), 40, 20)
+	e := g.Edges[0]
+	e.Route = []*geo.Point{geo.NewPoint(10, 20), geo.NewPoint(10, 200)}
+
+	repairCollisions(g, nil)
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(10, 20)))
+	assert.True(t, e.Route[len(e.Route)-1].Equals(geo.NewPoint(10, 200)))
+	for i := 0; i < len(e.Route)-1; i++ {
+		assert.False(t, obstacle.Box.Intersects(*geo.NewSegment(e.Route[i], e.Route[i+1]), 0))
+	}
+	assert.Equal(t, 4, len(e.Route)-2)
+	assert.Equal(t, 40., e.Route[2].X)
+	assert.Equal(t, 40., e.Route[3].X)
+
+	// Containers of the endpoints aren't in the way
+	g = compileGraph(t, `c -> x.a`)
+	c, x, xa := g.Objects[0], g.Objects[1], g.Objects[2]
+	c.Box = geo.NewBox(geo.NewPoint(0, -200), 20, 20)
+	x.Box = geo.NewBox(geo.NewPoint(-50, -50), 120, 120)
+	xa.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	e = g.Edges[0]
+	e.Route = []*geo.Point{geo.NewPoint(10, -180), geo.NewPoint(10, 0)}
+	repairCollisions(g, nil)
+	assert.Equal(t, 2, len(e.Route))
+}
+
+func TestDeterminism(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.RandomSeed = 7
+	opts.OrderedPorts = true
+	opts.EdgeLabelSpacing = 10
+	opts.SnapTracks = true
+	opts.Extra = map[string]string{
+		"elk.layered.crossingMinimization.strategy": "LAYER_SWEEP",
+		"elk.layered.thoroughness":                  "4",
+	}
+
+	e, err := NewEngine()
+	assert.Success(t, err)
+	var first []byte
+	for i := 0; i < 10; i++ {
+		g := compileGraph(t, benchmarkScript)
+		// Through one engine to keep the runs fast. A fresh one is checked against them below.
+		elkGraph, _, err := layout(context.Background(), e, g, &opts)
+		assert.Success(t, err)
+		sortELKGraph(elkGraph)
+		out, err := json.MarshalIndent(elkGraph, "", "  ")
+		assert.Success(t, err)
+		if first == nil {
+			first = out
+			assert.True(t, strings.Contains(string(out), `"elk.randomSeed": 7`))
+			continue
+		}
+		assert.Equal(t, string(first), string(out))
+	}
+
+	out, err := LayoutToJSON(context.Background(), compileGraph(t, benchmarkScript), &opts)
+	assert.Success(t, err)
+	assert.Equal(t, string(first), string(out))
+}
+
+func TestNodeMargins(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+`
+	g := layoutGraph(t, script, nil)
+	a, b, c := g.Objects[0], g.Objects[1], g.Objects[2]
+	width, height := a.Width, a.Height
+	layerGap := b.TopLeft.Y - (a.TopLeft.Y + a.Height)
+	siblingGap := c.TopLeft.X - (b.TopLeft.X + b.Width)
+
+	opts := DefaultOpts
+	opts.NodeMargins = "[top=20,left=30,bottom=20,right=30]"
+	g = layoutGraph(t, script, &opts)
+	a, b, c = g.Objects[0], g.Objects[1], g.Objects[2]
+	assert.Equal(t, width, a.Width)
+	assert.Equal(t, height, a.Height)
+	assert.Equal(t, layerGap+40, b.TopLeft.Y-(a.TopLeft.Y+a.Height))
+	assert.Equal(t, siblingGap+60, c.TopLeft.X-(b.TopLeft.X+b.Width))
+
+	// Edges still reach the nodes
+	for _, e := range g.Edges {
+		assert.Equal(t, e.Src.TopLeft.Y+e.Src.Height, e.Route[0].Y)
+		assert.Equal(t, e.Dst.TopLeft.Y, e.Route[len(e.Route)-1].Y)
+	}
+
+	opts.NodeMargins = "[top=20,left]"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid node margins "[top=20,left]"`)
+}
+
+func TestLeadOut(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `a -> b`)
+	a, b := g.Objects[0], g.Objects[1]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(90, 200), 20, 20)
+	e := g.Edges[0]
+	e.Route = []*geo.Point{
+		geo.NewPoint(10, 20),
+		geo.NewPoint(10, 30),
+		geo.NewPoint(100, 30),
+		geo.NewPoint(100, 200),
+	}
+
+	length := 40.
+	leadOut(g, nil, length)
+	assert.Equal(t, 4, len(e.Route))
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(10, 20)))
+	assert.True(t, e.Route[3].Equals(geo.NewPoint(100, 200)))
+	// Both terminal segments leave their borders straight, for at least length
+	for _, end := range [][2]*geo.Point{{e.Route[0], e.Route[1]}, {e.Route[3], e.Route[2]}} {
+		assert.Equal(t, end[0].X, end[1].X)
+		assert.True(t, math.Abs(end[1].Y-end[0].Y) >= length)
+	}
+
+	// Not when it would run the route through another object
+	g = compileGraph(t, `
+a -> b
+obstacle
+`)
+	a, b, obstacle := g.Objects[0], g.Objects[1], g.Objects[2]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(90, 200), 20, 20)
+	obstacle.Box = geo.NewBox(geo.NewPoint(40, 40), 20, 20)
+	e = g.Edges[0]
+	e.Route = []*geo.Point{
+		geo.NewPoint(10, 20),
+		geo.NewPoint(10, 30),
+		geo.NewPoint(100, 30),
+		geo.NewPoint(100, 200),
+	}
+	leadOut(g, nil, length)
+	assert.Equal(t, 30., e.Route[1].Y)
+
+	opts := DefaultOpts
+	opts.LeadOut = -1
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: lead out must not be negative, got -1`)
+}
+
+func TestStubLength(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `a -> b`)
+	a, b := g.Objects[0], g.Objects[1]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(190, 300), 20, 20)
+	e := g.Edges[0]
+	route := func() []*geo.Point {
+		return []*geo.Point{
+			geo.NewPoint(10, 20),
+			geo.NewPoint(10, 30),
+			geo.NewPoint(100, 30),
+			geo.NewPoint(100, 250),
+			geo.NewPoint(200, 250),
+			geo.NewPoint(200, 300),
+		}
+	}
+	terminals := func() (float64, float64) {
+		n := len(e.Route)
+		assert.True(t, e.Route[0].Equals(geo.NewPoint(10, 20)))
+		assert.True(t, e.Route[n-1].Equals(geo.NewPoint(200, 300)))
+		assert.Equal(t, e.Route[0].X, e.Route[1].X)
+		assert.Equal(t, e.Route[n-1].X, e.Route[n-2].X)
+		return e.Route[1].Y - e.Route[0].Y, e.Route[n-1].Y - e.Route[n-2].Y
+	}
+
+	e.Route = route()
+	stubRoutes(g, nil, 40)
+	start, end := terminals()
+	assert.Equal(t, 40., start)
+	assert.Equal(t, 40., end)
+
+	// Shortened to what the other segment running the same way leaves room for at the source
+	e.Route = route()
+	e.Route[1].Y, e.Route[2].Y = 80, 80
+	e.Route[3].Y, e.Route[4].Y = 100, 100
+	stubRoutes(g, nil, 100)
+	start, end = terminals()
+	assert.Equal(t, 40., start)
+	assert.Equal(t, 40., end)
+
+	// With a single segment between the bends, it's centered
+	e.Route = []*geo.Point{
+		geo.NewPoint(10, 20),
+		geo.NewPoint(10, 30),
+		geo.NewPoint(200, 30),
+		geo.NewPoint(200, 300),
+	}
+	stubRoutes(g, nil, 40)
+	start, end = terminals()
+	assert.Equal(t, 140., start)
+	assert.Equal(t, 140., end)
+
+	// Not when it would run the route through another object
+	g = compileGraph(t, `
+a -> b
+obstacle
+`)
+	a, b, obstacle := g.Objects[0], g.Objects[1], g.Objects[2]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(190, 300), 20, 20)
+	obstacle.Box = geo.NewBox(geo.NewPoint(40, 40), 20, 20)
+	e = g.Edges[0]
+	e.Route = route()
+	stubRoutes(g, nil, 40)
+	assert.Equal(t, 30., e.Route[1].Y)
+
+	opts := DefaultOpts
+	opts.StubLength = -1
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: stub length must not be negative, got -1`)
+}
+
+func TestColumns(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.Columns = 4
+	opts.ColumnGutter = 30
+	g := layoutGraph(t, `
+a
+b
+c: ccccccccccccccccccc
+d
+e
+f
+g
+h: {height: 200}
+i
+j
+`, &opts)
+	assert.Equal(t, 10, len(g.Objects))
+	for i, obj := range g.Objects {
+		col, row := i%4, i/4
+		if col > 0 {
+			left := g.Objects[i-1]
+			assert.Equal(t, left.Center().Y, obj.Center().Y)
+			assert.True(t, obj.TopLeft.X-(left.TopLeft.X+left.Width) >= 30)
+		}
+		if row > 0 {
+			above := g.Objects[i-4]
+			assert.Equal(t, above.Center().X, obj.Center().X)
+			assert.True(t, obj.TopLeft.Y-(above.TopLeft.Y+above.Height) >= 30)
+		}
+	}
+	// Rows are as tall as their tallest object
+	h, i := g.Objects[7], g.Objects[8]
+	assert.Equal(t, h.TopLeft.Y+h.Height+30, i.TopLeft.Y)
+
+	// With edges, ELK wraps toward the grid as a best effort
+	g = layoutGraph(t, `a -> b -> c -> d -> e -> f -> g -> h`, &opts)
+	assert.Equal(t, 8, len(g.Objects))
+
+	opts.Columns = -1
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: columns must not be negative, got -1`)
+}
+
+func TestArrowheadInset(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.ArrowheadInset = true
+	plain := layoutGraph(t, `a -- b`, &opts).Edges[0].Route
+	arrowed := layoutGraph(t, `a -> b`, &opts).Edges[0]
+
+	length, _ := d2target.TriangleArrowhead.Dimensions(float64(d2target.BaseConnection().StrokeWidth))
+	route := arrowed.Route
+	assert.True(t, route[0].Equals(plain[0]))
+	assert.True(t, route[len(route)-1].Equals(geo.NewPoint(plain[len(plain)-1].X, plain[len(plain)-1].Y-length)))
+	assert.Equal(t, arrowed.Dst.TopLeft.Y-length, route[len(route)-1].Y)
+}
+
+func TestCachedLayouter(t *testing.T) {
+	l := NewCachedLayouter(2)
+	opts := DefaultOpts
+	opts.RandomSeed = 1
+
+	first := compileGraph(t, benchmarkScript)
+	err := l.Layout(context.Background(), first, &opts)
+	assert.Success(t, err)
+
+	runs := atomic.LoadInt64(&elkRuns)
+	second := compileGraph(t, benchmarkScript)
+	err = l.Layout(context.Background(), second, &opts)
+	assert.Success(t, err)
+	assert.Equal(t, runs, atomic.LoadInt64(&elkRuns))
+	for i, obj := range second.Objects {
+		assert.True(t, first.Objects[i].TopLeft.Equals(obj.TopLeft))
+	}
+	for i, edge := range second.Edges {
+		assert.Equal(t, len(first.Edges[i].Route), len(edge.Route))
+		for j, p := range edge.Route {
+			assert.True(t, first.Edges[i].Route[j].Equals(p))
+		}
+	}
+
+	// Separately allocated but equal options share the layout
+	fresh := DefaultOpts
+	fresh.RandomSeed = 1
+	fresh.FavorStraightEdges = go2.Pointer(true)
+	fresh.UniformNodeSize = &geo.Point{X: 10, Y: 10}
+	err = l.Layout(context.Background(), compileGraph(t, benchmarkScript), &fresh)
+	assert.Success(t, err)
+	runs = atomic.LoadInt64(&elkRuns)
+	fresh = DefaultOpts
+	fresh.RandomSeed = 1
+	fresh.FavorStraightEdges = go2.Pointer(true)
+	fresh.UniformNodeSize = &geo.Point{X: 10, Y: 10}
+	err = l.Layout(context.Background(), compileGraph(t, benchmarkScript), &fresh)
+	assert.Success(t, err)
+	assert.Equal(t, runs, atomic.LoadInt64(&elkRuns))
+
+	// Options only applied in Go share ELK's output, and are applied to it
+	opts.Mirror = "horizontal"
+	mirrored := compileGraph(t, benchmarkScript)
+	err = l.Layout(context.Background(), mirrored, &opts)
+	assert.Success(t, err)
+	assert.Equal(t, runs, atomic.LoadInt64(&elkRuns))
+	assert.False(t, first.Objects[0].TopLeft.Equals(mirrored.Objects[0].TopLeft))
+
+	// Options sent to ELK or changing how it's run are part of the key
+	opts.Mirror = ""
+	opts.RandomSeed = 2
+	err = l.Layout(context.Background(), compileGraph(t, benchmarkScript), &opts)
+	assert.Success(t, err)
+	assert.Equal(t, runs+1, atomic.LoadInt64(&elkRuns))
+	opts.MaxWidth = 400
+	err = l.Layout(context.Background(), compileGraph(t, benchmarkScript), &opts)
+	assert.Success(t, err)
+	assert.True(t, atomic.LoadInt64(&elkRuns) > runs+1)
+
+	// The least recently used layout was forgotten
+	runs = atomic.LoadInt64(&elkRuns)
+	opts = DefaultOpts
+	opts.RandomSeed = 1
+	err = l.Layout(context.Background(), compileGraph(t, benchmarkScript), &opts)
+	assert.Success(t, err)
+	assert.Equal(t, runs+1, atomic.LoadInt64(&elkRuns))
+}
+
+func TestCycleBreaking(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> a
+x: {
+  d -> e -> d
+}
+c -> x.d
+`
+	explanation := ExplainOptions(compileGraph(t, script), nil)
+	_, ok := explanation["root"].(map[string]interface{})["elk.layered.cycleBreaking.strategy"]
+	assert.False(t, ok)
+
+	for _, strategy := range []string{"GREEDY", "DEPTH_FIRST", "INTERACTIVE", "MODEL_ORDER"} {
+		opts := DefaultOpts
+		opts.CycleBreaking = strategy
+		explanation := ExplainOptions(compileGraph(t, script), &opts)
+		assert.Equal(t, strategy, explanation["root"].(map[string]interface{})["elk.layered.cycleBreaking.strategy"])
+		assert.Equal(t, strategy, explanation["x"].(map[string]interface{})["elk.layered.cycleBreaking.strategy"])
+
+		g := layoutGraph(t, script, &opts)
+		for _, e := range g.Edges {
+			assert.True(t, len(e.Route) >= 2)
+		}
+	}
+
+	opts := DefaultOpts
+	opts.CycleBreaking = "RANDOM"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid cycle breaking strategy "RANDOM"`)
+}
+
+func TestComponentOrder(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+c -> d -> e
+c -> f
+h -> i -> j -> k
+h -> l
+h -> m
+`
+	explanation := ExplainOptions(compileGraph(t, script), nil)
+	_, ok := explanation["root"].(map[string]interface{})["elk.layered.considerModelOrder.components"]
+	assert.False(t, ok)
+
+	opts := DefaultOpts
+	opts.ComponentOrder = "FORCE_MODEL_ORDER"
+	explanation = ExplainOptions(compileGraph(t, script), &opts)
+	assert.Equal(t, "FORCE_MODEL_ORDER", explanation["root"].(map[string]interface{})["elk.layered.considerModelOrder.components"])
+
+	g := layoutGraph(t, script, &opts)
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.ID] = obj
+	}
+	assert.True(t, objects["a"].TopLeft.X+objects["a"].Width <= objects["c"].TopLeft.X)
+	assert.True(t, objects["f"].TopLeft.X+objects["f"].Width <= objects["h"].TopLeft.X)
+
+	opts.ComponentOrder = "MODEL_ORDER"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid component order "MODEL_ORDER"`)
+}
+
+func TestLabelBounds(t *testing.T) {
+	t.Parallel()
+
+	g := layoutGraph(t, `
+a -> b
+b: {shape: person}
+`, nil)
+	b := g.Objects[1]
+	assert.Equal(t, string(label.OutsideBottomCenter), *b.LabelPosition)
+	bounds := LabelBounds(g)
+	assert.True(t, bounds.TopLeft.Y+bounds.Height > b.TopLeft.Y+b.Height)
+	assert.Equal(t, b.TopLeft.Y+b.Height+label.PADDING+float64(b.LabelDimensions.Height), bounds.TopLeft.Y+bounds.Height)
+
+	// Edge labels count too
+	g = layoutGraph(t, `a -> b: a long edge label that's wider than either node`, nil)
+	bounds = LabelBounds(g)
+	assert.True(t, bounds.Width >= float64(g.Edges[0].LabelDimensions.Width))
+	assert.True(t, bounds.Width > g.Objects[0].Width)
+
+	// Text is the shape itself rather than a label
+	assert.Equal(t, (*geo.Box)(nil), LabelBounds(layoutGraph(t, `t: hello {shape: text}`, nil)))
+}
+
+func TestELKErrors(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		layout string
+		expErr string
+	}{
+		{
+			name:   "error",
+			layout: `Promise.reject(new Error("boom"))`,
+			expErr: `failed to ELK layout: ELK layout error: boom`,
+		},
+		{
+			name:   "error_subclass",
+			layout: `Promise.reject(new TypeError("boom"))`,
+			expErr: `failed to ELK layout: ELK layout error: boom`,
+		},
+		{
+			name:   "error_like",
+			layout: `Promise.reject({name: "UnsupportedGraphException", message: "boom"})`,
+			expErr: `failed to ELK layout: ELK layout error: boom`,
+		},
+		{
+			name:   "message",
+			layout: `Promise.reject("boom")`,
+			expErr: `failed to ELK layout: ELK layout error: boom`,
+		},
+		{
+			name:   "unknown_rejection",
+			layout: `Promise.reject(undefined)`,
+			expErr: `failed to ELK layout: ELK: something went wrong`,
+		},
+		{
+			name:   "unknown_return",
+			layout: `Promise.resolve(42)`,
+			expErr: `failed to ELK layout: ELK unexpected return: 42`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := NewEngine()
+			assert.Success(t, err)
+			_, err = e.vm.RunString(`elk.layout = () => ` + tc.layout)
+			assert.Success(t, err)
+
+			err = e.Layout(context.Background(), compileGraph(t, `a -> b`), nil)
+			assert.ErrorString(t, err, tc.expErr)
+		})
+	}
+}
+
+func TestFlattenSingleChildContainers(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> x.y.b
+x.y.b -> c
+d -> w
+w: {e}
+p.q -> p
+`
+	// extent is the width and height the objects of g span
+	extent := func(g *d2graph.Graph) (float64, float64) {
+		minX, minY := math.Inf(1), math.Inf(1)
+		maxX, maxY := math.Inf(-1), math.Inf(-1)
+		for _, obj := range g.Objects {
+			minX, minY = math.Min(minX, obj.TopLeft.X), math.Min(minY, obj.TopLeft.Y)
+			maxX, maxY = math.Max(maxX, obj.TopLeft.X+obj.Width), math.Max(maxY, obj.TopLeft.Y+obj.Height)
+		}
+		return maxX - minX, maxY - minY
+	}
+	width, height := extent(layoutGraph(t, script, nil))
+
+	opts := DefaultOpts
+	opts.FlattenSingleChildContainers = true
+	g := layoutGraph(t, script, &opts)
+	flatWidth, flatHeight := extent(g)
+	assert.True(t, flatWidth*flatHeight < width*height)
+	assert.True(t, flatHeight < height)
+
+	var ids []string
+	for _, obj := range g.Objects {
+		ids = append(ids, obj.AbsID())
+	}
+	// p is kept, since its edge to q would become a self-loop
+	sort.Strings(ids)
+	assert.Equal(t, "a b c d e p p.q", strings.Join(ids, " "))
+	b, _ := g.Root.HasChild([]string{"b"})
+	e, _ := g.Root.HasChild([]string{"e"})
+	assert.Equal(t, g.Root, b.Parent)
+	assert.Equal(t, 6, len(g.Root.ChildrenArray))
+	assert.Equal(t, b, g.Edges[0].Dst)
+	assert.Equal(t, b, g.Edges[1].Src)
+	assert.Equal(t, e, g.Edges[2].Dst)
+}
+
+func TestLayoutQuality(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> a
+x: {
+  d -> e
+}
+c -> x.d
+`
+	presets := map[string]map[string]interface{}{
+		"fast": {
+			"elk.layered.thoroughness":                                       float64(1),
+			"elk.layered.cycleBreaking.strategy":                             "GREEDY",
+			"elk.layered.crossingMinimization.greedySwitch.type":             "OFF",
+			"elk.layered.crossingMinimization.greedySwitchHierarchical.type": "OFF",
+			"elk.layered.nodePlacement.strategy":                             "SIMPLE",
+		},
+		"balanced": {
+			"elk.layered.thoroughness":                  float64(8),
+			"elk.layered.crossingMinimization.strategy": "LAYER_SWEEP",
+			"elk.layered.nodePlacement.strategy":        "BRANDES_KOEPF",
+			"elk.layered.considerModelOrder.strategy":   "NODES_AND_EDGES",
+		},
+		"best": {
+			"elk.layered.thoroughness":                                       float64(20),
+			"elk.layered.crossingMinimization.strategy":                      "LAYER_SWEEP",
+			"elk.layered.crossingMinimization.greedySwitch.type":             "TWO_SIDED",
+			"elk.layered.crossingMinimization.greedySwitchHierarchical.type": "TWO_SIDED",
+			"elk.layered.nodePlacement.strategy":                             "NETWORK_SIMPLEX",
+			"elk.layered.considerModelOrder.strategy":                        "NODES_AND_EDGES",
+		},
+	}
+	for quality, exp := range presets {
+		opts := DefaultOpts
+		opts.LayoutQuality = quality
+		explanation := ExplainOptions(compileGraph(t, script), &opts)
+		for _, id := range []string{"root", "x"} {
+			got := explanation[id].(map[string]interface{})
+			for k, v := range exp {
+				assert.Equal(t, v, got[k])
+			}
+		}
+	}
+	opts := DefaultOpts
+	opts.LayoutQuality = "fast"
+	_, ok := ExplainOptions(compileGraph(t, script), &opts)["root"].(map[string]interface{})["elk.layered.considerModelOrder.strategy"]
+	assert.False(t, ok)
+	opts.CycleBreaking = "DEPTH_FIRST"
+	assert.Equal(t, "DEPTH_FIRST", ExplainOptions(compileGraph(t, script), &opts)["root"].(map[string]interface{})["elk.layered.cycleBreaking.strategy"])
+
+	opts.LayoutQuality = "slow"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid layout quality "slow"`)
+}
+
+func BenchmarkLayoutQuality(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&sb, "n%d -> n%d\n", i, (i*7+3)%30)
+		fmt.Fprintf(&sb, "n%d -> n%d\n", i, (i*13+5)%30)
+	}
+	e, err := NewEngine()
+	assert.Success(b, err)
+	for _, quality := range []string{"fast", "balanced", "best"} {
+		b.Run(quality, func(b *testing.B) {
+			opts := DefaultOpts
+			opts.LayoutQuality = quality
+			for i := 0; i < b.N; i++ {
+				g := compileGraph(b, sb.String())
+				err := e.Layout(context.Background(), g, &opts)
+				assert.Success(b, err)
+			}
+		})
+	}
+}
+
+func TestMinSegmentLength(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+a -> b
+c -> d
+`)
+	a, b, c, d := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 20, 20)
+	b.Box = geo.NewBox(geo.NewPoint(1, 200), 20, 20)
+	c.Box = geo.NewBox(geo.NewPoint(100, 0), 20, 20)
+	d.Box = geo.NewBox(geo.NewPoint(200, 200), 20, 20)
+	ab, cd := g.Edges[0], g.Edges[1]
+	// b's end slides along its border
+	ab.Route = []*geo.Point{
+		geo.NewPoint(10, 20),
+		geo.NewPoint(10, 100),
+		geo.NewPoint(11, 100),
+		geo.NewPoint(11, 200),
+	}
+	cd.Route = []*geo.Point{
+		geo.NewPoint(110, 20),
+		geo.NewPoint(110, 60),
+		geo.NewPoint(111, 60),
+		geo.NewPoint(111, 100),
+		geo.NewPoint(210, 100),
+		geo.NewPoint(210, 200),
+	}
+
+	removeJogs(g, nil, 3)
+	assert.Equal(t, 2, len(ab.Route))
+	assert.True(t, ab.Route[0].Equals(geo.NewPoint(10, 20)))
+	assert.True(t, ab.Route[1].Equals(geo.NewPoint(10, 200)))
+	assert.Equal(t, 4, len(cd.Route))
+	assert.True(t, cd.Route[0].Equals(geo.NewPoint(110, 20)))
+	assert.True(t, cd.Route[1].Equals(geo.NewPoint(110, 100)))
+
+	// The run after the jog would cut through the obstacle, so the one before it moves
+	g = compileGraph(t, `
+a -> b
+obstacle
+`)
+	a, b, obstacle := g.Objects[0], g.Objects[1], g.Objects[2]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 40, 20)
+	b.Box = geo.NewBox(geo.NewPoint(0, 200), 40, 20)
+	obstacle.Box = geo.NewBox(geo.NewPoint(-100, 120), 110.5, 20)
+	e := g.Edges[0]
+	jogged := []*geo.Point{
+		geo.NewPoint(10, 20),
+		geo.NewPoint(10, 100),
+		geo.NewPoint(11, 100),
+		geo.NewPoint(11, 200),
+	}
+	e.Route = append([]*geo.Point{}, jogged...)
+	removeJogs(g, nil, 3)
+	assert.Equal(t, 2, len(e.Route))
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(11, 20)))
+
+	// Neither can when a's end can't slide over
+	a.Box = geo.NewBox(geo.NewPoint(-9, 0), 20, 20)
+	e.Route = append([]*geo.Point{}, jogged...)
+	removeJogs(g, nil, 3)
+	assert.Equal(t, 4, len(e.Route))
+
+	opts := DefaultOpts
+	opts.MinSegmentLength = -1
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: min segment length must not be negative, got -1`)
+}
+
+func TestCountCrossings(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 0, CountCrossings(layoutGraph(t, benchmarkScript, nil)))
+
+	// A # of two horizontal and two vertical routes, and one more alongside the first
+	g := compileGraph(t, `
+a -> b
+c -> d
+e -> f
+g -> h
+i -> j
+`)
+	routes := [][]*geo.Point{
+		{geo.NewPoint(0, 100), geo.NewPoint(300, 100)},
+		{geo.NewPoint(0, 200), geo.NewPoint(300, 200)},
+		{geo.NewPoint(100, 0), geo.NewPoint(100, 300)},
+		{geo.NewPoint(200, 0), geo.NewPoint(200, 150), geo.NewPoint(250, 150), geo.NewPoint(250, 300)},
+		{geo.NewPoint(0, 110), geo.NewPoint(300, 110)},
+	}
+	for i, e := range g.Edges {
+		e.Route = routes[i]
+	}
+	assert.Equal(t, 6, CountCrossings(g))
+}
+
+func TestEdgeRouting(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+b -> d
+c -> d
+`
+	opts := DefaultOpts
+	opts.EdgeRouting = map[string]string{
+		"(a -> b)[0]": "ORTHOGONAL",
+		"(a -> c)[0]": "STRAIGHT",
+	}
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	assert.Equal(t, "ORTHOGONAL", elkGraph.Edges[0].LayoutOptions.EdgeRouting)
+	assert.Equal(t, "POLYLINE", elkGraph.Edges[1].LayoutOptions.EdgeRouting)
+
+	g := layoutGraph(t, script, &opts)
+	orthogonal, straight := g.Edges[0], g.Edges[1]
+	assert.True(t, len(orthogonal.Route) > 2)
+	for i := 0; i < len(orthogonal.Route)-1; i++ {
+		p, q := orthogonal.Route[i], orthogonal.Route[i+1]
+		assert.True(t, p.X == q.X || p.Y == q.Y)
+	}
+	// Straight from border to border, diagonally
+	assert.Equal(t, 2, len(straight.Route))
+	start, end := straight.Route[0], straight.Route[1]
+	assert.True(t, start.X != end.X && start.Y != end.Y)
+	assert.Equal(t, straight.Src.TopLeft.Y+straight.Src.Height, start.Y)
+	assert.Equal(t, straight.Dst.TopLeft.Y, end.Y)
+
+	opts.EdgeRouting = map[string]string{"(a -> z)[0]": "STRAIGHT"}
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: routing on unknown edge "(a -> z)[0]"`)
+	opts.EdgeRouting = map[string]string{"(a -> b)[0]": "SPLINES"}
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid routing "SPLINES" on "(a -> b)[0]"`)
+}
+
+func TestRTL(t *testing.T) {
+	t.Parallel()
+
+	script := `
+x: {
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+  a -> b
+}
+`
+	opts := DefaultOpts
+	opts.NodeLabelPosition = string(label.OutsideLeftMiddle)
+	g := layoutGraph(t, script, &opts)
+	x, a := g.Objects[0], g.Objects[1]
+	assert.Equal(t, string(label.InsideTopLeft), *x.IconPosition)
+	assert.Equal(t, string(label.InsideTopRight), *x.LabelPosition)
+	assert.Equal(t, string(label.OutsideLeftMiddle), *a.LabelPosition)
+
+	opts.RTL = true
+	g = layoutGraph(t, script, &opts)
+	x, a = g.Objects[0], g.Objects[1]
+	assert.Equal(t, string(label.InsideTopRight), *x.IconPosition)
+	assert.Equal(t, string(label.InsideTopLeft), *x.LabelPosition)
+	assert.Equal(t, string(label.OutsideRightMiddle), *a.LabelPosition)
+	// The label has room on the right instead
+	labelTL := label.OutsideRightMiddle.GetPointOnBox(a.Box, label.PADDING, float64(a.LabelDimensions.Width), float64(a.LabelDimensions.Height))
+	assert.True(t, labelTL.X+float64(a.LabelDimensions.Width) <= x.TopLeft.X+x.Width)
+}
+
+func TestPreLayout(t *testing.T) {
+	t.Parallel()
+
+	var called int
+	opts := DefaultOpts
+	opts.PreLayout = func(elkGraph *ELKGraph) {
+		called++
+		elkGraph.LayoutOptions.Direction = "RIGHT"
+		elkGraph.LayoutOptions.Extra = map[string]string{"elk.layered.spacing.baseValue": "30"}
+	}
+	g := compileGraph(t, `a -> b`)
+	out, err := LayoutToJSON(context.Background(), g, &opts)
+	assert.Success(t, err)
+	assert.Equal(t, 1, called)
+	a, b := g.Objects[0], g.Objects[1]
+	assert.True(t, b.TopLeft.X > a.TopLeft.X+a.Width)
+	assert.Equal(t, a.Center().Y, b.Center().Y)
+
+	var elkGraph map[string]interface{}
+	err = json.Unmarshal(out, &elkGraph)
+	assert.Success(t, err)
+	layoutOptions := elkGraph["layoutOptions"].(map[string]interface{})
+	assert.Equal(t, "RIGHT", layoutOptions["elk.direction"])
+	assert.Equal(t, "30", layoutOptions["elk.layered.spacing.baseValue"])
+}
+
+func TestPostLayout(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+x: {
+  c
+}
+b -> x.c
+`
+	g := layoutGraph(t, script, nil)
+
+	var called int
+	opts := DefaultOpts
+	opts.PostLayout = func(g *d2graph.Graph) {
+		called++
+		for _, obj := range g.Objects {
+			obj.TopLeft.X += 100
+			obj.TopLeft.Y += 50
+		}
+	}
+	shifted := layoutGraph(t, script, &opts)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, len(g.Objects), len(shifted.Objects))
+	for i, obj := range g.Objects {
+		assert.Equal(t, obj.TopLeft.X+100, shifted.Objects[i].TopLeft.X)
+		assert.Equal(t, obj.TopLeft.Y+50, shifted.Objects[i].TopLeft.Y)
+	}
+	// It runs last, so the routes are left where they were
+	for i, e := range g.Edges {
+		assert.Equal(t, e.Route[0].X, shifted.Edges[i].Route[0].X)
+		assert.Equal(t, e.Route[0].Y, shifted.Edges[i].Route[0].Y)
+	}
+}
+
+func TestPaddingScale(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.Padding = "[top=40,left=40,bottom=40,right=40]"
+	opts.PaddingScale = 0.5
+	paddings := make(map[string]string)
+	opts.PreLayout = func(elkGraph *ELKGraph) {
+		var walk func([]*ELKNode)
+		walk = func(nodes []*ELKNode) {
+			for _, n := range nodes {
+				paddings[n.ID] = n.LayoutOptions.Padding
+				walk(n.Children)
+			}
+		}
+		walk(elkGraph.Children)
+	}
+	g := layoutGraph(t, `a.b.c.d`, &opts)
+	assert.Equal(t, "[top=40,left=40,bottom=40,right=40]", paddings["a"])
+	assert.Equal(t, "[top=20,left=20,bottom=20,right=20]", paddings["a.b"])
+	assert.Equal(t, "[top=10,left=10,bottom=10,right=10]", paddings["a.b.c"])
+
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	a, b, c, d := objects["a"], objects["a.b"], objects["a.b.c"], objects["a.b.c.d"]
+	assert.Equal(t, 40., b.TopLeft.X-a.TopLeft.X)
+	assert.Equal(t, 20., c.TopLeft.X-b.TopLeft.X)
+	assert.Equal(t, 10., d.TopLeft.X-c.TopLeft.X)
+
+	// The default padding's top still fits each container's label
+	opts = DefaultOpts
+	opts.PaddingScale = 0.5
+	g = layoutGraph(t, `a.b.c.d`, &opts)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	a, b, c, d = objects["a"], objects["a.b"], objects["a.b.c"], objects["a.b.c.d"]
+	assert.Equal(t, 50., b.TopLeft.X-a.TopLeft.X)
+	assert.Equal(t, 25., c.TopLeft.X-b.TopLeft.X)
+	assert.Equal(t, 13., d.TopLeft.X-c.TopLeft.X)
+	for _, obj := range []*d2graph.Object{a, b, c} {
+		assert.True(t, obj.ChildrenArray[0].TopLeft.Y-obj.TopLeft.Y >= float64(obj.LabelDimensions.Height))
+	}
+
+	opts = DefaultOpts
+	opts.PaddingScale = -1
+	err := Layout(context.Background(), compileGraph(t, `a.b`), &opts)
+	assert.ErrorString(t, err, "failed to ELK layout: padding scale must not be negative, got -1")
+}
+
+// routedGraph is a graph of objects in a grid with edges routed in ladders from each source down to its target,
+// laid out by hand so that post passes can be exercised on graphs too large to lay out with ELK in a test
+func routedGraph(tb testing.TB, objects, edges int) *d2graph.Graph {
+	const columns = 20
+	r := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for i := 0; i < objects; i++ {
+		fmt.Fprintf(&sb, "n%d\n", i)
+	}
+	for i := 0; i < edges; i++ {
+		src := r.Intn(objects - columns)
+		// Any object in a row below
+		below := (src/columns + 1) * columns
+		fmt.Fprintf(&sb, "n%d -> n%d\n", src, below+r.Intn(objects-below))
+	}
+	g := compileGraph(tb, sb.String())
+
+	for i, obj := range g.Objects {
+		obj.TopLeft = geo.NewPoint(float64(i%columns)*200, float64(i/columns)*200)
+		obj.Width, obj.Height = 100, 100
+	}
+	for i, e := range g.Edges {
+		start := geo.NewPoint(e.Src.TopLeft.X+10+float64(i%8)*10, e.Src.TopLeft.Y+100)
+		end := geo.NewPoint(e.Dst.TopLeft.X+10+float64(i%8)*10, e.Dst.TopLeft.Y)
+		steps := 1 + r.Intn(3)
+		route := []*geo.Point{start}
+		for j := 0; j < steps; j++ {
+			y := start.Y + (end.Y-start.Y)*float64(j+1)/float64(steps+1)
+			route = append(route,
+				geo.NewPoint(start.X+(end.X-start.X)*float64(j)/float64(steps), y),
+				geo.NewPoint(start.X+(end.X-start.X)*float64(j+1)/float64(steps), y),
+			)
+		}
+		e.Route = append(route, end)
+	}
+	return g
+}
+
+func TestCollisionIndex(t *testing.T) {
+	t.Parallel()
+
+	g := routedGraph(t, 200, 300)
+	idx := newCollisionIndex(g)
+	check := func() {
+		t.Helper()
+		for _, e := range g.Edges {
+			for i := 0; i < len(e.Route)-1; i++ {
+				for _, s := range []*geo.Segment{
+					geo.NewSegment(e.Route[i], e.Route[i+1]),
+					// Shifted alongside the segments nearby
+					geo.NewSegment(e.Route[i].AddVector(geo.Vector{15, 15}), e.Route[i+1].AddVector(geo.Vector{15, 15})),
+					geo.NewSegment(e.Route[i], e.Route[len(e.Route)-1]),
+				} {
+					assert.Equal(t, countObjectIntersects(g, e.Src, e.Dst, *s), idx.countObjectIntersects(e.Src, e.Dst, *s))
+					crossings, overlaps, closeOverlaps, touching := countEdgeIntersects(g, e, *s)
+					idxCrossings, idxOverlaps, idxCloseOverlaps, idxTouching := idx.countEdgeIntersects(e, *s)
+					assert.Equal(t, crossings, idxCrossings)
+					assert.Equal(t, overlaps, idxOverlaps)
+					assert.Equal(t, closeOverlaps, idxCloseOverlaps)
+					assert.Equal(t, touching, idxTouching)
+				}
+			}
+		}
+	}
+	check()
+
+	// Routes changed by bend deletion are reindexed
+	before := 0
+	for _, e := range g.Edges {
+		before += len(e.Route)
+	}
+	deleteBends(g, idx)
+	after := 0
+	for _, e := range g.Edges {
+		after += len(e.Route)
+	}
+	assert.True(t, after < before)
+	check()
+}
+
+func BenchmarkCollisionCounts(b *testing.B) {
+	g := routedGraph(b, 600, 1000)
+	count := func(countObjects func(src, dst *d2graph.Object, s geo.Segment) int, countEdges func(*d2graph.Edge, geo.Segment) (int, int, int, int)) {
+		for _, e := range g.Edges {
+			for i := 0; i < len(e.Route)-1; i++ {
+				s := *geo.NewSegment(e.Route[i], e.Route[i+1])
+				countObjects(e.Src, e.Dst, s)
+				countEdges(e, s)
+			}
+		}
+	}
+	b.Run("brute force", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			count(func(src, dst *d2graph.Object, s geo.Segment) int {
+				return countObjectIntersects(g, src, dst, s)
+			}, func(e *d2graph.Edge, s geo.Segment) (int, int, int, int) {
+				return countEdgeIntersects(g, e, s)
+			})
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			idx := newCollisionIndex(g)
+			count(idx.countObjectIntersects, idx.countEdgeIntersects)
+		}
+	})
+}
+
+func TestEdgeLabelPadding(t *testing.T) {
+	t.Parallel()
+
+	script := `a -> b: a label`
+	gap := func(g *d2graph.Graph) float64 {
+		a, b := g.Objects[0], g.Objects[1]
+		return b.TopLeft.Y - (a.TopLeft.Y + a.Height)
+	}
+	opts := DefaultOpts
+	opts.EdgeLabelSpacing = 10
+	unpadded := gap(layoutGraph(t, script, &opts))
+
+	opts.EdgeLabelPadding = 15
+	var sent ELKLabel
+	opts.PreLayout = func(elkGraph *ELKGraph) {
+		sent = *elkGraph.Edges[0].Labels[0]
+	}
+	g := compileGraph(t, script)
+	out, err := LayoutToJSON(context.Background(), g, &opts)
+	assert.Success(t, err)
+	e := g.Edges[0]
+	assert.Equal(t, float64(e.LabelDimensions.Width+2*15), sent.Width)
+	assert.Equal(t, float64(e.LabelDimensions.Height+2*15), sent.Height)
+	// The room left between the nodes grows by the padding on either side
+	assert.True(t, gap(g) >= unpadded+2*15)
+
+	var elkGraph ELKGraph
+	err = json.Unmarshal(out, &elkGraph)
+	assert.Success(t, err)
+	l := elkGraph.Edges[0].Labels[0]
+	assert.Equal(t, float64(e.LabelDimensions.Width), l.Width)
+	assert.Equal(t, float64(e.LabelDimensions.Height), l.Height)
+
+	opts = DefaultOpts
+	opts.EdgeLabelPadding = -1
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, "failed to ELK layout: edge label padding must not be negative, got -1")
+}
+
+func TestArrowheadLabels(t *testing.T) {
+	t.Parallel()
+
+	gap := func(g *d2graph.Graph) float64 {
+		a, b := g.Objects[0], g.Objects[1]
+		return b.TopLeft.Y - (a.TopLeft.Y + a.Height)
+	}
+	unlabeled := gap(layoutGraph(t, `a -> b`, nil))
+
+	g := compileGraph(t, `
+a -> b: {
+  source-arrowhead: 1
+  target-arrowhead: many
+}
+`)
+	out, err := LayoutToJSON(context.Background(), g, nil)
+	assert.Success(t, err)
+	assert.True(t, gap(g) > unlabeled)
+
+	var elkGraph ELKGraph
+	err = json.Unmarshal(out, &elkGraph)
+	assert.Success(t, err)
+	labels := elkGraph.Edges[0].Labels
+	assert.Equal(t, 2, len(labels))
+	assert.Equal(t, "1", labels[0].Text)
+	assert.Equal(t, "TAIL", labels[0].LayoutOptions.EdgeLabelsPlacement)
+	assert.Equal(t, "many", labels[1].Text)
+	assert.Equal(t, "HEAD", labels[1].LayoutOptions.EdgeLabelsPlacement)
+
+	// Each is laid out nearer the end it's for
+	route := g.Edges[0].Route
+	start, end := route[0], route[len(route)-1]
+	for i, l := range labels {
+		x, y := l.X+l.Width/2, l.Y+l.Height/2
+		nearStart := geo.EuclideanDistance(x, y, start.X, start.Y) < geo.EuclideanDistance(x, y, end.X, end.Y)
+		assert.Equal(t, i == 0, nearStart)
+	}
+}
+
+func TestFixedContainers(t *testing.T) {
+	t.Parallel()
+
+	script := `
+x -> legend
+legend: {
+  a: {top: 40; left: 20}
+  b: {top: 40; left: 150}
+  c: {
+    top: 150
+    left: 20
+    d: {top: 30; left: 10}
+  }
+  a -> b: key
+}
+`
+	opts := DefaultOpts
+	opts.FixedContainers = []string{"legend"}
+	g := layoutGraph(t, script, &opts)
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	assert.Equal(t, 6, len(g.Objects))
+	assert.Equal(t, 2, len(g.Edges))
+	x, legend := objects["x"], objects["legend"]
+	assert.Equal(t, 3, len(legend.ChildrenArray))
+	assert.True(t, legend.TopLeft.Y > x.TopLeft.Y+x.Height)
+
+	for id, offset := range map[string]*geo.Point{
+		"legend.a": geo.NewPoint(20, 40),
+		"legend.b": geo.NewPoint(150, 40),
+		"legend.c": geo.NewPoint(20, 150),
+	} {
+		obj := objects[id]
+		assert.Equal(t, legend.TopLeft.X+offset.X, obj.TopLeft.X)
+		assert.Equal(t, legend.TopLeft.Y+offset.Y, obj.TopLeft.Y)
+	}
+	c, d := objects["legend.c"], objects["legend.c.d"]
+	assert.Equal(t, c.TopLeft.X+10, d.TopLeft.X)
+	assert.Equal(t, c.TopLeft.Y+30, d.TopLeft.Y)
+	// Sized to keep the same margin past its children as in front of them
+	b := objects["legend.b"]
+	assert.Equal(t, b.TopLeft.X+b.Width+20, legend.TopLeft.X+legend.Width)
+	assert.Equal(t, c.TopLeft.Y+c.Height+40, legend.TopLeft.Y+legend.Height)
+	assert.Equal(t, string(label.InsideTopCenter), *legend.LabelPosition)
+
+	ab := g.Edges[1]
+	assert.Equal(t, "legend.(a -> b)[0]", ab.AbsID())
+	assert.Equal(t, 2, len(ab.Route))
+	assert.Equal(t, ab.Route[0].Y, ab.Route[1].Y)
+
+	for _, tc := range []struct {
+		script string
+		fixed  string
+		err    string
+	}{
+		{`a.b: {top: 0; left: 0}`, "z", `fixed layout on unknown object "z"`},
+		{`a.b: {top: 0; left: 0}`, "a.b", `fixed layout on "a.b", which isn't a container`},
+		{`a.b`, "a", `"a.b" has no top and left to be placed at in fixed container "a"`},
+		{"a.b: {top: 0; left: 0}\nx -> a.b", "a", `edge "(x -> a.b)[0]" crosses into fixed container "a"`},
+	} {
+		opts := DefaultOpts
+		opts.FixedContainers = []string{tc.fixed}
+		g := compileGraph(t, tc.script)
+		objects := len(g.Objects)
+		err := Layout(context.Background(), g, &opts)
+		assert.ErrorString(t, err, "failed to ELK layout: "+tc.err)
+		assert.Equal(t, objects, len(g.Objects))
+	}
+}
+
+func TestEdgeLabelGap(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+a -> b: first
+c -> d: second
+`)
+	a, b, c, d := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 50)
+	b.Box = geo.NewBox(geo.NewPoint(0, 250), 100, 50)
+	c.Box = geo.NewBox(geo.NewPoint(120, 0), 100, 50)
+	d.Box = geo.NewBox(geo.NewPoint(120, 250), 100, 50)
+	// Routes close enough that labels in their middles overlap
+	g.Edges[0].Route = []*geo.Point{geo.NewPoint(95, 50), geo.NewPoint(95, 250)}
+	g.Edges[1].Route = []*geo.Point{geo.NewPoint(125, 50), geo.NewPoint(125, 250)}
+	for _, e := range g.Edges {
+		e.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+	}
+	first, second := edgeLabelBox(g.Edges[0], 0.5), edgeLabelBox(g.Edges[1], 0.5)
+	assert.True(t, boxesWithin(first, second, 0))
+
+	gap := 10.
+	separateEdgeLabels(g, gap)
+	// The earlier label stays put
+	assert.Equal(t, string(label.InsideMiddleCenter), *g.Edges[0].LabelPosition)
+	assert.Equal(t, string(label.UnlockedMiddle), *g.Edges[1].LabelPosition)
+	percentage := *g.Edges[1].LabelPercentage
+	assert.True(t, percentage > 0.5 && percentage < 1)
+	second = edgeLabelBox(g.Edges[1], percentage)
+	assert.False(t, boxesWithin(first, second, gap))
+	// By as little as it takes
+	assert.True(t, boxesWithin(first, edgeLabelBox(g.Edges[1], percentage-labelNudge/200), gap))
+
+	// Labels with nowhere to go along short routes are left
+	g.Edges[0].Route = []*geo.Point{geo.NewPoint(95, 50), geo.NewPoint(95, 70)}
+	g.Edges[1].Route = []*geo.Point{geo.NewPoint(125, 50), geo.NewPoint(125, 70)}
+	for _, e := range g.Edges {
+		e.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+		e.LabelPercentage = nil
+	}
+	separateEdgeLabels(g, gap)
+	for _, e := range g.Edges {
+		assert.Equal(t, string(label.InsideMiddleCenter), *e.LabelPosition)
+	}
+
+	opts := DefaultOpts
+	opts.EdgeLabelGap = -1
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: edge label gap must not be negative, got -1`)
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c
+a -> c: a label
+x: {
+  y -> z
+}
+c -> x.y
+`
+	opts := DefaultOpts
+	opts.NodeLabelPosition = string(label.OutsideTopLeft)
+	opts.EdgeLabelSpacing = 10
+	original := layoutGraph(t, script, &opts)
+
+	for _, direction := range []string{"horizontal", "vertical"} {
+		opts := opts
+		opts.Mirror = direction
+		mirrored := layoutGraph(t, script, &opts)
+
+		horizontal := direction == "horizontal"
+		coord := func(p *geo.Point) float64 {
+			if horizontal {
+				return p.X
+			}
+			return p.Y
+		}
+		other := func(p *geo.Point) float64 {
+			if horizontal {
+				return p.Y
+			}
+			return p.X
+		}
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, obj := range original.Objects {
+			size := obj.Height
+			if horizontal {
+				size = obj.Width
+			}
+			min, max = math.Min(min, coord(obj.TopLeft)), math.Max(max, coord(obj.TopLeft)+size)
+		}
+		for _, e := range original.Edges {
+			for _, p := range e.Route {
+				min, max = math.Min(min, coord(p)), math.Max(max, coord(p))
+			}
+		}
+
+		sides := strings.NewReplacer("LEFT", "RIGHT", "RIGHT", "LEFT")
+		if !horizontal {
+			sides = strings.NewReplacer("TOP", "BOTTOM", "BOTTOM", "TOP")
+		}
+		for i, obj := range original.Objects {
+			m := mirrored.Objects[i]
+			assert.Equal(t, obj.Width, m.Width)
+			assert.Equal(t, obj.Height, m.Height)
+			size := obj.Height
+			if horizontal {
+				size = obj.Width
+			}
+			assert.Equal(t, min+max-coord(obj.TopLeft)-size, coord(m.TopLeft))
+			assert.Equal(t, other(obj.TopLeft), other(m.TopLeft))
+			assert.Equal(t, sides.Replace(*obj.LabelPosition), *m.LabelPosition)
+		}
+		for i, e := range original.Edges {
+			m := mirrored.Edges[i]
+			assert.Equal(t, len(e.Route), len(m.Route))
+			for j, p := range e.Route {
+				assert.True(t, math.Abs(min+max-coord(p)-coord(m.Route[j])) < 1e-9)
+				assert.Equal(t, other(p), other(m.Route[j]))
+			}
+		}
+		e, m := original.Edges[2], mirrored.Edges[2]
+		assert.Equal(t, "a label", e.Label.Value)
+		// It's beside its route, on the other side once reflected
+		assert.True(t, *e.LabelPosition != *m.LabelPosition)
+		assert.Equal(t, strings.NewReplacer("TOP", "BOTTOM", "BOTTOM", "TOP").Replace(*e.LabelPosition), *m.LabelPosition)
+	}
+
+	opts = DefaultOpts
+	opts.Mirror = "diagonal"
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid mirror "diagonal"`)
+}
+
+func TestCriticalEdges(t *testing.T) {
+	t.Parallel()
+
+	script := `
+start -> check
+check -> ok: yes
+check -> retry: no
+check -> log
+retry -> check
+ok -> done
+start -> done
+log -> done
+ok: {width: 300}
+`
+	critical := "(ok -> done)[0]"
+	edge := func(g *d2graph.Graph) *d2graph.Edge {
+		for _, e := range g.Edges {
+			if e.AbsID() == critical {
+				return e
+			}
+		}
+		return nil
+	}
+	e := edge(layoutGraph(t, script, nil))
+	assert.True(t, len(e.Route) > 2)
+
+	opts := DefaultOpts
+	opts.CriticalEdges = []string{critical}
+	var sent *elkOpts
+	opts.PreLayout = func(elkGraph *ELKGraph) {
+		for _, e := range elkGraph.Edges {
+			if e.ID == critical {
+				sent = e.LayoutOptions
+			}
+		}
+	}
+	e = edge(layoutGraph(t, script, &opts))
+	assert.Equal(t, criticalPriority, sent.StraightnessPriority)
+	assert.Equal(t, 2, len(e.Route))
+	assert.Equal(t, e.Route[0].X, e.Route[1].X)
+
+	// Routes ELK leaves bent are straightened across the gap, through other edges but around objects
+	g := compileGraph(t, `
+a -> b
+c -> d
+x
+`)
+	a, b, c, d, x := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3], g.Objects[4]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 50)
+	b.Box = geo.NewBox(geo.NewPoint(40, 200), 100, 50)
+	c.Box = geo.NewBox(geo.NewPoint(-100, 100), 50, 50)
+	d.Box = geo.NewBox(geo.NewPoint(200, 100), 50, 50)
+	x.Box = geo.NewBox(geo.NewPoint(300, 100), 50, 50)
+	g.Edges[1].Route = []*geo.Point{geo.NewPoint(-50, 125), geo.NewPoint(200, 125)}
+	e = g.Edges[0]
+	bent := func() []*geo.Point {
+		return []*geo.Point{
+			geo.NewPoint(50, 50),
+			geo.NewPoint(50, 120),
+			geo.NewPoint(90, 120),
+			geo.NewPoint(90, 200),
+		}
+	}
+	e.Route = bent()
+	straighten(g, nil, e)
+	assert.Equal(t, 2, len(e.Route))
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(70, 50)))
+	assert.True(t, e.Route[1].Equals(geo.NewPoint(70, 200)))
+
+	// Blocked in the middle, it's lined up with an end instead
+	x.Box = geo.NewBox(geo.NewPoint(60, 100), 20, 50)
+	e.Route = bent()
+	straighten(g, nil, e)
+	assert.Equal(t, 2, len(e.Route))
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(50, 50)))
+	assert.True(t, e.Route[1].Equals(geo.NewPoint(50, 200)))
+
+	// With no line clear, it's left as it was
+	x.Box = geo.NewBox(geo.NewPoint(30, 100), 80, 50)
+	e.Route = bent()
+	straighten(g, nil, e)
+	assert.Equal(t, 4, len(e.Route))
+
+	opts = DefaultOpts
+	opts.CriticalEdges = []string{"(a -> c)[0]"}
+	err := Layout(context.Background(), compileGraph(t, `a -> b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: critical path on unknown edge "(a -> c)[0]"`)
+	opts.CriticalEdges = []string{"(a -> a)[0]"}
+	err = Layout(context.Background(), compileGraph(t, `a -> a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: critical path on "(a -> a)[0]", which is a self-loop`)
+}
+
+func TestNodeAlignment(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+a -> d
+b: {width: 30; height: 30}
+c: {width: 150; height: 120}
+d: {height: 60}
+`
+	siblings := func(g *d2graph.Graph) []*d2graph.Object {
+		return g.Objects[1:]
+	}
+	for _, tc := range []struct {
+		alignment string
+		line      func(obj *d2graph.Object) float64
+	}{
+		{"TOP", func(obj *d2graph.Object) float64 { return obj.TopLeft.Y }},
+		{"CENTER", func(obj *d2graph.Object) float64 { return obj.Center().Y }},
+		{"BOTTOM", func(obj *d2graph.Object) float64 { return obj.TopLeft.Y + obj.Height }},
+	} {
+		opts := DefaultOpts
+		opts.NodeAlignment = tc.alignment
+		g := layoutGraph(t, script, &opts)
+		for _, obj := range siblings(g) {
+			assert.Equal(t, tc.line(siblings(g)[0]), tc.line(obj))
+		}
+	}
+
+	// Layers are columns flowing right
+	opts := DefaultOpts
+	opts.NodeAlignment = "RIGHT"
+	g := layoutGraph(t, "direction: right\n"+script, &opts)
+	for _, obj := range siblings(g) {
+		assert.Equal(t, siblings(g)[0].TopLeft.X+siblings(g)[0].Width, obj.TopLeft.X+obj.Width)
+	}
+
+	explanation := ExplainOptions(compileGraph(t, script), nil)
+	_, ok := explanation["root"].(map[string]interface{})["elk.layered.nodePlacement.favorStraightEdges"]
+	assert.False(t, ok)
+	opts = DefaultOpts
+	opts.FavorStraightEdges = go2.Pointer(false)
+	explanation = ExplainOptions(compileGraph(t, script), &opts)
+	assert.Equal(t, false, explanation["root"].(map[string]interface{})["elk.layered.nodePlacement.favorStraightEdges"])
+	layoutGraph(t, script, &opts)
+
+	opts = DefaultOpts
+	opts.NodeAlignment = "MIDDLE"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid node alignment "MIDDLE"`)
+}
+
+func TestBestEffort(t *testing.T) {
+	t.Parallel()
+
+	e, err := NewEngine()
+	assert.Success(t, err)
+	expired := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	err = e.Layout(expired(), compileGraph(t, benchmarkScript), nil)
+	assert.ErrorString(t, err, "failed to ELK layout: context deadline exceeded")
+
+	opts := DefaultOpts
+	opts.BestEffort = true
+	g := compileGraph(t, benchmarkScript)
+	stats, err := e.LayoutWithStats(expired(), g, &opts)
+	assert.Success(t, err)
+	assert.True(t, stats.BestEffort)
+	// Placed in grids, children within their containers and apart from their siblings
+	for _, obj := range g.Objects {
+		if obj.Parent != g.Root {
+			p := obj.Parent
+			assert.True(t, p.TopLeft.X <= obj.TopLeft.X && obj.TopLeft.X+obj.Width <= p.TopLeft.X+p.Width)
+			assert.True(t, p.TopLeft.Y <= obj.TopLeft.Y && obj.TopLeft.Y+obj.Height <= p.TopLeft.Y+p.Height)
+		}
+		for _, other := range g.Objects {
+			if obj != other && obj.Parent == other.Parent {
+				apart := obj.TopLeft.X+obj.Width <= other.TopLeft.X || other.TopLeft.X+other.Width <= obj.TopLeft.X ||
+					obj.TopLeft.Y+obj.Height <= other.TopLeft.Y || other.TopLeft.Y+other.Height <= obj.TopLeft.Y
+				assert.True(t, apart)
+			}
+		}
+	}
+	for _, edge := range g.Edges {
+		assert.Equal(t, 2, len(edge.Route))
+	}
+
+	// The interrupted engine lays out the next graph in full
+	stats, err = e.LayoutWithStats(context.Background(), compileGraph(t, benchmarkScript), &opts)
+	assert.Success(t, err)
+	assert.False(t, stats.BestEffort)
+}
+
+func TestShiftBottomLabels(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a: {shape: person}
+a -> b
+a -> c
+a -> d
+`
+	g := layoutGraph(t, script, nil)
+	a := g.Objects[0]
+	assert.Equal(t, string(label.OutsideBottomCenter), *a.LabelPosition)
+	assert.True(t, labelCrossed(g, a, label.OutsideBottomCenter))
+
+	opts := DefaultOpts
+	opts.ShiftBottomLabels = true
+	g = layoutGraph(t, script, &opts)
+	a = g.Objects[0]
+	assert.Equal(t, string(label.OutsideBottomLeft), *a.LabelPosition)
+	assert.False(t, labelCrossed(g, a, label.OutsideBottomLeft))
+
+	opts.RTL = true
+	g = layoutGraph(t, script, &opts)
+	assert.Equal(t, string(label.OutsideBottomRight), *g.Objects[0].LabelPosition)
+
+	// Wider than its node, there's nowhere along the bottom the edge doesn't run through it
+	opts.RTL = false
+	g = layoutGraph(t, `
+a: the longest label of them all {shape: person}
+a -> b
+`, &opts)
+	assert.Equal(t, string(label.OutsideBottomCenter), *g.Objects[0].LabelPosition)
+}
+
+func TestLayoutToBox(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c
+a -> c
+x: {
+  y -> z
+}
+c -> x.y
+`
+	opts := DefaultOpts
+	original := contentBounds(layoutGraph(t, script, &opts))
+
+	for _, box := range []geo.Box{
+		*geo.NewBox(geo.NewPoint(10, 20), 300, 2000),
+		*geo.NewBox(geo.NewPoint(-50, 0), 2000, 150),
+	} {
+		g := compileGraph(t, script)
+		err := LayoutToBox(context.Background(), g, box, &opts)
+		assert.Success(t, err)
+
+		bounds := contentBounds(g)
+		const epsilon = 1e-6
+		if bounds.TopLeft.X < box.TopLeft.X-epsilon || bounds.TopLeft.Y < box.TopLeft.Y-epsilon ||
+			bounds.TopLeft.X+bounds.Width > box.TopLeft.X+box.Width+epsilon ||
+			bounds.TopLeft.Y+bounds.Height > box.TopLeft.Y+box.Height+epsilon {
+			t.Fatalf("%v doesn't fit in %v", bounds, box)
+		}
+		// It fills one side of the box and is centered along the other
+		if math.Abs(bounds.Width-box.Width) > epsilon && math.Abs(bounds.Height-box.Height) > epsilon {
+			t.Fatalf("%v doesn't fill %v", bounds, box)
+		}
+		assert.True(t, math.Abs(bounds.Center().X-box.Center().X) < epsilon)
+		assert.True(t, math.Abs(bounds.Center().Y-box.Center().Y) < epsilon)
+		assert.True(t, math.Abs(bounds.Width/bounds.Height-original.Width/original.Height) < epsilon)
+	}
+
+	err := LayoutToBox(context.Background(), compileGraph(t, script), *geo.NewBox(geo.NewPoint(0, 0), 0, 100), &opts)
+	assert.Error(t, err)
+}
+
+func TestStackedEndpoints(t *testing.T) {
+	t.Parallel()
+
+	opts := DefaultOpts
+	opts.FixedContainers = []string{"stack"}
+	g := compileGraph(t, `
+stack: {
+  a: {top: 20; left: 20; shape: circle}
+  b: {top: 20; left: 20; shape: circle}
+  a -> b
+}
+`)
+	stats, err := LayoutWithStats(context.Background(), g, &opts)
+	assert.Success(t, err)
+
+	e := g.Edges[0]
+	assert.Equal(t, 2, len(e.Route))
+	for _, p := range e.Route {
+		assert.False(t, math.IsNaN(p.X) || math.IsNaN(p.Y))
+	}
+	a := g.Objects[1]
+	assert.Equal(t, *geo.NewPoint(a.TopLeft.X+a.Width/2, a.TopLeft.Y+a.Height), *e.Route[0])
+	assert.True(t, e.Route[1].Y > e.Route[0].Y)
+	assert.Equal(t, 1, len(stats.Warnings))
+	assert.True(t, strings.Contains(stats.Warnings[0], `"stack.(a -> b)[0]"`))
+
+	// Edges between objects apart are left alone
+	stats, err = LayoutWithStats(context.Background(), compileGraph(t, "a -> b"), &DefaultOpts)
+	assert.Success(t, err)
+	assert.Equal(t, 0, len(stats.Warnings))
+}
+
+func TestSpacingBaseValue(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c
+a -> c
+b -> d
+x: {
+  y -> z
+  y -> w
+}
+c -> x.y
+`
+	var prev *geo.Box
+	for _, base := range []int{10, 20, 40, 80} {
+		opts := DefaultOpts
+		opts.SpacingBaseValue = base
+		bounds := contentBounds(layoutGraph(t, script, &opts))
+		if prev != nil {
+			assert.True(t, bounds.Width > prev.Width)
+			assert.True(t, bounds.Height > prev.Height)
+		}
+		prev = bounds
+	}
+
+	// Explicit spacings win over the derived ones
+	opts := DefaultOpts
+	opts.SpacingBaseValue = 80
+	opts.NodeSpacing = 20
+	explicit := contentBounds(layoutGraph(t, script, &opts))
+	assert.True(t, explicit.Height < prev.Height)
+	root := ExplainOptions(compileGraph(t, script), &opts)["root"].(map[string]interface{})
+	assert.Equal(t, 20., root["spacing.nodeNodeBetweenLayers"])
+	_, ok := root["elk.layered.spacing.edgeEdgeBetweenLayers"]
+	assert.False(t, ok)
+}
+
+func TestAvoidContainerLabels(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `
+x: a long container label {
+  a -> b
+}
+`)
+	x, a, b := g.Objects[0], g.Objects[1], g.Objects[2]
+	x.Box = geo.NewBox(geo.NewPoint(0, 0), 300, 200)
+	x.LabelPosition = go2.Pointer(string(label.InsideTopCenter))
+	a.Box = geo.NewBox(geo.NewPoint(20, 100), 40, 40)
+	b.Box = geo.NewBox(geo.NewPoint(240, 100), 40, 40)
+	e := g.Edges[0]
+	// Over the top of a and b, through where x's label is drawn
+	route := []*geo.Point{geo.NewPoint(40, 100), geo.NewPoint(40, 10), geo.NewPoint(260, 10), geo.NewPoint(260, 100)}
+
+	bands := labelBands(g)
+	assert.Equal(t, 1, len(bands))
+	band := bands[0].box
+	assert.Equal(t, float64(x.LabelDimensions.Height+label.PADDING), band.Height)
+
+	e.Route = append([]*geo.Point{}, route...)
+	repairCollisions(g, nil)
+	assert.Equal(t, 10., e.Route[1].Y)
+
+	e.Route = append([]*geo.Point{}, route...)
+	repairCollisions(g, bands)
+	assert.Equal(t, 4, len(e.Route))
+	assert.True(t, e.Route[0].Equals(route[0]))
+	assert.True(t, e.Route[3].Equals(route[3]))
+	for i := 0; i < len(e.Route)-1; i++ {
+		assert.False(t, bands[0].collides(*geo.NewSegment(e.Route[i], e.Route[i+1])))
+	}
+	assert.True(t, e.Route[1].Y > band.TopLeft.Y+band.Height)
+	assert.True(t, e.Route[1].Y < a.TopLeft.Y)
+
+	// Routes into the container cross the band where they must
+	opts := DefaultOpts
+	opts.AvoidContainerLabels = true
+	g = layoutGraph(t, `
+c -> x.a
+x: a long container label {
+  a -> b -> d
+  d -> a
+  a -> d
+}
+`, &opts)
+	bands = labelBands(g)
+	assert.Equal(t, 1, len(bands))
+	for _, e := range g.Edges {
+		assert.Equal(t, e.Src.Parent == bands[0].container, bands[0].isObstacle(e))
+		if bands[0].isObstacle(e) {
+			assert.Equal(t, 0, countCollisions(g, bands, e, e.Route))
+		}
+	}
+}
+
+func TestChildOverflow(t *testing.T) {
+	t.Parallel()
+
+	protruding := func() (*d2graph.Graph, map[string]*ELKNode) {
+		g := compileGraph(t, `
+x: {
+  y: {
+    a
+  }
+  b
+}
+`)
+		x, y, a, b := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3]
+		x.Box = geo.NewBox(geo.NewPoint(0, 0), 300, 200)
+		y.Box = geo.NewBox(geo.NewPoint(20, 40), 100, 100)
+		// a pokes out of the bottom of y, and with y grown, out of x
+		a.Box = geo.NewBox(geo.NewPoint(40, 80), 40, 150)
+		b.Box = geo.NewBox(geo.NewPoint(200, 40), 40, 40)
+		padding := &elkOpts{ConfigurableOpts: ConfigurableOpts{Padding: "[top=30,left=10,bottom=20,right=10]"}}
+		return g, map[string]*ELKNode{
+			"x":   {ID: "x", LayoutOptions: padding},
+			"x.y": {ID: "x.y", LayoutOptions: padding},
+		}
+	}
+
+	g, nodes := protruding()
+	assert.Success(t, containChildren(g, nodes, ""))
+	assert.Equal(t, 100., g.Objects[1].Height)
+
+	g, nodes = protruding()
+	err := containChildren(g, nodes, "error")
+	assert.ErrorString(t, err, `children protrude from their containers: "x.y.a"`)
+
+	g, nodes = protruding()
+	assert.Success(t, containChildren(g, nodes, "grow"))
+	x, y := g.Objects[0], g.Objects[1]
+	assert.True(t, y.TopLeft.Equals(geo.NewPoint(20, 40)))
+	assert.Equal(t, 100., y.Width)
+	assert.Equal(t, 210., y.Height)
+	assert.True(t, x.TopLeft.Equals(geo.NewPoint(0, 0)))
+	assert.Equal(t, 300., x.Width)
+	assert.Equal(t, 270., x.Height)
+
+	opts := DefaultOpts
+	opts.ChildOverflow = "clamp"
+	err = Layout(context.Background(), compileGraph(t, "x: {a}"), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid child overflow "clamp"`)
+
+	// Layouts ELK keeps children inside of pass
+	opts.ChildOverflow = "error"
+	layoutGraph(t, "x: {a -> b\ny: {c}}\nz -> x.y.c", &opts)
+}
+
+func TestMultilineEdgeLabels(t *testing.T) {
+	t.Parallel()
+
+	oneLine := compileGraph(t, `a -> b: first line`).Edges[0].LabelDimensions
+	script := `a -> b: "first line\nsecond line"`
+	for _, spacing := range []int{0, 10} {
+		opts := DefaultOpts
+		opts.EdgeLabelSpacing = spacing
+		var sent ELKLabel
+		opts.PreLayout = func(elkGraph *ELKGraph) {
+			sent = *elkGraph.Edges[0].Labels[0]
+		}
+		g := compileGraph(t, script)
+		out, err := LayoutToJSON(context.Background(), g, &opts)
+		assert.Success(t, err)
+
+		e := g.Edges[0]
+		assert.True(t, e.LabelDimensions.Height > oneLine.Height)
+		assert.Equal(t, float64(e.LabelDimensions.Height), sent.Height)
+
+		var elkGraph ELKGraph
+		err = json.Unmarshal(out, &elkGraph)
+		assert.Success(t, err)
+		l := elkGraph.Edges[0].Labels[0]
+		width, height := float64(e.LabelDimensions.Width), float64(e.LabelDimensions.Height)
+		if spacing == 0 {
+			// Inline labels are drawn centered on the route, in the room ELK made for their whole height
+			assert.Equal(t, string(label.InsideMiddleCenter), *e.LabelPosition)
+			a, b := g.Objects[0], g.Objects[1]
+			assert.True(t, b.TopLeft.Y-(a.TopLeft.Y+a.Height) >= height)
+			continue
+		}
+
+		position := label.Position(*e.LabelPosition)
+		tl, _ := position.GetPointOnRoute(e.Route, 2, *e.LabelPercentage, width, height)
+		box := geo.NewBox(tl, width, height)
+		for i := 0; i < len(e.Route)-1; i++ {
+			assert.False(t, box.Intersects(*geo.NewSegment(e.Route[i], e.Route[i+1]), 0))
+		}
+		// The whole box is centered where ELK put the label
+		center := box.Center()
+		assert.True(t, math.Abs(center.Y-(l.Y+l.Height/2)) < 1)
+	}
+}
+
+func TestReroute(t *testing.T) {
+	t.Parallel()
+
+	g := layoutGraph(t, `
+a -> b -> c
+a -> d
+d -> c
+b -> b
+`, nil)
+	before := make(map[*d2graph.Edge][]geo.Point)
+	for _, e := range g.Edges {
+		for _, p := range e.Route {
+			before[e] = append(before[e], *p)
+		}
+	}
+	b := g.Objects[1]
+	b.TopLeft = geo.NewPoint(b.TopLeft.X+400, b.TopLeft.Y+30)
+
+	err := Reroute(context.Background(), g, b, nil)
+	assert.Success(t, err)
+	for _, e := range g.Edges {
+		unchanged := len(e.Route) == len(before[e])
+		for i := 0; unchanged && i < len(e.Route); i++ {
+			unchanged = e.Route[i].Equals(&before[e][i])
+		}
+		incident := e.Src == b || e.Dst == b
+		assert.Equal(t, !incident, unchanged)
+		if !incident {
+			continue
+		}
+		for i := 0; i < len(e.Route)-1; i++ {
+			start, end := e.Route[i], e.Route[i+1]
+			assert.True(t, sameCoordinate(start.X, end.X) || sameCoordinate(start.Y, end.Y))
+		}
+		assert.Equal(t, 0, countCollisions(g, nil, e, e.Route))
+		// It ends on the moved box
+		p := e.Route[0]
+		if e.Dst == b {
+			p = e.Route[len(e.Route)-1]
+		}
+		assert.True(t, p.X >= b.TopLeft.X-1 && p.X <= b.TopLeft.X+b.Width+1)
+		assert.True(t, p.Y >= b.TopLeft.Y-1 && p.Y <= b.TopLeft.Y+b.Height+1)
+	}
+
+	other := compileGraph(t, `x`)
+	err = Reroute(context.Background(), g, other.Objects[0], nil)
+	assert.ErrorString(t, err, `failed to reroute: "x" isn't in the graph`)
+}
+
+func TestContainerLabelAlignment(t *testing.T) {
+	t.Parallel()
+
+	script := `
+x: header {
+  a -> b
+}
+y: header {
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+  c
+}
+`
+	opts := DefaultOpts
+	g := layoutGraph(t, script, &opts)
+	assert.Equal(t, string(label.InsideTopCenter), *g.Objects[0].LabelPosition)
+
+	opts.ContainerLabelAlignment = "left"
+	g = layoutGraph(t, script, &opts)
+	x, y := g.Objects[0], g.Objects[3]
+	assert.Equal(t, string(label.InsideTopLeft), *x.LabelPosition)
+	assert.Equal(t, string(label.InsideTopLeft), *y.LabelPosition)
+	assert.Equal(t, string(label.InsideTopRight), *y.IconPosition)
+
+	explanation := ExplainOptions(compileGraph(t, script), &opts)
+	assert.Equal(t, "INSIDE V_TOP H_LEFT", explanation["x"].(map[string]interface{})["elk.nodeLabels.placement"])
+
+	opts.ContainerLabelAlignment = "right"
+	g = layoutGraph(t, script, &opts)
+	y = g.Objects[3]
+	assert.Equal(t, string(label.InsideTopRight), *y.LabelPosition)
+	assert.Equal(t, string(label.InsideTopLeft), *y.IconPosition)
+
+	opts.ContainerLabelAlignment = "start"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid container label alignment "start"`)
+}
+
+func TestConstraintEdges(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> c
+b -> c
+a -> b: only for layering
+`
+	opts := DefaultOpts
+	g := layoutGraph(t, script, &opts)
+	a, b := g.Objects[0], g.Objects[2]
+	assert.True(t, b.TopLeft.Y > a.TopLeft.Y+a.Height)
+	assert.Equal(t, 3, len(g.Edges))
+
+	// Without the edge, a and b share the first layer
+	g = layoutGraph(t, "a -> c\nb -> c\nb", &opts)
+	assert.Equal(t, g.Objects[0].TopLeft.Y, g.Objects[2].TopLeft.Y)
+
+	opts.ConstraintEdges = []string{"(a -> b)[0]"}
+	g = compileGraph(t, script)
+	var sent *ELKEdge
+	opts.PreLayout = func(elkGraph *ELKGraph) {
+		sent = elkGraph.Edges[2]
+	}
+	assert.Success(t, Layout(context.Background(), g, &opts))
+	a, b = g.Objects[0], g.Objects[2]
+	assert.True(t, b.TopLeft.Y > a.TopLeft.Y+a.Height)
+	assert.Equal(t, "(a -> b)[0]", sent.ID)
+	assert.Equal(t, 0, len(sent.Labels))
+	assert.Equal(t, 2, len(g.Edges))
+	for _, e := range g.Edges {
+		assert.True(t, e.AbsID() != "(a -> b)[0]")
+	}
+
+	opts.PreLayout = nil
+	opts.ConstraintEdges = []string{"(a -> d)[0]"}
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: constraint on unknown edge "(a -> d)[0]"`)
+}
+
+func TestRootAttributes(t *testing.T) {
+	t.Parallel()
+
+	options := func(script string, opts *ConfigurableOpts) map[string]interface{} {
+		return ExplainOptions(compileGraph(t, script), opts)["root"].(map[string]interface{})
+	}
+	root := options("vertical-gap: 120\nhorizontal-gap: 15\na -> b", &DefaultOpts)
+	assert.Equal(t, 120., root["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, "15", root["elk.spacing.nodeNode"])
+
+	// Across the direction, for layers lined up left to right
+	root = options("direction: right\ngrid-gap: 30\nhorizontal-gap: 90\na -> b", &DefaultOpts)
+	assert.Equal(t, 90., root["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, "30", root["elk.spacing.nodeNode"])
+
+	// Options set programmatically win
+	opts := DefaultOpts
+	opts.NodeSpacing = 40
+	root = options("vertical-gap: 120\na -> b", &opts)
+	assert.Equal(t, 40., root["spacing.nodeNodeBetweenLayers"])
+	opts.NodeSpacing = DefaultOpts.NodeSpacing
+	opts.Extra = map[string]string{"spacing.nodeNodeBetweenLayers": "40", "elk.spacing.nodeNode": "5"}
+	root = options("grid-gap: 200\na -> b", &opts)
+	assert.Equal(t, "40", root["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, "5", root["elk.spacing.nodeNode"])
+
+	gap := func(g *d2graph.Graph) float64 {
+		a, b := g.Objects[0], g.Objects[1]
+		return b.TopLeft.Y - (a.TopLeft.Y + a.Height)
+	}
+	assert.True(t, gap(layoutGraph(t, "vertical-gap: 200\na -> b", nil)) > gap(layoutGraph(t, "a -> b", nil)))
+
+	// Grids placed without ELK are spaced by them too
+	opts = DefaultOpts
+	opts.Columns = 2
+	g := layoutGraph(t, "grid-gap: 200\na; b", &opts)
+	a, b := g.Objects[0], g.Objects[1]
+	assert.Equal(t, 200., b.TopLeft.X-(a.TopLeft.X+a.Width))
+
+	// Gaps that don't parse are skipped rather than taken as 0
+	g = compileGraph(t, "a -> b")
+	g.Root.GridGap = &d2graph.Scalar{Value: "wide"}
+	merged := withRootAttributes(g, &DefaultOpts)
+	assert.Equal(t, DefaultOpts.NodeSpacing, merged.NodeSpacing)
+	_, ok := merged.Extra["elk.spacing.nodeNode"]
+	assert.False(t, ok)
+}
+
+func TestRouteCoordinateSpace(t *testing.T) {
+	t.Parallel()
+
+	script := `
+x: {
+  a -> b
+  y: {c}
+  a -> y.c
+  y -> y.c
+}
+x.b -> d
+`
+	absolute := layoutGraph(t, script, nil)
+	opts := DefaultOpts
+	opts.RouteCoordinateSpace = "container-relative"
+	relative := layoutGraph(t, script, &opts)
+
+	for i, e := range relative.Edges {
+		var dx, dy float64
+		if c := routeContainer(e); c != nil {
+			dx, dy = c.TopLeft.X, c.TopLeft.Y
+		}
+		want := absolute.Edges[i].Route
+		assert.Equal(t, len(want), len(e.Route))
+		for j, p := range e.Route {
+			assert.True(t, p.Equals(geo.NewPoint(want[j].X-dx, want[j].Y-dy)))
+		}
+	}
+	// Within x, within y for the edge into its child, and absolute across x as it's drawn on the root
+	assert.Equal(t, "x", routeContainer(relative.Edges[0]).AbsID())
+	assert.Equal(t, "x.y", routeContainer(relative.Edges[2]).AbsID())
+	assert.True(t, routeContainer(relative.Edges[3]) == nil)
+
+	opts.RouteCoordinateSpace = "parent"
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid route coordinate space "parent"`)
+}
+
+func TestAspectRatioBounds(t *testing.T) {
+	t.Parallel()
+
+	chain := "a -> b -> c -> d -> e -> f -> g -> h -> i -> j -> k -> l -> m -> n\n"
+	ratio := func(g *d2graph.Graph) float64 {
+		tl, br := boundingBox(g)
+		return (br.X - tl.X) / (br.Y - tl.Y)
+	}
+
+	wide := ratio(layoutGraph(t, "direction: right\n"+chain, nil))
+	assert.True(t, wide > 10)
+	opts := DefaultOpts
+	opts.MaxAspectRatio = 3
+	assert.True(t, ratio(layoutGraph(t, "direction: right\n"+chain, &opts)) <= 3)
+
+	assert.True(t, ratio(layoutGraph(t, chain, nil)) < 0.1)
+	opts = DefaultOpts
+	opts.MinAspectRatio, opts.MaxAspectRatio = 0.5, 2
+	tall := ratio(layoutGraph(t, chain, &opts))
+	assert.True(t, tall >= 0.5 && tall <= 2)
+
+	// Under the min, but wrapping a horizontal layout only makes it narrower, so it's left as it is
+	opts = DefaultOpts
+	opts.MinAspectRatio = 50
+	assert.Equal(t, wide, ratio(layoutGraph(t, "direction: right\n"+chain, &opts)))
+
+	opts = DefaultOpts
+	opts.MinAspectRatio, opts.MaxAspectRatio = 2, 1
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: min aspect ratio must not be over max aspect ratio, got 2 and 1`)
+	opts.MinAspectRatio = -1
+	err = Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: min aspect ratio must not be negative, got -1`)
+}
+
+func TestEndpointSides(t *testing.T) {
+	t.Parallel()
+
+	script := `direction: right
+a -> b: {target-arrowhead.class: elk-port-north}
+a -> c: {source-arrowhead.class: elk-port-South}
+x: {y}
+a -> x: {target-arrowhead.class: elk-port-north}
+`
+	elkGraph := BuildELKGraph(compileGraph(t, script), nil)
+	b := elkGraph.Children[1]
+	assert.Equal(t, "FIXED_SIDE", b.LayoutOptions.PortConstraints)
+	assert.Equal(t, 1, len(b.Ports))
+	assert.Equal(t, "NORTH", b.Ports[0].LayoutOptions.PortSide)
+	assert.Equal(t, "(a -> b)[0].dst", elkGraph.Edges[0].Targets[0])
+	assert.Equal(t, "SOUTH", elkGraph.Children[0].Ports[0].LayoutOptions.PortSide)
+	// Containers aren't given ports
+	assert.Equal(t, "x", elkGraph.Edges[2].Targets[0])
+
+	// Classes without the prefix are only for styling
+	elkGraph = BuildELKGraph(compileGraph(t, "a -> b: {target-arrowhead.class: north}"), nil)
+	assert.Equal(t, 0, len(elkGraph.Children[1].Ports))
+	assert.Equal(t, "b", elkGraph.Edges[0].Targets[0])
+
+	onTop := func(g *d2graph.Graph, i int) {
+		e := g.Edges[i]
+		end := e.Route[len(e.Route)-1]
+		assert.True(t, geo.PrecisionCompare(end.Y, e.Dst.TopLeft.Y, 1) == 0)
+		assert.True(t, end.X > e.Dst.TopLeft.X && end.X < e.Dst.TopLeft.X+e.Dst.Width)
+	}
+	g := layoutGraph(t, script, nil)
+	// Into b from above, though the layout runs left to right
+	onTop(g, 0)
+	start := g.Edges[1].Route[0]
+	assert.True(t, geo.PrecisionCompare(start.Y, g.Edges[1].Src.TopLeft.Y+g.Edges[1].Src.Height, 1) == 0)
+
+	opts := DefaultOpts
+	opts.OrderedPorts = true
+	onTop(layoutGraph(t, script, &opts), 0)
+}
+
+func TestLeafIconSide(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a: a rather long label {
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+}
+b: b {
+  shape: circle
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+}
+# Too narrow as declared for both side by side
+c: another long label {
+  width: 100
+  icon: https://icons.terrastruct.com/essentials/004-picture.svg
+}
+a -> b -> c
+`
+	opts := DefaultOpts
+	opts.LeafIconSide = "left"
+	g := layoutGraph(t, script, &opts)
+	for _, obj := range g.Objects {
+		assert.Equal(t, string(label.InsideMiddleLeft), *obj.IconPosition)
+		assert.Equal(t, string(label.InsideMiddleRight), *obj.LabelPosition)
+
+		// Where the renderer draws them
+		inner := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[obj.Shape.Value], obj.Box).GetInnerBox()
+		iconSize := float64(d2target.GetIconSize(inner, *obj.IconPosition))
+		icon := geo.NewBox(label.InsideMiddleLeft.GetPointOnBox(inner, label.PADDING, iconSize, iconSize), iconSize, iconSize)
+		width, height := float64(obj.LabelDimensions.Width), float64(obj.LabelDimensions.Height)
+		lbl := geo.NewBox(label.InsideMiddleRight.GetPointOnBox(inner, label.PADDING, width, height), width, height)
+		assert.True(t, icon.TopLeft.X+icon.Width < lbl.TopLeft.X)
+		for _, b := range []*geo.Box{icon, lbl} {
+			assert.True(t, b.TopLeft.X >= inner.TopLeft.X && b.TopLeft.X+b.Width <= inner.TopLeft.X+inner.Width)
+			assert.True(t, b.TopLeft.Y >= inner.TopLeft.Y && b.TopLeft.Y+b.Height <= inner.TopLeft.Y+inner.Height)
+		}
+	}
+
+	// Labels over icons by default
+	g = layoutGraph(t, script, nil)
+	assert.Equal(t, string(label.InsideMiddleCenter), *g.Objects[0].IconPosition)
+	assert.Equal(t, string(label.InsideTopCenter), *g.Objects[0].LabelPosition)
+
+	opts.LeafIconSide = "top"
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid leaf icon side "top"`)
+}
+
+func TestKeepELKEndpoints(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a
+b
+c
+d: {shape: circle}
+a -> d
+b -> d
+c -> d
+`
+	ends := func(opts *ConfigurableOpts) (elk, routes []geo.Point) {
+		g := compileGraph(t, script)
+		elkGraph, _, err := layout(context.Background(), nil, g, opts)
+		assert.Success(t, err)
+		for i, e := range elkGraph.Edges {
+			sections := e.Sections
+			route := g.Edges[i].Route
+			elk = append(elk, geo.Point(sections[0].Start), geo.Point(sections[len(sections)-1].End))
+			routes = append(routes, *route[0], *route[len(route)-1])
+		}
+		return elk, routes
+	}
+
+	// Edges entering the circle off its center are traced on from its bounding box
+	elk, traced := ends(&DefaultOpts)
+	moved := 0
+	for i := range elk {
+		if !traced[i].Equals(&elk[i]) {
+			moved++
+		}
+	}
+	assert.True(t, moved > 0)
+
+	opts := DefaultOpts
+	opts.KeepELKEndpoints = true
+	elk, untraced := ends(&opts)
+	for i := range elk {
+		assert.Equal(t, elk[i], untraced[i])
+	}
+}
+
+func TestUniformNodeSize(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a
+b: a much longer label
+c: {shape: circle}
+x: {
+  d
+}
+a -> b -> c -> x.d
+`
+	opts := DefaultOpts
+	opts.UniformNodeSize = geo.NewPoint(150, 80)
+	g := layoutGraph(t, script, &opts)
+	for _, obj := range g.Objects {
+		if len(obj.ChildrenArray) > 0 {
+			continue
+		}
+		assert.True(t, obj.Width >= 150)
+		assert.True(t, obj.Height >= 80)
+	}
+	// Larger nodes keep their size
+	b := g.Objects[1]
+	assert.Equal(t, layoutGraph(t, script, nil).Objects[1].Width, b.Width)
+	c := g.Objects[2]
+	assert.Equal(t, c.Width, c.Height)
+
+	opts.UniformNodeSize = geo.NewPoint(-1, 10)
+	err := Layout(context.Background(), compileGraph(t, `a`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: uniform node size must not be negative, got -1x10`)
+}
+
+func TestOutsideLabelObstacles(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, "x -> y\na")
+	x, y, a := g.Objects[0], g.Objects[1], g.Objects[2]
+	x.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 200)
+	y.Box = geo.NewBox(geo.NewPoint(300, 100), 100, 100)
+	// Clear of either leg of the S out of x, but its label below reaches down across where bend deletion would go
+	a.Box = geo.NewBox(geo.NewPoint(110, 60), 40, 40)
+	a.LabelDimensions = d2target.TextDimensions{Width: 40, Height: 60}
+	a.LabelPosition = go2.Pointer(string(label.OutsideBottomCenter))
+	route := []*geo.Point{
+		geo.NewPoint(100, 20),
+		geo.NewPoint(160, 20),
+		geo.NewPoint(160, 150),
+		geo.NewPoint(300, 150),
+	}
+	e := g.Edges[0]
+
+	straight := *geo.NewSegment(geo.NewPoint(100, 150), geo.NewPoint(300, 150))
+	idx := newCollisionIndex(g)
+	assert.Equal(t, 1, countObjectIntersects(g, x, y, straight))
+	assert.Equal(t, 1, idx.countObjectIntersects(x, y, straight))
+
+	e.Route = append([]*geo.Point{}, route...)
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, 4, len(e.Route))
+
+	// Inside, the label's no obstacle
+	a.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+	assert.Equal(t, 0, countObjectIntersects(g, x, y, straight))
+	e.Route = append([]*geo.Point{}, route...)
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, 2, len(e.Route))
+}
+
+func TestLayoutN(t *testing.T) {
+	t.Parallel()
+
+	scripts := make([]string, 20)
+	graphs := make([]*d2graph.Graph, len(scripts))
+	for i := range scripts {
+		nodes := make([]string, 1+i%5)
+		for j := range nodes {
+			nodes[j] = fmt.Sprintf("n%d", j)
+		}
+		scripts[i] = fmt.Sprintf("x: {%s}\ny -> z", strings.Join(nodes, " -> "))
+		graphs[i] = compileGraph(t, scripts[i])
+	}
+	// One that fails the options, without stopping the rest
+	graphs[7] = compileGraph(t, "a -> b")
+	opts := DefaultOpts
+	opts.ContainerAlgorithms = map[string]string{"x": "layered"}
+
+	errs := LayoutN(context.Background(), graphs, &opts)
+	assert.Equal(t, len(graphs), len(errs))
+	for i, g := range graphs {
+		if i == 7 {
+			assert.ErrorString(t, errs[i], `failed to ELK layout: algorithm on unknown object "x"`)
+			continue
+		}
+		assert.Success(t, errs[i])
+		exp := layoutGraph(t, scripts[i], &opts)
+		for j, obj := range g.Objects {
+			assert.True(t, exp.Objects[j].TopLeft.Equals(obj.TopLeft))
+		}
+		for j, edge := range g.Edges {
+			assert.Equal(t, len(exp.Edges[j].Route), len(edge.Route))
+		}
+	}
+}
+
+func BenchmarkLayoutN(b *testing.B) {
+	graphs := func() []*d2graph.Graph {
+		graphs := make([]*d2graph.Graph, 20)
+		for i := range graphs {
+			graphs[i] = compileGraph(b, benchmarkScript)
+		}
+		return graphs
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			e, err := NewEngine()
+			assert.Success(b, err)
+			for _, g := range graphs() {
+				assert.Success(b, e.Layout(context.Background(), g, nil))
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, err := range LayoutN(context.Background(), graphs(), nil) {
+				assert.Success(b, err)
+			}
+		}
+	})
+}
+
+func TestAvoidCrossings(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, "p -> q\nl -> r")
+	p, q, l, r := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3]
+	p.Box = geo.NewBox(geo.NewPoint(200, 0), 100, 50)
+	q.Box = geo.NewBox(geo.NewPoint(200, 300), 100, 50)
+	l.Box = geo.NewBox(geo.NewPoint(0, 200), 50, 50)
+	r.Box = geo.NewBox(geo.NewPoint(450, 200), 50, 50)
+	down, across := g.Edges[0], g.Edges[1]
+	down.Route = []*geo.Point{geo.NewPoint(250, 50), geo.NewPoint(250, 300)}
+	across.Route = []*geo.Point{geo.NewPoint(50, 225), geo.NewPoint(450, 225)}
+	assert.Equal(t, 1, CountCrossings(g))
+
+	// Across passes above q, so it goes around below it instead
+	uncross(g, nil, &DefaultOpts)
+	assert.Equal(t, 0, CountCrossings(g))
+	assert.Equal(t, 2, len(down.Route))
+	below := false
+	for _, pt := range across.Route {
+		below = below || pt.Y > q.TopLeft.Y+q.Height
+	}
+	assert.True(t, below)
+	assert.Equal(t, 0, countCollisions(g, nil, across, across.Route))
+
+	// Unless it would run into something there
+	g.Objects = append(g.Objects, compileGraph(t, "o").Objects[0])
+	g.Objects[4].Box = geo.NewBox(geo.NewPoint(150, 360), 200, 40)
+	across.Route = []*geo.Point{geo.NewPoint(50, 225), geo.NewPoint(450, 225)}
+	uncross(g, nil, &DefaultOpts)
+	assert.Equal(t, 1, CountCrossings(g))
+
+	opts := DefaultOpts
+	opts.AvoidCrossings = true
+	g = compileGraph(t, "a -> b\na -> c\nd -> b\nd -> c")
+	stats, err := LayoutWithStats(context.Background(), g, &opts)
+	assert.Success(t, err)
+	assert.Equal(t, CountCrossings(g), *stats.Crossings)
+	stats, err = LayoutWithStats(context.Background(), compileGraph(t, "a -> b"), nil)
+	assert.Success(t, err)
+	assert.True(t, stats.Crossings == nil)
+}
+
+func TestCenterChildren(t *testing.T) {
+	t.Parallel()
+
+	gaps := func(obj *d2graph.Object) (left, right float64) {
+		left, right = math.Inf(1), math.Inf(1)
+		for _, ch := range obj.ChildrenArray {
+			left = math.Min(left, ch.TopLeft.X-obj.TopLeft.X)
+			right = math.Min(right, obj.TopLeft.X+obj.Width-(ch.TopLeft.X+ch.Width))
+		}
+		return left, right
+	}
+	script := `direction: right
+x: {
+  width: 600
+  height: 400
+  a -> b
+}
+x -> c
+`
+	// Box packing leaves them at the left
+	opts := DefaultOpts
+	opts.ContainerAlgorithms = map[string]string{"x": "box"}
+	left, right := gaps(layoutGraph(t, script, &opts).Objects[0])
+	assert.True(t, right > left+100)
+
+	opts.CenterChildren = true
+	left, right = gaps(layoutGraph(t, script, &opts).Objects[0])
+	assert.True(t, math.Abs(left-right) < 1)
+
+	// Routes out of the container are routed again off the moved child
+	g := compileGraph(t, "x: {a}\nx.a -> b")
+	x, a, b := g.Objects[0], g.Objects[1], g.Objects[2]
+	x.Box = geo.NewBox(geo.NewPoint(0, 0), 400, 200)
+	a.Box = geo.NewBox(geo.NewPoint(50, 80), 60, 40)
+	b.Box = geo.NewBox(geo.NewPoint(500, 80), 60, 40)
+	e := g.Edges[0]
+	e.Route = []*geo.Point{geo.NewPoint(110, 100), geo.NewPoint(500, 100)}
+	centerChildren(g, nil, nil, &DefaultOpts)
+	assert.Equal(t, 170., a.TopLeft.X)
+	assert.True(t, e.Route[0].Equals(geo.NewPoint(230, 100)))
+	assert.True(t, e.Route[len(e.Route)-1].Equals(geo.NewPoint(500, 100)))
+}
+
+func TestZigZag(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, "x -> y\na\nb\nc")
+	x, y, a, b, c := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3], g.Objects[4]
+	x.Box = geo.NewBox(geo.NewPoint(0, 0), 100, 100)
+	y.Box = geo.NewBox(geo.NewPoint(1000, 0), 100, 100)
+	// Keep the ladder steps at either end of the zig-zag from being taken
+	a.Box = geo.NewBox(geo.NewPoint(150, 260), 100, 80)
+	b.Box = geo.NewBox(geo.NewPoint(800, 260), 100, 80)
+	c.Box = geo.NewBox(geo.NewPoint(450, 500), 100, 100)
+	// Under x and y, the run between them steps off its line and back onto it
+	route := []*geo.Point{
+		geo.NewPoint(50, 100),
+		geo.NewPoint(50, 200),
+		geo.NewPoint(400, 200),
+		geo.NewPoint(400, 300),
+		geo.NewPoint(600, 300),
+		geo.NewPoint(600, 200),
+		geo.NewPoint(1050, 200),
+		geo.NewPoint(1050, 100),
+	}
+	e := g.Edges[0]
+
+	e.Route = append([]*geo.Point{}, route...)
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, 4, len(e.Route))
+	assert.Equal(t, *geo.NewPoint(50, 200), *e.Route[1])
+	assert.Equal(t, *geo.NewPoint(1050, 200), *e.Route[2])
+
+	// In the way of the straight run, the zig-zag stays
+	c.Box = geo.NewBox(geo.NewPoint(450, 150), 100, 100)
+	e.Route = append([]*geo.Point{}, route...)
+	deleteBends(g, newCollisionIndex(g))
+	assert.Equal(t, len(route), len(e.Route))
+}
+
+func TestSelfLoopSides(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> a
+a -> a
+a -> a
+a -> a
+`
+	// innermost is how far out the innermost self-loop goes past each side of a
+	innermost := func(g *d2graph.Graph) map[string]float64 {
+		a := g.Objects[0]
+		distances := make(map[string]float64)
+		add := func(side string, d float64) {
+			if d > 0 && (distances[side] == 0 || d < distances[side]) {
+				distances[side] = d
+			}
+		}
+		for _, e := range g.Edges {
+			for _, p := range e.Route[1 : len(e.Route)-1] {
+				add("top", a.TopLeft.Y-p.Y)
+				add("right", p.X-(a.TopLeft.X+a.Width))
+				add("bottom", p.Y-(a.TopLeft.Y+a.Height))
+				add("left", a.TopLeft.X-p.X)
+			}
+		}
+		return distances
+	}
+	assert.Equal(t, 4, len(innermost(layoutGraph(t, script, nil))))
+
+	opts := DefaultOpts
+	opts.SelfLoopSides = &SelfLoopSides{Top: 10, Right: 40, Bottom: 70}
+	unset := innermost(layoutGraph(t, script, nil))["left"]
+	g := layoutGraph(t, script, &opts)
+	distances := innermost(g)
+	assert.Equal(t, 10., distances["top"])
+	assert.Equal(t, 40., distances["right"])
+	assert.Equal(t, 70., distances["bottom"])
+	assert.Equal(t, unset, distances["left"])
+	// Still orthogonal
+	for _, e := range g.Edges {
+		for i := 1; i < len(e.Route); i++ {
+			assert.True(t, sameCoordinate(e.Route[i-1].X, e.Route[i].X) || sameCoordinate(e.Route[i-1].Y, e.Route[i].Y))
+		}
+	}
+
+	opts.SelfLoopSides = &SelfLoopSides{Left: -5}
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: self-loop sides must not be negative, got {Top:0 Right:0 Bottom:0 Left:-5}`)
+}
+
+func TestWaypoints(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+`
+	base := layoutGraph(t, script, nil)
+	a, b := base.Objects[0], base.Objects[1]
+	// Out past the right of both, then back in under b
+	right := math.Max(a.TopLeft.X+a.Width, b.TopLeft.X+b.Width) + 100
+	waypoints := []geo.Point{
+		{X: right, Y: a.Box.Center().Y},
+		{X: right, Y: b.TopLeft.Y + b.Height + 50},
+	}
+
+	opts := DefaultOpts
+	opts.Waypoints = map[string][]geo.Point{"(a -> b)[0]": waypoints}
+	g := layoutGraph(t, script, &opts)
+	e := g.Edges[0]
+	next := 0
+	for _, p := range e.Route {
+		if next < len(waypoints) && sameCoordinate(p.X, waypoints[next].X) && sameCoordinate(p.Y, waypoints[next].Y) {
+			next++
+		}
+	}
+	assert.Equal(t, len(waypoints), next)
+	// Orthogonal throughout, from border to border
+	for i := 1; i < len(e.Route); i++ {
+		assert.True(t, sameCoordinate(e.Route[i-1].X, e.Route[i].X) || sameCoordinate(e.Route[i-1].Y, e.Route[i].Y))
+	}
+	first, last := e.Route[0], e.Route[len(e.Route)-1]
+	assert.True(t, sameCoordinate(first.X, g.Objects[0].TopLeft.X+g.Objects[0].Width))
+	assert.True(t, sameCoordinate(last.Y, g.Objects[1].TopLeft.Y+g.Objects[1].Height))
+
+	opts.Waypoints = map[string][]geo.Point{"(a -> d)[0]": waypoints}
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: waypoints on unknown edge "(a -> d)[0]"`)
+}
+
+func TestMaxDimensions(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> d -> e
+a -> f -> g
+x -> y
+`
+	full := contentBounds(layoutGraph(t, script, nil))
+
+	opts := DefaultOpts
+	opts.MaxDimensions = geo.NewPoint(200, 150)
+	g := layoutGraph(t, script, &opts)
+	bounds := contentBounds(g)
+	assert.True(t, bounds.Width <= 200+geo.PRECISION)
+	assert.True(t, bounds.Height <= 150+geo.PRECISION)
+	// Scaled uniformly, filling one of the two
+	assert.True(t, math.Abs(bounds.Width/bounds.Height-full.Width/full.Height) < 0.01)
+	assert.True(t, sameCoordinate(bounds.Width, 200) || sameCoordinate(bounds.Height, 150))
+	for _, e := range g.Edges {
+		for i := 1; i < len(e.Route); i++ {
+			assert.True(t, sameCoordinate(e.Route[i-1].X, e.Route[i].X) || sameCoordinate(e.Route[i-1].Y, e.Route[i].Y))
+		}
+	}
+
+	// Never scaled up
+	opts.MaxDimensions = geo.NewPoint(full.Width*10, 0)
+	bounds = contentBounds(layoutGraph(t, script, &opts))
+	assert.Equal(t, full.Width, bounds.Width)
+	assert.Equal(t, full.Height, bounds.Height)
+
+	opts.MaxDimensions = geo.NewPoint(-1, 10)
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: max dimensions must not be negative, got -1x10`)
+}
+
+func TestRootPadding(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+x: {
+  y
+}
+`
+	opts := DefaultOpts
+	opts.RootPadding = "[top=100,left=70,bottom=100,right=70]"
+	tl, _ := boundingBox(layoutGraph(t, script, &opts))
+	assert.Equal(t, 70., tl.X)
+	assert.Equal(t, 100., tl.Y)
+
+	// By ELK's default
+	tl, _ = boundingBox(layoutGraph(t, script, nil))
+	assert.Equal(t, 12., tl.X)
+	assert.Equal(t, 12., tl.Y)
+
+	// With or without ELK
+	tl, _ = boundingBox(layoutGraph(t, "a", &opts))
+	assert.Equal(t, 70., tl.X)
+	assert.Equal(t, 100., tl.Y)
+	opts.Columns = 2
+	tl, _ = boundingBox(layoutGraph(t, "a\nb\nc", &opts))
+	assert.Equal(t, 70., tl.X)
+	assert.Equal(t, 100., tl.Y)
+
+	opts.RootPadding = "100"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid root padding "100"`)
+}
+
+func TestMergeBidirectional(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+b -> a
+b -> c
+c -> b: back
+a -> c
+`
+	opts := DefaultOpts
+	opts.MergeBidirectional = true
+	g := layoutGraph(t, script, &opts)
+	assert.Equal(t, 4, len(g.Edges))
+	e := g.Edges[0]
+	assert.Equal(t, "(a <-> b)[0]", e.AbsID())
+	assert.True(t, e.SrcArrow && e.DstArrow)
+	assert.Equal(t, "a", e.Src.ID)
+	assert.Equal(t, "b", e.Dst.ID)
+	assert.True(t, len(e.Route) >= 2)
+	// Labeled, so kept apart
+	assert.Equal(t, "(b -> c)[0]", g.Edges[1].AbsID())
+	assert.Equal(t, "(c -> b)[0]", g.Edges[2].AbsID())
+
+	assert.Equal(t, 5, len(layoutGraph(t, script, nil).Edges))
+
+	// Numbered past the edges already both ways
+	g = layoutGraph(t, "a <-> b\na -> b\nb -> a", &opts)
+	assert.Equal(t, 2, len(g.Edges))
+	assert.Equal(t, "(a <-> b)[0]", g.Edges[0].AbsID())
+	assert.Equal(t, "(a <-> b)[1]", g.Edges[1].AbsID())
+
+	// Styled differently, so kept apart
+	g = layoutGraph(t, "a -> b\nb -> a: {style.stroke: red}\nc -> d: {class: x}\nd -> c", &opts)
+	assert.Equal(t, 4, len(g.Edges))
+	assert.Equal(t, "(b -> a)[0]", g.Edges[1].AbsID())
+	assert.Equal(t, "red", g.Edges[1].Style.Stroke.Value)
+	assert.Equal(t, "(c -> d)[0]", g.Edges[2].AbsID())
+	assert.Equal(t, "(d -> c)[0]", g.Edges[3].AbsID())
+
+	// Keeps its index when it's free
+	g = layoutGraph(t, "a -> b: one\na -> b\nb -> a", &opts)
+	assert.Equal(t, 2, len(g.Edges))
+	assert.Equal(t, "(a -> b)[0]", g.Edges[0].AbsID())
+	assert.Equal(t, "(a <-> b)[1]", g.Edges[1].AbsID())
+}
+
+func TestDiagnose(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+x: {
+  c -> d
+}
+`
+	stats, err := LayoutWithStats(context.Background(), compileGraph(t, script), nil)
+	assert.Success(t, err)
+	assert.True(t, stats.Diagnostics == nil)
+
+	opts := DefaultOpts
+	opts.Diagnose = true
+	opts.NodeSpacing = 90
+	stats, err = LayoutWithStats(context.Background(), compileGraph(t, script), &opts)
+	assert.Success(t, err)
+	d := stats.Diagnostics
+	assert.True(t, d != nil)
+	assert.True(t, d.Duration > 0)
+	assert.Equal(t, ELKVersion, d.ELKVersion)
+	assert.Equal(t, 5, d.Objects)
+	assert.Equal(t, 2, d.Edges)
+	assert.Equal(t, 90., d.Options["spacing.nodeNodeBetweenLayers"])
+	assert.Equal(t, "layered", d.Options["elk.algorithm"])
+
+	raw, err := json.Marshal(stats)
+	assert.Success(t, err)
+	var bundle struct {
+		Diagnostics map[string]interface{} `json:"diagnostics"`
+	}
+	assert.Success(t, json.Unmarshal(raw, &bundle))
+	for _, field := range []string{"duration", "elkVersion", "objects", "edges", "options"} {
+		_, ok := bundle.Diagnostics[field]
+		assert.True(t, ok)
+	}
+}
+
+func TestPortSections(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, `direction: right
+a -> b: {target-arrowhead.class: elk-port-north}
+a -> c: {source-arrowhead.class: elk-port-south}
+`)
+	elkGraph, _, err := layout(context.Background(), nil, g, nil)
+	assert.Success(t, err)
+	port := func(id string) geo.Point {
+		for _, n := range elkGraph.Children {
+			for _, p := range n.Ports {
+				if p.ID == id {
+					return geo.Point{X: n.X + p.X, Y: n.Y + p.Y}
+				}
+			}
+		}
+		t.Fatalf("no port %#v", id)
+		return geo.Point{}
+	}
+	for _, e := range elkGraph.Edges {
+		assert.Equal(t, 1, len(e.Sections))
+	}
+	assert.Equal(t, "(a -> b)[0].dst", elkGraph.Edges[0].Sections[0].OutgoingShape)
+	assert.Equal(t, "(a -> c)[0].src", elkGraph.Edges[1].Sections[0].IncomingShape)
+
+	ab, ac := g.Edges[0], g.Edges[1]
+	assert.Equal(t, port("(a -> b)[0].dst"), *ab.Route[len(ab.Route)-1])
+	assert.Equal(t, port("(a -> c)[0].src"), *ac.Route[0])
+
+	// Chained from the first section, whichever order they're listed in
+	e := &ELKEdge{Sections: []ELKEdgeSection{
+		{ID: "s1", Start: ELKPoint{X: 50}, End: ELKPoint{X: 100}, IncomingSections: []string{"s0"}},
+		{ID: "s0", Start: ELKPoint{X: 0}, End: ELKPoint{X: 50}, OutgoingSections: []string{"s1"}},
+	}}
+	ordered := orderSections(e)
+	assert.Equal(t, "s0", ordered[0].ID)
+	assert.Equal(t, "s1", ordered[1].ID)
+}
+
+func TestEdgeLabelClearance(t *testing.T) {
+	t.Parallel()
+
+	g := compileGraph(t, "a -> b: a long label\nc -> d")
+	a, b, c, d := g.Objects[0], g.Objects[1], g.Objects[2], g.Objects[3]
+	a.Box = geo.NewBox(geo.NewPoint(0, 0), 60, 50)
+	b.Box = geo.NewBox(geo.NewPoint(0, 300), 60, 50)
+	c.Box = geo.NewBox(geo.NewPoint(80, 0), 60, 50)
+	d.Box = geo.NewBox(geo.NewPoint(80, 300), 60, 50)
+	// Running parallel close enough for the label in the middle of one to reach over the other
+	labeled, other := g.Edges[0], g.Edges[1]
+	labeled.Route = []*geo.Point{geo.NewPoint(30, 50), geo.NewPoint(30, 300)}
+	other.Route = []*geo.Point{geo.NewPoint(110, 50), geo.NewPoint(110, 300)}
+	labeled.LabelPosition = go2.Pointer(string(label.InsideMiddleCenter))
+	labeled.LabelDimensions = d2target.TextDimensions{Width: 140, Height: 20}
+
+	otherSegment := *geo.NewSegment(other.Route[0], other.Route[1])
+	assert.True(t, segmentWithin(edgeLabelBox(labeled, labelPercentage(labeled)), otherSegment, 20))
+	clearEdgeLabels(g, 20, 0)
+	assert.True(t, *labeled.LabelPosition != string(label.InsideMiddleCenter))
+	box := edgeLabelBox(labeled, labelPercentage(labeled))
+	assert.False(t, segmentWithin(box, otherSegment, 20))
+	// Beside its own edge, on the side away from the other
+	assert.True(t, box.TopLeft.X+box.Width < 30)
+
+	opts := DefaultOpts
+	opts.EdgeLabelClearance = -1
+	err := Layout(context.Background(), compileGraph(t, "a -> b"), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: edge label clearance must not be negative, got -1`)
+}
+
+func TestPostCompaction(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> d
+a -> e
+x -> y
+x -> z
+z -> d
+`
+	explanation := ExplainOptions(compileGraph(t, script), nil)
+	_, ok := explanation["root"].(map[string]interface{})["elk.layered.compaction.postCompaction.strategy"]
+	assert.False(t, ok)
+
+	opts := DefaultOpts
+	opts.PostCompaction = "LEFT"
+	explanation = ExplainOptions(compileGraph(t, script), &opts)
+	assert.Equal(t, "LEFT", explanation["root"].(map[string]interface{})["elk.layered.compaction.postCompaction.strategy"])
+
+	area := func(g *d2graph.Graph) float64 {
+		bounds := contentBounds(g)
+		return bounds.Width * bounds.Height
+	}
+	assert.True(t, area(layoutGraph(t, script, &opts)) < area(layoutGraph(t, script, nil)))
+
+	opts.PostCompaction = "UP"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid post-compaction strategy "UP"`)
+}
+
+func TestOrphanCorner(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+o1
+b -> c
+o2
+c -> d
+a -> e
+o3
+`
+	split := func(g *d2graph.Graph) (flow, orphans []*d2graph.Object) {
+		for _, obj := range g.Objects {
+			if strings.HasPrefix(obj.ID, "o") {
+				orphans = append(orphans, obj)
+			} else {
+				flow = append(flow, obj)
+			}
+		}
+		return flow, orphans
+	}
+
+	opts := DefaultOpts
+	opts.OrphanCorner = "top-right"
+	flow, orphans := split(layoutGraph(t, script, &opts))
+	assert.Equal(t, 3, len(orphans))
+	right, top := math.Inf(-1), math.Inf(1)
+	for _, obj := range flow {
+		right = math.Max(right, obj.TopLeft.X+obj.Width)
+		top = math.Min(top, obj.TopLeft.Y)
+	}
+	orphanTop := math.Inf(1)
+	for _, obj := range orphans {
+		assert.True(t, obj.TopLeft.X >= right+float64(opts.NodeSpacing))
+		orphanTop = math.Min(orphanTop, obj.TopLeft.Y)
+		assert.Equal(t, string(label.InsideMiddleCenter), *obj.LabelPosition)
+	}
+	assert.Equal(t, top, orphanTop)
+	// In a two by two grid
+	rows := make(map[float64]bool)
+	for _, obj := range orphans {
+		rows[obj.TopLeft.Y] = true
+	}
+	assert.Equal(t, 2, len(rows))
+
+	opts.OrphanCorner = "bottom-left"
+	flow, orphans = split(layoutGraph(t, script, &opts))
+	left := math.Inf(1)
+	for _, obj := range flow {
+		left = math.Min(left, obj.TopLeft.X)
+	}
+	for _, obj := range orphans {
+		assert.True(t, obj.TopLeft.X+obj.Width <= left-float64(opts.NodeSpacing))
+	}
+
+	opts.OrphanCorner = "middle"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid orphan corner "middle"`)
+}
+
+func TestContainerDirection(t *testing.T) {
+	t.Parallel()
+
+	// x flows right within a diagram flowing down, p fanning out to q, r and s
+	script := `
+a -> x.p
+x: {
+  direction: right
+  p -> q
+  p -> r
+  p -> s
+}
+x.r -> b
+`
+	g := compileGraph(t, script)
+	elkGraph := BuildELKGraph(g, &DefaultOpts)
+	assert.Equal(t, "DOWN", elkGraph.LayoutOptions.Direction)
+	x := elkGraph.Children[1]
+	assert.Equal(t, "x", x.ID)
+	assert.Equal(t, "RIGHT", x.LayoutOptions.Direction)
+	// p's 3 outgoing edges leave on its right side, so it's grown in height, not width
+	p := x.Children[0]
+	assert.Equal(t, "x.p", p.ID)
+	assert.Equal(t, 3*port_spacing, p.Height)
+	assert.True(t, p.Width < 3*port_spacing)
+
+	g = layoutGraph(t, script, nil)
+	objects := make(map[string]*d2graph.Object)
+	for _, obj := range g.Objects {
+		objects[obj.AbsID()] = obj
+	}
+	// The root still flows down
+	assert.True(t, objects["a"].TopLeft.Y+objects["a"].Height <= objects["x"].TopLeft.Y)
+	assert.True(t, objects["x"].TopLeft.Y+objects["x"].Height <= objects["b"].TopLeft.Y)
+	for _, id := range []string{"x.q", "x.r", "x.s"} {
+		assert.True(t, objects["x.p"].TopLeft.X+objects["x.p"].Width < objects[id].TopLeft.X)
+	}
+	for _, e := range g.Edges {
+		if e.Src.AbsID() != "x.p" {
+			continue
+		}
+		// Inner edges leave p rightward, spread over its right side
+		assert.Equal(t, objects["x.p"].TopLeft.X+objects["x.p"].Width, e.Route[0].X)
+		assert.True(t, e.Route[len(e.Route)-1].X > e.Route[0].X)
+	}
+	// Edges into x are routed on to their endpoints
+	end := g.Edges[0].Route[len(g.Edges[0].Route)-1]
+	assert.Equal(t, objects["x.p"].TopLeft.Y, end.Y)
+	assert.True(t, end.X > objects["x.p"].TopLeft.X && end.X < objects["x.p"].TopLeft.X+objects["x.p"].Width)
+}
+
+func TestLayoutObjective(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b
+a -> c
+a -> d
+b -> e
+c -> e
+d -> f
+e -> g
+f -> g
+a -> g
+b -> f
+`
+	edgeLength := func(objective string) float64 {
+		opts := DefaultOpts
+		opts.LayoutObjective = objective
+		length := 0.
+		for _, e := range layoutGraph(t, script, &opts).Edges {
+			length += geo.Route(e.Route).Length()
+		}
+		return length
+	}
+	assert.True(t, edgeLength("short-edges") < edgeLength("readable"))
+
+	opts := DefaultOpts
+	opts.LayoutObjective = "short-edges"
+	elkGraph := BuildELKGraph(compileGraph(t, script), &opts)
+	assert.Equal(t, "NETWORK_SIMPLEX", elkGraph.LayoutOptions.NodePlacement)
+	assert.Equal(t, "EDGE_LENGTH", elkGraph.LayoutOptions.PostCompaction)
+	assert.Equal(t, DefaultOpts.NodeSpacing/2, elkGraph.LayoutOptions.NodeSpacing)
+	assert.Equal(t, shortEdgesPriority, elkGraph.Edges[0].LayoutOptions.StraightnessPriority)
+
+	opts.LayoutObjective = "pretty"
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid layout objective "pretty"`)
+}
+
+func TestSquareToSide(t *testing.T) {
+	t.Parallel()
+
+	// The ends of routes through ports run square into the ports' sides
+	g := layoutGraph(t, `direction: right
+a -> b: {target-arrowhead.class: elk-port-north}
+a -> c: {source-arrowhead.class: elk-port-south}
+a -> d: {target-arrowhead.class: elk-port-west}
+`, nil)
+	for _, c := range []struct {
+		from, to *geo.Point
+		dx, dy   float64
+	}{
+		{g.Edges[0].Route[len(g.Edges[0].Route)-2], g.Edges[0].Route[len(g.Edges[0].Route)-1], 0, 1},
+		{g.Edges[1].Route[1], g.Edges[1].Route[0], 0, -1},
+		{g.Edges[2].Route[len(g.Edges[2].Route)-2], g.Edges[2].Route[len(g.Edges[2].Route)-1], 1, 0},
+	} {
+		v := c.from.VectorTo(c.to).Unit()
+		assert.Equal(t, c.dx, math.Round(v[0]))
+		assert.Equal(t, c.dy, math.Round(v[1]))
+		assert.True(t, sameCoordinate(v[0]*c.dx+v[1]*c.dy, 1))
+	}
+
+	// Slightly off the port, the bend before the end slides along the segment into it
+	route := squareToSide([]*geo.Point{geo.NewPoint(0, 0), geo.NewPoint(100, 0), geo.NewPoint(103, 50)}, "NORTH")
+	assert.Equal(t, 3, len(route))
+	assert.Equal(t, *geo.NewPoint(103, 0), *route[1])
+	// Arriving diagonally, it turns in
+	route = squareToSide([]*geo.Point{geo.NewPoint(0, 0), geo.NewPoint(50, 50)}, "WEST")
+	assert.Equal(t, 3, len(route))
+	assert.Equal(t, *geo.NewPoint(0, 50), *route[1])
+	// From behind the side, it's led out first
+	route = squareToSide([]*geo.Point{geo.NewPoint(0, 100), geo.NewPoint(50, 50)}, "NORTH")
+	assert.Equal(t, 4, len(route))
+	assert.Equal(t, *geo.NewPoint(0, 50-portLead), *route[1])
+	assert.Equal(t, *geo.NewPoint(50, 50-portLead), *route[2])
+}
+
+func TestContainerMinimumSize(t *testing.T) {
+	t.Parallel()
+
+	script := `
+x: {
+  a -> b
+}
+y: {
+  c
+}
+x -> y
+`
+	opts := DefaultOpts
+	var computed geo.Point
+	opts.ContainerMinimumSize = func(id string, size geo.Point) geo.Point {
+		if id != "x" {
+			return size
+		}
+		computed = size
+		return geo.Point{X: 600, Y: 400}
+	}
+	g := compileGraph(t, script)
+	explanation := ExplainOptions(g, &opts)
+	assert.True(t, computed.X > 0 && computed.Y > 0)
+	// Down the page, ELK takes the height first
+	x := explanation["x"].(map[string]interface{})
+	assert.Equal(t, "(400, 600)", x["elk.nodeSize.minimum"])
+	y := explanation["y"].(map[string]interface{})
+	assert.NotEqual(t, "(400, 600)", y["elk.nodeSize.minimum"])
+
+	g = layoutGraph(t, script, &opts)
+	for _, obj := range g.Objects {
+		if obj.AbsID() == "x" {
+			assert.True(t, obj.Width >= 600)
+			assert.True(t, obj.Height >= 400)
+		}
+	}
+}
+
+func TestLayerDistance(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> d
+a -> e -> d
+b.height: 200
+e.height: 120
+c.height: 30
+`
+	opts := DefaultOpts
+	opts.LayerDistance = 250
+	g := layoutGraph(t, script, &opts)
+	centers := make(map[string]float64)
+	for _, obj := range g.Objects {
+		centers[obj.ID] = obj.TopLeft.Y + obj.Height/2
+	}
+	for _, layer := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}} {
+		assert.Equal(t, 250., centers[layer[1]]-centers[layer[0]])
+	}
+	// e spans across c, so they share a layer
+	assert.Equal(t, centers["c"], centers["e"])
+	// Edges are routed again between the moved objects
+	for _, e := range g.Edges {
+		start, end := e.Route[0], e.Route[len(e.Route)-1]
+		assert.Equal(t, e.Src.TopLeft.Y+e.Src.Height, start.Y)
+		assert.Equal(t, e.Dst.TopLeft.Y, end.Y)
+	}
+
+	opts.LayerDistance = -1
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: layer distance must not be negative, got -1`)
+}
+
+func TestFunnelEdges(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> x
+b -> x
+c -> x
+d -> x
+`
+	opts := DefaultOpts
+	opts.FunnelEdges = true
+	g := layoutGraph(t, script, &opts)
+	x := g.Edges[0].Dst
+	entry := geo.NewPoint(x.TopLeft.X+x.Width/2, x.TopLeft.Y)
+	line := x.TopLeft.Y - float64(opts.EdgeNodeSpacing)/2
+	for _, e := range g.Edges {
+		n := len(e.Route)
+		assert.Equal(t, *entry, *e.Route[n-1])
+		// They run in together from the line they turn in along
+		assert.Equal(t, entry.X, e.Route[n-2].X)
+		assert.Equal(t, line, e.Route[n-2].Y)
+	}
+
+	// Without it, they're spread along the side
+	g = layoutGraph(t, script, nil)
+	ends := make(map[float64]bool)
+	for _, e := range g.Edges {
+		ends[e.Route[len(e.Route)-1].X] = true
+	}
+	assert.Equal(t, 4, len(ends))
+
+	// An edge the funnel would run through an object is left as it is
+	g = compileGraph(t, `
+a -> x
+b -> x
+obstacle
+`)
+	g.Objects[0].Box = geo.NewBox(geo.NewPoint(0, -20), 20, 20)
+	g.Objects[1].Box = geo.NewBox(geo.NewPoint(0, 200), 100, 40)
+	g.Objects[2].Box = geo.NewBox(geo.NewPoint(80, -20), 20, 20)
+	g.Objects[3].Box = geo.NewBox(geo.NewPoint(20, 170), 20, 20)
+	a, b := g.Edges[0], g.Edges[1]
+	a.Route = []*geo.Point{geo.NewPoint(10, 0), geo.NewPoint(10, 200)}
+	b.Route = []*geo.Point{geo.NewPoint(90, 0), geo.NewPoint(90, 200)}
+	funnelEdges(g, nil, 20, func(*d2graph.Edge) bool { return false })
+	assert.Equal(t, 2, len(a.Route))
+	assert.Equal(t, geo.Point{X: 50, Y: 200}, *b.Route[len(b.Route)-1])
+}
+
+func TestOverflowLabelPosition(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a: a label far too long for its node {
+  width: 40
+  height: 30
+}
+b: fits
+a -> b
+`
+	opts := DefaultOpts
+	opts.OverflowLabelPosition = string(label.OutsideBottomCenter)
+	g := layoutGraph(t, script, &opts)
+	a, b := g.Objects[0], g.Objects[1]
+	assert.Equal(t, string(label.OutsideBottomCenter), *a.LabelPosition)
+	assert.Equal(t, string(label.InsideMiddleCenter), *b.LabelPosition)
+	// a keeps its size, with room for its label below it
+	assert.Equal(t, 40., a.Width)
+	assert.Equal(t, 30., a.Height)
+	assert.True(t, a.TopLeft.Y+a.Height+float64(a.LabelDimensions.Height) <= b.TopLeft.Y)
+
+	// Without it, the label overflows
+	g = layoutGraph(t, script, nil)
+	assert.Equal(t, string(label.InsideMiddleCenter), *g.Objects[0].LabelPosition)
+
+	opts.OverflowLabelPosition = string(label.InsideTopCenter)
+	err := Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid overflow label position "INSIDE_TOP_CENTER"`)
+}
+
+func TestGreedySwitch(t *testing.T) {
+	t.Parallel()
+
+	script := `
+a -> b -> c -> a
+x: {
+  d -> e
+}
+c -> x.d
+a -> x.e
+`
+	opts := DefaultOpts
+	opts.LayoutQuality = "fast"
+	opts.GreedySwitchType = "ONE_SIDED"
+	opts.GreedySwitchThreshold = go2.Pointer(0)
+	explanation := ExplainOptions(compileGraph(t, script), &opts)
+	for _, id := range []string{"root", "x"} {
+		got := explanation[id].(map[string]interface{})
+		assert.Equal(t, "ONE_SIDED", got["elk.layered.crossingMinimization.greedySwitch.type"])
+		assert.Equal(t, "ONE_SIDED", got["elk.layered.crossingMinimization.greedySwitchHierarchical.type"])
+		assert.Equal(t, float64(0), got["elk.layered.crossingMinimization.greedySwitch.activationThreshold"])
+	}
+	g := compileGraph(t, script)
+	err := Layout(context.Background(), g, &opts)
+	assert.Success(t, err)
+	for _, e := range g.Edges {
+		assert.True(t, len(e.Route) >= 2)
+	}
+
+	_, ok := ExplainOptions(compileGraph(t, script), nil)["root"].(map[string]interface{})["elk.layered.crossingMinimization.greedySwitch.activationThreshold"]
+	assert.False(t, ok)
+
+	opts.GreedySwitchType = "THREE_SIDED"
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: invalid greedy switch type "THREE_SIDED"`)
+
+	opts.GreedySwitchType = ""
+	opts.GreedySwitchThreshold = go2.Pointer(-1)
+	err = Layout(context.Background(), compileGraph(t, script), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: greedy switch threshold must not be negative, got -1`)
+}
+
+func TestMaxNodesPerLayer(t *testing.T) {
+	t.Parallel()
+
+	rowsOf := func(objects []*d2graph.Object) map[float64]int {
+		rows := make(map[float64]int)
+		for _, obj := range objects {
+			rows[obj.Center().Y]++
+		}
+		return rows
+	}
+
+	opts := DefaultOpts
+	opts.MaxNodesPerLayer = 3
+	g := layoutGraph(t, `a; b; c; d; e; f; g; h; i; j`, &opts)
+	rows := rowsOf(g.Objects)
+	assert.True(t, len(rows) >= 4)
+	for _, count := range rows {
+		assert.True(t, count <= 3)
+	}
+
+	g = layoutGraph(t, `
+a -> b
+a -> c
+a -> d
+a -> e
+x: {
+  p; q; r; s; t
+}
+a -> x
+`, &opts)
+	rows = rowsOf(g.Root.ChildrenArray)
+	for _, count := range rows {
+		assert.True(t, count <= 3)
+	}
+	x := g.Root.ChildrenArray[len(g.Root.ChildrenArray)-1]
+	rows = rowsOf(x.ChildrenArray)
+	assert.True(t, len(rows) >= 2)
+	for _, count := range rows {
+		assert.True(t, count <= 3)
+	}
+
+	opts.MaxNodesPerLayer = -1
+	err := Layout(context.Background(), compileGraph(t, `a; b`), &opts)
+	assert.ErrorString(t, err, `failed to ELK layout: max nodes per layer must not be negative, got -1`)
+}
@@ -0,0 +1,71 @@
+package d2elklayout
+
+import (
+	"strings"
+
+	"oss.terrastruct.com/util-go/go2"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+var topBottomSwapper = strings.NewReplacer("TOP", "BOTTOM", "BOTTOM", "TOP")
+
+// mirror reflects the laid out g across the middle of its content bounds,
+// left to right if direction is horizontal or top to bottom if it's vertical
+func mirror(g *d2graph.Graph, direction string) {
+	if direction == "" || len(g.Objects) == 0 {
+		return
+	}
+	horizontal := direction == "horizontal"
+	coord := func(p *geo.Point) float64 {
+		if horizontal {
+			return p.X
+		}
+		return p.Y
+	}
+	size := func(obj *d2graph.Object) float64 {
+		if horizontal {
+			return obj.Width
+		}
+		return obj.Height
+	}
+	reflect := func(p *geo.Point, v float64) *geo.Point {
+		if horizontal {
+			return geo.NewPoint(v, p.Y)
+		}
+		return geo.NewPoint(p.X, v)
+	}
+
+	bounds := contentBounds(g)
+	// Reflected across the middle, v lands at min+max-v
+	sum := 2*bounds.TopLeft.X + bounds.Width
+	if !horizontal {
+		sum = 2*bounds.TopLeft.Y + bounds.Height
+	}
+
+	sides := leftRightSwapper
+	if !horizontal {
+		sides = topBottomSwapper
+	}
+	for _, obj := range g.Objects {
+		obj.TopLeft = reflect(obj.TopLeft, sum-coord(obj.TopLeft)-size(obj))
+		obj.LabelPosition = swapSides(obj.LabelPosition, sides)
+		obj.IconPosition = swapSides(obj.IconPosition, sides)
+	}
+	for _, e := range g.Edges {
+		movePoints(e, func(p *geo.Point) *geo.Point {
+			return reflect(p, sum-coord(p))
+		})
+		// Edge labels go left and right along their routes, which keep their direction,
+		// but top and bottom of them by the side they turn to, which reflecting reverses
+		e.LabelPosition = swapSides(e.LabelPosition, topBottomSwapper)
+	}
+}
+
+func swapSides(position *string, sides *strings.Replacer) *string {
+	if position == nil {
+		return nil
+	}
+	return go2.Pointer(sides.Replace(*position))
+}
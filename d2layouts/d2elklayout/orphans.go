@@ -0,0 +1,66 @@
+package d2elklayout
+
+import (
+	"math"
+
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// setAsideOrphans takes the nodes of g's orphans, top-level leaves without edges, out of elkGraph,
+// so that ELK lays out the rest without them for OrphanCorner. Nothing is set aside if everything's an orphan.
+func setAsideOrphans(g *d2graph.Graph, elkGraph *ELKGraph) []*ELKNode {
+	connected := make(map[*d2graph.Object]bool)
+	for _, e := range g.Edges {
+		connected[e.Src] = true
+		connected[e.Dst] = true
+	}
+	orphans := make(map[string]bool)
+	for _, obj := range g.Root.ChildrenArray {
+		if len(obj.ChildrenArray) == 0 && !connected[obj] {
+			orphans[obj.AbsID()] = true
+		}
+	}
+	if len(orphans) == len(elkGraph.Children) {
+		return nil
+	}
+
+	var kept, set []*ELKNode
+	for _, n := range elkGraph.Children {
+		if orphans[n.ID] {
+			set = append(set, n)
+		} else {
+			kept = append(kept, n)
+		}
+	}
+	elkGraph.Children = kept
+	return set
+}
+
+// placeOrphans puts orphans back into the laid out elkGraph, in a square grid in corner of what's laid out,
+// beside it: to its left for the left corners and its right for the right ones, aligned with its top or bottom.
+func placeOrphans(elkGraph *ELKGraph, orphans []*ELKNode, corner string, gutter float64) {
+	if len(orphans) == 0 {
+		return
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, n := range elkGraph.Children {
+		minX, minY = math.Min(minX, n.X), math.Min(minY, n.Y)
+		maxX, maxY = math.Max(maxX, n.X+n.Width), math.Max(maxY, n.Y+n.Height)
+	}
+
+	columns := int(math.Ceil(math.Sqrt(float64(len(orphans)))))
+	width, height := placeCells(orphans, columns, gutter, 0, 0)
+	left, top := maxX+gutter, minY
+	if corner == "top-left" || corner == "bottom-left" {
+		left = minX - gutter - width
+	}
+	if corner == "bottom-left" || corner == "bottom-right" {
+		top = maxY - height
+	}
+	for _, n := range orphans {
+		n.X += left
+		n.Y += top
+	}
+	elkGraph.Children = append(elkGraph.Children, orphans...)
+}
@@ -0,0 +1,70 @@
+package d2elklayout
+
+import (
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// containChildren handles the children of g's containers that poke out of them, as ELK occasionally leaves them
+// when a container's minimum size wins over its content. Under ChildOverflow "error" they're an error naming them,
+// and under "grow" their containers grow over them, to their padding, deepest first.
+func containChildren(g *d2graph.Graph, elkNodes map[string]*ELKNode, overflow string) error {
+	if overflow == "" {
+		return nil
+	}
+	var protruding []string
+	var contain func(*d2graph.Object)
+	contain = func(obj *d2graph.Object) {
+		for _, ch := range obj.ChildrenArray {
+			contain(ch)
+		}
+		if obj == g.Root {
+			return
+		}
+		var top, left, bottom, right float64
+		if n := elkNodes[obj.AbsID()]; n != nil && n.LayoutOptions != nil {
+			top, left, bottom, right, _ = parseSides(n.LayoutOptions.Padding)
+		}
+		for _, ch := range obj.ChildrenArray {
+			if !protrudes(ch.Box, obj.Box) {
+				continue
+			}
+			if overflow == "error" {
+				protruding = append(protruding, fmt.Sprintf("%#v", ch.AbsID()))
+				continue
+			}
+			minX, minY := obj.TopLeft.X, obj.TopLeft.Y
+			maxX, maxY := minX+obj.Width, minY+obj.Height
+			if ch.TopLeft.X < minX {
+				minX = ch.TopLeft.X - left
+			}
+			if ch.TopLeft.Y < minY {
+				minY = ch.TopLeft.Y - top
+			}
+			if ch.TopLeft.X+ch.Width > maxX {
+				maxX = ch.TopLeft.X + ch.Width + right
+			}
+			if ch.TopLeft.Y+ch.Height > maxY {
+				maxY = ch.TopLeft.Y + ch.Height + bottom
+			}
+			obj.TopLeft = geo.NewPoint(minX, minY)
+			obj.Width, obj.Height = maxX-minX, maxY-minY
+		}
+	}
+	contain(g.Root)
+	if len(protruding) > 0 {
+		return fmt.Errorf("children protrude from their containers: %s", strings.Join(protruding, ", "))
+	}
+	return nil
+}
+
+// protrudes is whether child isn't within parent
+func protrudes(child, parent *geo.Box) bool {
+	return geo.PrecisionCompare(child.TopLeft.X, parent.TopLeft.X, geo.PRECISION) < 0 ||
+		geo.PrecisionCompare(child.TopLeft.Y, parent.TopLeft.Y, geo.PRECISION) < 0 ||
+		geo.PrecisionCompare(child.TopLeft.X+child.Width, parent.TopLeft.X+parent.Width, geo.PRECISION) > 0 ||
+		geo.PrecisionCompare(child.TopLeft.Y+child.Height, parent.TopLeft.Y+parent.Height, geo.PRECISION) > 0
+}
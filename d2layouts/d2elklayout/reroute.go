@@ -0,0 +1,124 @@
+package d2elklayout
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"oss.terrastruct.com/util-go/xdefer"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2target"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/shape"
+)
+
+// Reroute routes the edges of moved and of its descendants again after it's been moved in the laid out g,
+// such as by dragging it in an editor, without laying g out again. Routes are orthogonal: straight across
+// where the endpoints face each other, else out of the source and around a corner into the destination,
+// and detoured around objects in the way. Other routes are left as they are, and may now run through moved.
+func Reroute(ctx context.Context, g *d2graph.Graph, moved *d2graph.Object, opts *ConfigurableOpts) (err error) {
+	if opts == nil {
+		opts = &DefaultOpts
+	}
+	defer xdefer.Errorf(&err, "failed to reroute")
+
+	if moved.Graph != g {
+		return fmt.Errorf("%#v isn't in the graph", moved.AbsID())
+	}
+	var bands []labelBand
+	if opts.AvoidContainerLabels {
+		bands = labelBands(g)
+	}
+	for _, e := range g.Edges {
+		if !e.Src.IsDescendantOf(moved) && !e.Dst.IsDescendantOf(moved) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.Route = orthogonalRoute(g, bands, e, opts)
+		e.JunctionPoints = nil
+		if e.Src != e.Dst {
+			repairRoute(g, bands, e)
+		}
+	}
+	return nil
+}
+
+// orthogonalRoute is an orthogonal route for e between where its endpoints are now, traced to their borders
+func orthogonalRoute(g *d2graph.Graph, bands []labelBand, e *d2graph.Edge, opts *ConfigurableOpts) []*geo.Point {
+	src, dst := e.Src.Box, e.Dst.Box
+	if e.Src == e.Dst {
+		// Out of the right and around the top right corner into the top, like ELK's self-loops
+		dRight, dTop := float64(opts.SelfLoopSpacing)/2, float64(opts.SelfLoopSpacing)/2
+		if sides := opts.SelfLoopSides; sides != nil {
+			if sides.Right > 0 {
+				dRight = float64(sides.Right)
+			}
+			if sides.Top > 0 {
+				dTop = float64(sides.Top)
+			}
+		}
+		right, middle := src.TopLeft.X+src.Width, src.TopLeft.Y+src.Height/2
+		center, top := src.TopLeft.X+src.Width/2, src.TopLeft.Y
+		return []*geo.Point{
+			geo.NewPoint(right, middle),
+			geo.NewPoint(right+dRight, middle),
+			geo.NewPoint(right+dRight, top-dTop),
+			geo.NewPoint(center, top-dTop),
+			geo.NewPoint(center, top),
+		}
+	}
+	if e.Src.IsDescendantOf(e.Dst) || e.Dst.IsDescendantOf(e.Src) {
+		return guardRoute(e, straightRoute(e), &Stats{})
+	}
+
+	var route []*geo.Point
+	if srcY, dstY, ok := facing(src.TopLeft.Y, src.Height, dst.TopLeft.Y, dst.Height); ok {
+		lo, hi := math.Max(src.TopLeft.X, dst.TopLeft.X), math.Min(src.TopLeft.X+src.Width, dst.TopLeft.X+dst.Width)
+		if lo <= hi {
+			route = []*geo.Point{geo.NewPoint((lo+hi)/2, srcY), geo.NewPoint((lo+hi)/2, dstY)}
+		}
+	}
+	if srcX, dstX, ok := facing(src.TopLeft.X, src.Width, dst.TopLeft.X, dst.Width); route == nil && ok {
+		lo, hi := math.Max(src.TopLeft.Y, dst.TopLeft.Y), math.Min(src.TopLeft.Y+src.Height, dst.TopLeft.Y+dst.Height)
+		if lo <= hi {
+			route = []*geo.Point{geo.NewPoint(srcX, (lo+hi)/2), geo.NewPoint(dstX, (lo+hi)/2)}
+		}
+	}
+	if route == nil {
+		// Diagonal from each other, so around the corner either way, whichever runs into less
+		srcCenter, dstCenter := src.Center(), dst.Center()
+		horizontalFirst := []*geo.Point{
+			geo.NewPoint(sideTowards(src.TopLeft.X, src.Width, dstCenter.X), srcCenter.Y),
+			geo.NewPoint(dstCenter.X, srcCenter.Y),
+			geo.NewPoint(dstCenter.X, sideTowards(dst.TopLeft.Y, dst.Height, srcCenter.Y)),
+		}
+		verticalFirst := []*geo.Point{
+			geo.NewPoint(srcCenter.X, sideTowards(src.TopLeft.Y, src.Height, dstCenter.Y)),
+			geo.NewPoint(srcCenter.X, dstCenter.Y),
+			geo.NewPoint(sideTowards(dst.TopLeft.X, dst.Width, srcCenter.X), dstCenter.Y),
+		}
+		route = horizontalFirst
+		if countCollisions(g, bands, e, verticalFirst) < countCollisions(g, bands, e, horizontalFirst) {
+			route = verticalFirst
+		}
+	}
+
+	srcShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(e.Src.Shape.Value)], src)
+	dstShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(e.Dst.Shape.Value)], dst)
+	n := len(route)
+	route[0] = shape.TraceToShapeBorder(srcShape, route[0], route[1])
+	route[n-1] = shape.TraceToShapeBorder(dstShape, route[n-1], route[n-2])
+	return route
+}
+
+// sideTowards is the side of the span from min, size long, that faces toward v
+func sideTowards(min, size, v float64) float64 {
+	if v < min+size/2 {
+		return min
+	}
+	return min + size
+}
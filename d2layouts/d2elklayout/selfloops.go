@@ -0,0 +1,68 @@
+package d2elklayout
+
+import (
+	"math"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/lib/geo"
+)
+
+// SelfLoopSides is how far out from each side of their nodes self-loops go, as drawn, so Top is the top
+// whichever way the layout flows. 0 leaves loops past that side where they were laid out.
+type SelfLoopSides struct {
+	Top    int
+	Right  int
+	Bottom int
+	Left   int
+}
+
+// spaceSelfLoops moves the self-loops of g's objects out to the spacing sides sets on each side they go around.
+// The innermost loop past a side is moved to its spacing and those outside it are scaled with it, so that
+// loops nested on a side stay nested.
+func spaceSelfLoops(g *d2graph.Graph, sides SelfLoopSides) {
+	loops := make(map[*d2graph.Object][]*d2graph.Edge)
+	for _, e := range g.Edges {
+		if e.Src == e.Dst && len(e.Route) > 2 {
+			loops[e.Src] = append(loops[e.Src], e)
+		}
+	}
+	for obj, edges := range loops {
+		top, left := obj.TopLeft.Y, obj.TopLeft.X
+		bottom, right := top+obj.Height, left+obj.Width
+		// How far points are past each side of obj, and moving them to a distance past it
+		type side struct {
+			spacing   int
+			past      func(*geo.Point) float64
+			moveTo    func(*geo.Point, float64)
+			innermost float64
+		}
+		all := []*side{
+			{spacing: sides.Top, past: func(p *geo.Point) float64 { return top - p.Y }, moveTo: func(p *geo.Point, d float64) { p.Y = top - d }},
+			{spacing: sides.Right, past: func(p *geo.Point) float64 { return p.X - right }, moveTo: func(p *geo.Point, d float64) { p.X = right + d }},
+			{spacing: sides.Bottom, past: func(p *geo.Point) float64 { return p.Y - bottom }, moveTo: func(p *geo.Point, d float64) { p.Y = bottom + d }},
+			{spacing: sides.Left, past: func(p *geo.Point) float64 { return left - p.X }, moveTo: func(p *geo.Point, d float64) { p.X = left - d }},
+		}
+		for _, s := range all {
+			s.innermost = math.Inf(1)
+			for _, e := range edges {
+				for _, p := range e.Route[1 : len(e.Route)-1] {
+					if d := s.past(p); d > geo.PRECISION {
+						s.innermost = math.Min(s.innermost, d)
+					}
+				}
+			}
+		}
+		// The ends of the loops are on the node, past none of its sides
+		for _, e := range edges {
+			movePoints(e, func(p *geo.Point) *geo.Point {
+				at := *p
+				for _, s := range all {
+					if d := s.past(&at); s.spacing > 0 && d > geo.PRECISION {
+						s.moveTo(p, d*float64(s.spacing)/s.innermost)
+					}
+				}
+				return p
+			})
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package d2elklayout
+
+import (
+	"time"
+
+	"oss.terrastruct.com/util-go/go2"
+)
+
+// ELKVersion is the version of elkjs embedded as elk.js, as noted in NOTICE.txt
+const ELKVersion = "0.8.2"
+
+// Stats reports on how a graph was laid out.
+type Stats struct {
+	// BestEffort is whether the layout is a rough one, because ELK ran out of time under BestEffort
+	BestEffort bool `json:"bestEffort"`
+	// Warnings are about what the layout had to work around, e.g. edges between stacked objects
+	Warnings []string `json:"warnings"`
+	// Crossings is how many edge crossings AvoidCrossings left, nil if it's not set
+	Crossings *int `json:"crossings,omitempty"`
+	// Diagnostics is what Diagnose reports, nil if it's not set
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// Diagnostics describes a layout for reproducing it, under Diagnose
+type Diagnostics struct {
+	// Duration is how long the layout took, start to finish
+	Duration time.Duration `json:"duration"`
+	// ELKVersion is the version of ELK that laid it out
+	ELKVersion string `json:"elkVersion"`
+	// Objects and Edges are how many of each the graph has
+	Objects int `json:"objects"`
+	Edges   int `json:"edges"`
+	// Options are the ELK options set on the root, as sent to ELK, keyed by ELK option path
+	Options map[string]interface{} `json:"options"`
+}
+
+// warn records warning, once
+func (s *Stats) warn(warning string) {
+	if !go2.Contains(s.Warnings, warning) {
+		s.Warnings = append(s.Warnings, warning)
+	}
+}
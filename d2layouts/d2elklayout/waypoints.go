@@ -0,0 +1,76 @@
+package d2elklayout
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2target"
+	"oss.terrastruct.com/d2/lib/geo"
+	"oss.terrastruct.com/d2/lib/shape"
+)
+
+// validateWaypoints rejects waypoints on edges that aren't g's or are self-loops, and edges without any
+func validateWaypoints(g *d2graph.Graph, waypoints map[string][]geo.Point) error {
+	ids := make([]string, 0, len(waypoints))
+	for id := range waypoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if err := validateEdgeIDs(g, ids, "waypoints"); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if len(waypoints[id]) == 0 {
+			return fmt.Errorf("no waypoints on %#v", id)
+		}
+	}
+	return nil
+}
+
+// waypointRoute is an orthogonal route for edge from its source through each of waypoints in turn to its destination.
+// Waypoints not in line with the point before get a corner between, turning out of the side of whichever endpoint
+// that leg leaves or enters, else across first. The ends are traced to the borders of the endpoints' shapes.
+func waypointRoute(edge *d2graph.Edge, waypoints []geo.Point) []*geo.Point {
+	points := []*geo.Point{edge.Src.Center()}
+	for _, wp := range waypoints {
+		points = append(points, geo.NewPoint(wp.X, wp.Y))
+	}
+	points = append(points, edge.Dst.Center())
+
+	route := []*geo.Point{points[0]}
+	for i := 1; i < len(points); i++ {
+		prev, next := points[i-1], points[i]
+		if !sameCoordinate(prev.X, next.X) && !sameCoordinate(prev.Y, next.Y) {
+			corner := geo.NewPoint(next.X, prev.Y)
+			if (i == 1 && inBox(edge.Src.Box, corner)) || (i == len(points)-1 && inBox(edge.Dst.Box, corner)) {
+				corner = geo.NewPoint(prev.X, next.Y)
+			}
+			route = append(route, corner)
+		}
+		route = append(route, next)
+	}
+
+	n := len(route)
+	route[0] = leaveBox(edge.Src.Box, route[0], route[1])
+	route[n-1] = leaveBox(edge.Dst.Box, route[n-1], route[n-2])
+	srcShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Src.Shape.Value)], edge.Src.Box)
+	dstShape := shape.NewShape(d2target.DSL_SHAPE_TO_SHAPE_TYPE[strings.ToLower(edge.Dst.Shape.Value)], edge.Dst.Box)
+	route[0] = shape.TraceToShapeBorder(srcShape, route[0], route[1])
+	route[n-1] = shape.TraceToShapeBorder(dstShape, route[n-1], route[n-2])
+	return route
+}
+
+// leaveBox is where the segment from start, inside box, to next leaves box, or start if next is inside it too
+func leaveBox(box *geo.Box, start, next *geo.Point) *geo.Point {
+	if intersections := box.Intersections(*geo.NewSegment(start, next)); len(intersections) > 0 {
+		return intersections[0]
+	}
+	return start
+}
+
+// inBox is whether p is within box, borders included
+func inBox(box *geo.Box, p *geo.Point) bool {
+	return p.X >= box.TopLeft.X && p.X <= box.TopLeft.X+box.Width && p.Y >= box.TopLeft.Y && p.Y <= box.TopLeft.Y+box.Height
+}
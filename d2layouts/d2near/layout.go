@@ -51,6 +51,10 @@ func Layout(ctx context.Context, g *d2graph.Graph, constantNearGraphs []*d2graph
 						point.X += dx
 						point.Y += dy
 					}
+					for _, point := range subEdge.JunctionPoints {
+						point.X += dx
+						point.Y += dy
+					}
 				}
 			}
 		}
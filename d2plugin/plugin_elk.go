@@ -59,6 +59,20 @@ func (p elkPlugin) Flags(context.Context) ([]PluginSpecificFlag, error) {
 			Usage:   "spacing to be preserved between a node and its self loops",
 			Tag:     "elk.spacing.nodeSelfLoop",
 		},
+		{
+			Name:    "elk-selfLoopDistribution",
+			Type:    "string",
+			Default: d2elklayout.DefaultOpts.SelfLoopDistribution,
+			Usage:   "the sides of a node its self loops are distributed around: EQUALLY, NORTH or NORTH_SOUTH",
+			Tag:     "elk.layered.edgeRouting.selfLoopDistribution",
+		},
+		{
+			Name:    "elk-labelNode",
+			Type:    "int64",
+			Default: int64(d2elklayout.DefaultOpts.LabelNodeSpacing),
+			Usage:   "spacing to be preserved between a node's label and its border",
+			Tag:     "elk.spacing.labelNode",
+		},
 	}, nil
 }
 
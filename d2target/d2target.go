@@ -471,6 +471,8 @@ type Connection struct {
 
 	Route   []*geo.Point `json:"route"`
 	IsCurve bool         `json:"isCurve,omitempty"`
+	// JunctionPoints are where the connection splits off from others it shares a route with
+	JunctionPoints []*geo.Point `json:"junctionPoints,omitempty"`
 
 	Animated bool     `json:"animated"`
 	Tooltip  string   `json:"tooltip"`